@@ -86,23 +86,16 @@ func main() {
 		machine.UART1_RX_PIN,
 		machine.UART1_RX_PIN,
 	)
+	mb.SetAddress(msg.ADDR_CONSOLE)
 	mb.Configure()
 
 	//
-	// Create subscription channels
+	// Subscribe to the messages the console shows
 	//
-	fooCh := make(chan msg.FooMsg)
-	handsetCh := make(chan msg.HandsetMsg)
-	raDriverCh := make(chan msg.RADriverMsg)
-	raDriverCmdCh := make(chan msg.RADriverCmdMsg)
-
-	//
-	// Register the channels with the broker
-	//
-	mb.SetFooCh(fooCh)
-	mb.SetHandsetCh(handsetCh)
-	mb.SetRADriverCh(raDriverCh)
-	mb.SetRADriverCmdCh(raDriverCmdCh)
+	fooCh, _ := msg.Subscribe[msg.FooMsg](&mb, msg.MSG_FOO, msg.SUBSCRIBE_BUFFER)
+	handsetCh, _ := msg.Subscribe[msg.HandsetMsg](&mb, msg.MSG_HANDSET, msg.SUBSCRIBE_BUFFER)
+	raDriverCh, _ := msg.Subscribe[msg.RADriverMsg](&mb, msg.MSG_RADRIVER, msg.SUBSCRIBE_BUFFER)
+	raDriverCmdCh, _ := msg.Subscribe[msg.RADriverCmdMsg](&mb, msg.MSG_RADRIVER_CMD, msg.SUBSCRIBE_BUFFER)
 
 	//
 	// Create the screen
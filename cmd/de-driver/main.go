@@ -2,8 +2,386 @@ package main
 
 import (
 	"fmt"
+
+	"github.com/tonygilkerson/astroeq/pkg/driver"
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+	"github.com/tonygilkerson/astroeq/pkg/msg"
+
+	"machine"
+	"strconv"
+	"time"
 )
 
+// See wire.md for wiring details and pin assignments
+
 func main() {
-	fmt.Println("de-driver")
+
+	// run light
+	runLight()
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Broker
+	/////////////////////////////////////////////////////////////////////////////
+
+	fmt.Println("[main] Create new broker")
+
+	//
+	// UART0
+	//
+	machine.UART0.Configure(machine.UARTConfig{
+		TX: machine.UART0_TX_PIN,
+		RX: machine.UART0_RX_PIN,
+	})
+
+	var uartUp msg.UART
+	var uartUpTxPin machine.Pin
+	var uartUpRxPin machine.Pin
+
+	uartUp = machine.UART0
+	uartUpTxPin = machine.UART0_TX_PIN
+	uartUpRxPin = machine.UART0_RX_PIN
+
+	// Note if UART1 was use it would be used here, however
+	// the de-driver is at the end of the conga line so no UART1 needed
+	var uartDn msg.UART
+	var uartDnTxPin machine.Pin
+	var uartDnRxPin machine.Pin
+
+	mb, err := msg.NewBroker(
+		uartUp,
+		uartUpTxPin,
+		uartUpRxPin,
+		uartDn,
+		uartDnTxPin,
+		uartDnRxPin,
+	)
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	mb.SetAddress(msg.ADDR_DE_DRIVER)
+	mb.Configure()
+
+	//
+	// Subscribe to the messages the driver consumes
+	//
+	fooCh, _ := msg.Subscribe[msg.FooMsg](&mb, msg.MSG_FOO, msg.SUBSCRIBE_BUFFER)
+
+	deDriverCmdCh, _ := msg.Subscribe[msg.DEDriverCmdMsg](&mb, msg.MSG_DEDRIVER_CMD, msg.SUBSCRIBE_BUFFER)
+
+	//
+	// Start the subscription reader, it will read from the the UARTS
+	// and then dispatch message to the proper channels
+	//
+	go mb.SubscriptionReaderRoutine()
+
+	/////////////////////////////////////////////////////////////////////////////
+	// DE-Drive
+	/////////////////////////////////////////////////////////////////////////////
+
+	//
+	// Configure SPI bus
+	//
+	machine.SPI0.Configure(machine.SPIConfig{
+		Frequency: 115200,
+		LSBFirst:  false,
+		Mode:      0,
+		DataBits:  8,
+		SCK:       machine.SPI0_SCK_PIN, // GP18
+		SDO:       machine.SPI0_SDO_PIN, // GP19
+		SDI:       machine.SPI0_SDI_PIN, // GP16
+	})
+
+	//
+	// motor
+	//
+
+	// Select the hardware PWM for the DE Driver
+	var dePWM hal.PWM
+	dePWM = hal.NewPWM(machine.PWM4)
+
+	// Direction North or South
+	deDirectionPin := hal.NewPin(machine.GP8)
+
+	// Enable motor
+	deEnableMotorPin := hal.NewPin(machine.GP13)
+
+	deStep := hal.NewPin(machine.GP9)
+	var deStepsPerRevolution int32 = 400
+	var deMaxHz int32 = 1000
+	var deMaxMicroStepSetting driver.MicroStep = 16
+	var deWormRatio int32 = 144
+	var deGearRatio int32 = 3
+	deMicroStep1 := hal.NewPin(machine.GP12)
+	deMicroStep2 := hal.NewPin(machine.GP11)
+	deEncoderCS := hal.NewPin(machine.GP20)
+	deEncoder, err := encoder.NewAMT22(machine.SPI0, deEncoderCS, encoder.RES14)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	de, err := driver.NewDEDriver(
+		deStep,
+		dePWM,
+		deDirectionPin,
+		deStepsPerRevolution,
+		deMaxHz,
+		deMicroStep1,
+		deMicroStep2,
+		deMaxMicroStepSetting,
+		deEnableMotorPin,
+		deWormRatio,
+		deGearRatio,
+		deEncoder,
+	)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// The park position is saved in flash so the position survives a power cycle
+	de.SetFlash(machine.Flash)
+
+	// The DEC is the end of the line so UART1 is free for the TMC2208, see wire.md
+	machine.UART1.Configure(machine.UARTConfig{
+		BaudRate: 115200,
+		TX:       machine.GP4,
+		RX:       machine.GP5,
+	})
+	deTMC, err := driver.NewTMC2208(machine.UART1)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	de.SetTMC2208(&deTMC)
+	// Alarms raised by the driver are published on the bus
+	deAlarmCh := make(chan driver.Alarm, 4)
+	de.SetAlarmCh(deAlarmCh)
+	deFaultCh := make(chan driver.Fault, 4)
+	de.SetFaultCh(deFaultCh)
+	de.Configure()
+
+	// Stepper driver temperature, the Pico's own sensor and a 10k NTC thermistor on GP26 stuck to the driver heat sink
+	machine.InitADC()
+	deThermistor, err := driver.NewThermistorSensor(hal.NewADC(machine.GP26), 10_000, 10_000, 3950)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	de.ConfigureTemperature(driver.InternalTemperatureSensor{}, deThermistor)
+
+	//
+	// Start the message consumers
+	//
+	go fooConsumerRoutine(fooCh, &mb)
+	go deCmdConsumeRoutine(deDriverCmdCh, &mb, &de)
+	go dePublishInfoRoutine(&de, &mb)
+	go deAlarmRoutine(deAlarmCh, &de, &mb)
+	go deFaultRoutine(deFaultCh, &de, &mb)
+
+	//
+	// Keep main live
+	//
+	for {
+		time.Sleep(time.Millisecond * 5000)
+		fmt.Printf("[de-driver.main] heart beat, position: %v\n", de.GetPosition())
+	}
+
+}
+
+func runLight() {
+
+	// run light
+	led := machine.LED
+	led.Configure(machine.PinConfig{Mode: machine.PinOutput})
+
+	// blink run light for a bit seconds so I can tell it is starting
+	for i := 0; i < 25; i++ {
+		led.High()
+		time.Sleep(time.Millisecond * 100)
+		led.Low()
+		time.Sleep(time.Millisecond * 100)
+	}
+	led.High()
+}
+
+func fooConsumerRoutine(ch chan msg.FooMsg, mb *msg.MsgBroker) {
+
+	for foo := range ch {
+		fmt.Printf("[de-driver.fooConsumerRoutine] - Kind: [%s], Name: [%s]\n", foo.Kind, foo.Name)
+	}
+}
+
+func deCmdConsumeRoutine(ch chan msg.DEDriverCmdMsg, mb *msg.MsgBroker, de *driver.DEDriver) {
+
+	for deCmdMsg := range ch {
+		fmt.Printf("[deCmdConsumeRoutine] - deCmdMsg: [%v]\n", deCmdMsg)
+
+		// A retry of a command already run is only replied to
+		if mb.IsRetry(msg.MSG_DEDRIVER_CMD, deCmdMsg.From, deCmdMsg.Seq) {
+			continue
+		}
+
+		err := deDriverCtl(deCmdMsg, de)
+		if err != nil {
+			fmt.Printf("[deCmdConsumeRoutine] - %v %v\n", deCmdMsg.Cmd, err)
+		}
+		mb.ReplyCmd(msg.MSG_DEDRIVER_CMD, deCmdMsg.From, deCmdMsg.Seq, err)
+	}
+
+}
+
+// Run a command, a *msg.CmdError says the command is unknown or its arguments are bad
+func deDriverCtl(cmdMsg msg.DEDriverCmdMsg, de *driver.DEDriver) error {
+
+	args := cmdMsg.Args
+
+	switch cmdMsg.Cmd {
+
+	case msg.DE_CMD_SET_DIRECTION:
+		// The first argument is the direction "North" or "South"
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		direction := driver.DeValue(args[0])
+		if direction != driver.DE_DIRECTION_NORTH && direction != driver.DE_DIRECTION_SOUTH {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad direction: [%v]", args[0])
+		}
+		de.SetDirection(direction)
+
+	case msg.DE_CMD_SET_MOTOR:
+		// The first argument is the motor "On" or "Off"
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		motor := driver.DeValue(args[0])
+		if motor != driver.DE_MOTOR_ON && motor != driver.DE_MOTOR_OFF {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad motor: [%v]", args[0])
+		}
+		de.SetMotor(motor)
+
+	case msg.DE_CMD_SLEW_TO:
+		// The first argument is the target encoder position
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		target, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad slew target: [%v]", args[0])
+		}
+		return de.SlewTo(target)
+
+	case msg.DE_CMD_ABORT:
+		de.Abort()
+
+	case msg.DE_CMD_PARK:
+		return de.Park()
+
+	case msg.DE_CMD_UNPARK:
+		return de.Unpark()
+
+	case msg.DE_CMD_HOME:
+		return de.Home()
+
+	case msg.DE_CMD_SET_PARK:
+		// The first argument is the park position, without it the current position is used
+		if len(args) == 0 || args[0] == "" {
+			return de.SetPark()
+		}
+		position, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad park position: [%v]", args[0])
+		}
+		return de.SetParkPosition(position)
+
+	case msg.DE_CMD_SET_LIMITS:
+		// The arguments are the min and max positions in encoder counts
+		if err := msg.NeedArgs(args, 2); err != nil {
+			return err
+		}
+		min, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad min limit: [%v]", args[0])
+		}
+		max, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad max limit: [%v]", args[1])
+		}
+		return de.SetLimits(min, max)
+
+	case msg.DE_CMD_CLEAR_ALARM:
+		de.ClearAlarm()
+		de.ClearFault()
+
+	case msg.DE_CMD_SET_BACKLASH:
+		// The arguments are the backlash in encoder counts and the take up rate in Hz
+		if err := msg.NeedArgs(args, 2); err != nil {
+			return err
+		}
+		counts, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad backlash counts: [%v]", args[0])
+		}
+		hz, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad backlash hz: [%v]", args[1])
+		}
+		return de.SetBacklash(uint32(counts), hz)
+
+	default:
+		return msg.NewCmdError(msg.NACK_UNKNOWN_CMD, "unknown command: [%v]", cmdMsg.Cmd)
+	}
+
+	return nil
+}
+
+func dePublishInfoRoutine(de *driver.DEDriver, mb *msg.MsgBroker) {
+
+	for {
+		var deMsg msg.DEDriverMsg
+		deMsg.Kind = msg.MSG_DEDRIVER
+		deMsg.Motor = de.GetMotor()
+		deMsg.Direction = de.GetDirection()
+		deMsg.Position = de.GetPosition()
+		deMsg.Slewing = de.IsSlewing()
+		deMsg.SlewProgress = de.GetSlewProgress()
+		deMsg.Parked = de.IsParked()
+		if status, err := de.GetDriverStatus(); err == nil {
+			deMsg.DriverStatus = status.String()
+		}
+		deMsg.EncoderHealthy = de.IsEncoderHealthy()
+		deMsg.EncoderStats = de.GetEncoderStats().String()
+
+		mb.PublishDEDriver(deMsg)
+
+		time.Sleep(time.Second * 2)
+	}
+}
+
+func deAlarmRoutine(ch chan driver.Alarm, de *driver.DEDriver, mb *msg.MsgBroker) {
+
+	for alarm := range ch {
+		var alarmMsg msg.AlarmMsg
+		alarmMsg.Kind = msg.MSG_ALARM
+		alarmMsg.Source = "DEC"
+		alarmMsg.Alarm = alarm
+		alarmMsg.Position = de.GetPosition()
+
+		mb.PublishAlarm(alarmMsg)
+	}
+}
+
+// There is no DEC fault message, watchdog faults are published as an alarm so the handset shows them
+func deFaultRoutine(ch chan driver.Fault, de *driver.DEDriver, mb *msg.MsgBroker) {
+
+	for fault := range ch {
+		var alarmMsg msg.AlarmMsg
+		alarmMsg.Kind = msg.MSG_ALARM
+		alarmMsg.Source = "DEC"
+		alarmMsg.Alarm = driver.Alarm(fault)
+		alarmMsg.Position = de.GetPosition()
+
+		mb.PublishAlarm(alarmMsg)
+	}
 }
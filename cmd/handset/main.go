@@ -96,20 +96,16 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	mb.SetAddress(msg.ADDR_HANDSET)
 	mb.Configure()
 
 	//
-	// Create subscription channels and
-	// Register the them with the broker
+	// Subscribe to the messages the handset consumes
 	//
-	fooCh := make(chan msg.FooMsg)
-	mb.SetFooCh(fooCh)
-
-	raDriverCh := make(chan msg.RADriverMsg)
-	mb.SetRADriverCh(raDriverCh)
-
-	handsetCh := make(chan msg.HandsetMsg)
-	mb.SetHandsetCh(handsetCh)
+	fooCh, _ := msg.Subscribe[msg.FooMsg](&mb, msg.MSG_FOO, msg.SUBSCRIBE_BUFFER)
+	raDriverCh, _ := msg.Subscribe[msg.RADriverMsg](&mb, msg.MSG_RADRIVER, msg.SUBSCRIBE_BUFFER)
+	alarmCh, _ := msg.Subscribe[msg.AlarmMsg](&mb, msg.MSG_ALARM, msg.SUBSCRIBE_BUFFER)
+	raDriverFaultCh, _ := msg.Subscribe[msg.RADriverFaultMsg](&mb, msg.MSG_RADRIVER_FAULT, msg.SUBSCRIBE_BUFFER)
 
 	//
 	// Start the subscription reader, it will read from the the UARTS
@@ -213,11 +209,18 @@ func main() {
 
 	keyStrokesCh := handset.Configure()
 
+	// Commands the drivers did not acknowledge are shown on the screen
+	cmdResultCh := make(chan hid.CmdResult)
+	handset.SetCmdResultCh(cmdResultCh)
+
 	//
 	// Start the message consumers
 	//
 	go fooConsumerRoutine(fooCh, &mb)
 	go raDriverConsumerRoutine(&handset, raDriverCh, &mb)
+	go alarmConsumerRoutine(&handset, alarmCh, &mb)
+	go raDriverFaultConsumerRoutine(&handset, raDriverFaultCh, &mb)
+	go cmdResultConsumerRoutine(&handset, cmdResultCh)
 
 	//
 	// Start the local key consumer
@@ -282,6 +285,51 @@ func raDriverConsumerRoutine(hs *hid.Handset, ch chan msg.RADriverMsg, mb *msg.M
 		hs.Screen.Tracking = raMsg.Tracking
 		hs.Screen.Direction = raMsg.Direction
 		hs.Screen.Position = raMsg.Position
+		hs.Screen.TrackingRate = raMsg.TrackingRate
+		hs.Screen.Temperature = raMsg.Temperature
+
+		hs.Screen.BodyText = hs.StateMachine(hid.KEY_REFRESH)
+		hs.RenderScreen()
+
+	}
+}
+
+func alarmConsumerRoutine(hs *hid.Handset, ch chan msg.AlarmMsg, mb *msg.MsgBroker) {
+
+	for alarmMsg := range ch {
+		fmt.Printf("[handset.alarmConsumerRoutine] - msg: [%v]\n", alarmMsg)
+
+		hs.Screen.Alarm = alarmMsg.Source + " " + string(alarmMsg.Alarm)
+
+		hs.Screen.BodyText = hs.StateMachine(hid.KEY_REFRESH)
+		hs.RenderScreen()
+
+	}
+}
+
+func raDriverFaultConsumerRoutine(hs *hid.Handset, ch chan msg.RADriverFaultMsg, mb *msg.MsgBroker) {
+
+	for faultMsg := range ch {
+		fmt.Printf("[handset.raDriverFaultConsumerRoutine] - msg: [%v]\n", faultMsg)
+
+		hs.Screen.Fault = faultMsg.Fault
+
+		hs.Screen.BodyText = hs.StateMachine(hid.KEY_REFRESH)
+		hs.RenderScreen()
+
+	}
+}
+
+func cmdResultConsumerRoutine(hs *hid.Handset, ch chan hid.CmdResult) {
+
+	for result := range ch {
+		fmt.Printf("[handset.cmdResultConsumerRoutine] - %v: %v\n", result.Name, result.Err)
+
+		if result.Err != nil {
+			hs.Screen.CmdFailure = result.Failure()
+		} else {
+			hs.Screen.CmdFailure = ""
+		}
 
 		hs.Screen.BodyText = hs.StateMachine(hid.KEY_REFRESH)
 		hs.RenderScreen()
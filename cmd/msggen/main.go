@@ -0,0 +1,586 @@
+//go:build !tinygo
+
+// Generate the encode and decode functions for the bus messages and their round trip tests
+//
+// Run from pkg/msg by go generate, it reads the message structs in MsgInterface and writes
+// msg_gen.go and msg_gen_test.go next to them
+//
+//	go generate ./pkg/msg
+//
+// A message is sent as its parts, the kind first then each field in the order it is in the
+// struct. A field tag changes how it is sent
+//
+//	msg:"-"          the field is not sent
+//	msg:"prec=1"     a float is sent with 1 decimal place, all of them when not set
+//	msg:"nan"        a float is NaN when its part is missing or does not parse
+//	msg:"omitempty"  the part is left off when the field is zero, only after the parts always sent
+//	msg:"join=,"     a []string is sent as one part joined with ","
+//	msg:"rest"       a []string is sent as one part each, it must be the last part
+//
+// Options are separated by spaces, for example msg:"prec=1 nan"
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	UNION_NAME = "MsgInterface"
+	GEN_FILE   = "msg_gen.go"
+	TEST_FILE  = "msg_gen_test.go"
+)
+
+// How a field is sent, from its msg tag
+type field struct {
+	name      string
+	typ       types.Type
+	skip      bool
+	prec      int
+	nan       bool
+	omitEmpty bool
+	join      string
+	rest      bool
+}
+
+type message struct {
+	name   string // The struct, for example RADriverMsg
+	base   string // The name less Msg, for example RADriver
+	fields []field
+}
+
+func main() {
+
+	dir := flag.String("dir", ".", "the directory of the message package")
+	flag.Parse()
+
+	pkg, err := loadPackage(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[msggen] %v\n", err)
+		os.Exit(1)
+	}
+
+	messages, err := readMessages(pkg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[msggen] %v\n", err)
+		os.Exit(1)
+	}
+
+	gen := &generator{pkg: pkg, imports: map[string]bool{}}
+	if err := gen.write(filepath.Join(*dir, GEN_FILE), gen.codecs(messages)); err != nil {
+		fmt.Fprintf(os.Stderr, "[msggen] %v\n", err)
+		os.Exit(1)
+	}
+
+	gen.imports = map[string]bool{}
+	if err := gen.write(filepath.Join(*dir, TEST_FILE), gen.tests(messages)); err != nil {
+		fmt.Fprintf(os.Stderr, "[msggen] %v\n", err)
+		os.Exit(1)
+	}
+
+}
+
+// Parse and type check the package as it builds on the host, less the files generated before
+func loadPackage(dir string) (*types.Package, error) {
+
+	bp, err := build.Default.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range bp.GoFiles {
+		if name == GEN_FILE {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	// Without the generated file the codecs are undefined, the types are still checked
+	config := types.Config{Importer: importer.ForCompiler(fset, "source", nil), Error: func(err error) {}}
+	pkg, _ := config.Check(bp.ImportPath, fset, files, nil)
+	if pkg == nil || pkg.Scope().Lookup(UNION_NAME) == nil {
+		return nil, fmt.Errorf("no %v in %v", UNION_NAME, dir)
+	}
+
+	return pkg, nil
+}
+
+// Returns the messages in the union in the order they are listed
+func readMessages(pkg *types.Package) ([]message, error) {
+
+	union, ok := pkg.Scope().Lookup(UNION_NAME).Type().Underlying().(*types.Interface)
+	if !ok || union.NumEmbeddeds() != 1 {
+		return nil, fmt.Errorf("%v is not a union of messages", UNION_NAME)
+	}
+
+	terms, ok := union.EmbeddedType(0).(*types.Union)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a union of messages", UNION_NAME)
+	}
+
+	var messages []message
+	for i := 0; i < terms.Len(); i++ {
+
+		named, ok := terms.Term(i).Type().(*types.Named)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a named type", terms.Term(i).Type())
+		}
+		st, ok := named.Underlying().(*types.Struct)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a struct", named.Obj().Name())
+		}
+
+		m, err := readMessage(named.Obj().Name(), st)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+func readMessage(name string, st *types.Struct) (message, error) {
+
+	m := message{name: name, base: strings.TrimSuffix(name, "Msg")}
+
+	if st.NumFields() == 0 || st.Field(0).Name() != "Kind" {
+		return m, fmt.Errorf("%v: the first field must be Kind", name)
+	}
+
+	omitting := false
+	for i := 1; i < st.NumFields(); i++ {
+
+		f, err := readField(st.Field(i), reflect.StructTag(st.Tag(i)).Get("msg"))
+		if err != nil {
+			return m, fmt.Errorf("%v.%v: %v", name, st.Field(i).Name(), err)
+		}
+		if f.skip {
+			continue
+		}
+
+		// A part left off must be the last one sent or the parts after it would move
+		if omitting && !f.omitEmpty {
+			return m, fmt.Errorf("%v.%v: must be omitempty, it is after an omitempty field", name, f.name)
+		}
+		omitting = omitting || f.omitEmpty
+
+		if len(m.fields) > 0 && m.fields[len(m.fields)-1].rest {
+			return m, fmt.Errorf("%v.%v: a rest field must be the last field sent", name, f.name)
+		}
+		m.fields = append(m.fields, f)
+	}
+
+	return m, nil
+}
+
+func readField(v *types.Var, tag string) (field, error) {
+
+	f := field{name: v.Name(), typ: v.Type(), prec: -1}
+
+	for _, option := range strings.Fields(tag) {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "-":
+			f.skip = true
+		case "prec":
+			prec, err := strconv.Atoi(value)
+			if err != nil || prec < 0 {
+				return f, fmt.Errorf("bad prec: %v", value)
+			}
+			f.prec = prec
+		case "nan":
+			f.nan = true
+		case "omitempty":
+			f.omitEmpty = true
+		case "join":
+			if value == "" {
+				return f, errors.New("join needs a separator")
+			}
+			f.join = value
+		case "rest":
+			f.rest = true
+		default:
+			return f, fmt.Errorf("unknown option: %v", option)
+		}
+	}
+
+	if f.skip {
+		return f, nil
+	}
+
+	if f.join != "" || f.rest {
+		if !isStringSlice(f.typ) {
+			return f, errors.New("join and rest need a []string")
+		}
+		if f.join != "" && f.rest {
+			return f, errors.New("a field can not be join and rest")
+		}
+		return f, nil
+	}
+
+	basic, ok := f.typ.Underlying().(*types.Basic)
+	if !ok || basic.Info()&(types.IsString|types.IsBoolean|types.IsInteger|types.IsFloat) == 0 {
+		return f, fmt.Errorf("can not send a %v", f.typ)
+	}
+	if (f.prec >= 0 || f.nan) && basic.Info()&types.IsFloat == 0 {
+		return f, errors.New("prec and nan are for floats")
+	}
+
+	return f, nil
+}
+
+func isStringSlice(t types.Type) bool {
+
+	slice, ok := t.Underlying().(*types.Slice)
+	if !ok {
+		return false
+	}
+	basic, ok := slice.Elem().(*types.Basic)
+	return ok && basic.Kind() == types.String
+}
+
+// The lower camel case name, RADriver is raDriver
+func lowerCamel(name string) string {
+
+	runes := []rune(name)
+	n := 0
+	for n < len(runes) && unicode.IsUpper(runes[n]) {
+		n++
+	}
+	// The last capital of a run starts the next word
+	if n > 1 && n < len(runes) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+type generator struct {
+	pkg     *types.Package
+	imports map[string]bool
+}
+
+// The type as it is written in the message package
+func (g *generator) typeName(t types.Type) string {
+
+	return types.TypeString(t, func(p *types.Package) string {
+		if p == g.pkg {
+			return ""
+		}
+		g.imports[p.Path()] = true
+		return p.Name()
+	})
+}
+
+func (g *generator) use(path string) {
+	g.imports[path] = true
+}
+
+// Format the code with the header and imports and write it
+func (g *generator) write(path string, body []byte) error {
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by msggen from the message structs. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %v\n\n", g.pkg.Name())
+
+	var paths []string
+	for p := range g.imports {
+		paths = append(paths, p)
+	}
+	// The standard library first then the rest, as goimports has them
+	sort.Slice(paths, func(i, j int) bool {
+		if isStd(paths[i]) != isStd(paths[j]) {
+			return isStd(paths[i])
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) > 0 {
+		b.WriteString("import (\n")
+		for i, p := range paths {
+			if i > 0 && isStd(paths[i-1]) && !isStd(p) {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "%q\n", p)
+		}
+		b.WriteString(")\n\n")
+	}
+	b.Write(body)
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return os.WriteFile(path, src, 0644)
+}
+
+func isStd(path string) bool {
+	return !strings.Contains(strings.Split(path, "/")[0], ".")
+}
+
+// The parts and make functions for each message
+func (g *generator) codecs(messages []message) []byte {
+
+	var b bytes.Buffer
+	for _, m := range messages {
+		g.encoder(&b, m)
+		g.decoder(&b, m)
+	}
+	return b.Bytes()
+}
+
+func (g *generator) encoder(b *bytes.Buffer, m message) {
+
+	fmt.Fprintf(b, "func %vParts(m %v) []string {\n\n", lowerCamel(m.base), m.name)
+	b.WriteString("msgParts := []string{string(m.Kind)}\n")
+
+	for _, f := range m.fields {
+
+		if f.rest {
+			fmt.Fprintf(b, "msgParts = append(msgParts, m.%v...)\n", f.name)
+			continue
+		}
+		value := g.format(f)
+		if f.omitEmpty {
+			fmt.Fprintf(b, "if %v {\nmsgParts = append(msgParts, %v)\n}\n", g.notZero(f), value)
+			continue
+		}
+		fmt.Fprintf(b, "msgParts = append(msgParts, %v)\n", value)
+	}
+
+	b.WriteString("\nreturn msgParts\n}\n\n")
+}
+
+// The field as a part
+func (g *generator) format(f field) string {
+
+	v := "m." + f.name
+
+	if f.join != "" {
+		g.use("strings")
+		return fmt.Sprintf("strings.Join(%v, %q)", v, f.join)
+	}
+
+	info := f.typ.Underlying().(*types.Basic).Info()
+	switch {
+	case info&types.IsString != 0:
+		return convert(f.typ, types.String, v)
+	case info&types.IsBoolean != 0:
+		g.use("strconv")
+		return fmt.Sprintf("strconv.FormatBool(%v)", convert(f.typ, types.Bool, v))
+	case info&types.IsUnsigned != 0:
+		g.use("strconv")
+		return fmt.Sprintf("strconv.FormatUint(%v, 10)", convert(f.typ, types.Uint64, v))
+	case info&types.IsInteger != 0:
+		g.use("strconv")
+		return fmt.Sprintf("strconv.FormatInt(%v, 10)", convert(f.typ, types.Int64, v))
+	default:
+		g.use("strconv")
+		return fmt.Sprintf("strconv.FormatFloat(%v, 'f', %v, 64)", convert(f.typ, types.Float64, v), f.prec)
+	}
+}
+
+// The value converted to the basic type, as it is when it is that type
+func convert(t types.Type, kind types.BasicKind, v string) string {
+
+	if types.Identical(t, types.Typ[kind]) {
+		return v
+	}
+	return fmt.Sprintf("%v(%v)", types.Typ[kind].Name(), v)
+}
+
+func (g *generator) notZero(f field) string {
+
+	v := "m." + f.name
+	info := f.typ.Underlying().(*types.Basic).Info()
+	switch {
+	case info&types.IsString != 0:
+		return v + ` != ""`
+	case info&types.IsBoolean != 0:
+		return v
+	default:
+		return v + " != 0"
+	}
+}
+
+func (g *generator) decoder(b *bytes.Buffer, m message) {
+
+	fmt.Fprintf(b, "func make%v(msgParts []string) %v {\n\n", m.base, m.name)
+	fmt.Fprintf(b, "var m %v\n\n", m.name)
+	b.WriteString("if len(msgParts) > 0 {\nm.Kind = MsgType(msgParts[0])\n}\n")
+
+	for i, f := range m.fields {
+
+		part := fmt.Sprintf("msgParts[%v]", i+1)
+
+		if f.nan {
+			g.use("math")
+			fmt.Fprintf(b, "\n// NaN when it is not sent\nm.%v = math.NaN()", f.name)
+		}
+		fmt.Fprintf(b, "\nif len(msgParts) > %v {\n", i+1)
+		g.parse(b, f, part, i+1)
+		b.WriteString("}\n")
+	}
+
+	b.WriteString("\nreturn m\n}\n\n")
+}
+
+// Set the field from its part, a part that does not parse leaves the field zero, or NaN
+func (g *generator) parse(b *bytes.Buffer, f field, part string, i int) {
+
+	v := "m." + f.name
+	typ := g.typeName(f.typ)
+
+	if f.rest {
+		fmt.Fprintf(b, "%v = msgParts[%v:]\n", v, i)
+		return
+	}
+	if f.join != "" {
+		g.use("strings")
+		fmt.Fprintf(b, "%v = strings.Split(%v, %q)\n", v, part, f.join)
+		return
+	}
+
+	basic := f.typ.Underlying().(*types.Basic)
+	info := basic.Info()
+	bits := sizeOf(basic)
+
+	if info&types.IsString != 0 {
+		if types.Identical(f.typ, types.Typ[types.String]) {
+			fmt.Fprintf(b, "%v = %v\n", v, part)
+		} else {
+			fmt.Fprintf(b, "%v = %v(%v)\n", v, typ, part)
+		}
+		return
+	}
+
+	g.use("strconv")
+
+	var call string
+	var kind types.BasicKind
+	switch {
+	case info&types.IsBoolean != 0:
+		call, kind = fmt.Sprintf("strconv.ParseBool(%v)", part), types.Bool
+	case info&types.IsUnsigned != 0:
+		call, kind = fmt.Sprintf("strconv.ParseUint(%v, 10, %v)", part, bits), types.Uint64
+	case info&types.IsInteger != 0:
+		call, kind = fmt.Sprintf("strconv.ParseInt(%v, 10, %v)", part, bits), types.Int64
+	default:
+		call, kind = fmt.Sprintf("strconv.ParseFloat(%v, %v)", part, bits), types.Float64
+	}
+
+	switch {
+	case f.nan:
+		fmt.Fprintf(b, "if x, err := %v; err == nil {\n%v = %v\n}\n", call, v, convertTo(f.typ, kind, typ, "x"))
+	case types.Identical(f.typ, types.Typ[kind]):
+		fmt.Fprintf(b, "%v, _ = %v\n", v, call)
+	default:
+		fmt.Fprintf(b, "x, _ := %v\n%v = %v(x)\n", call, v, typ)
+	}
+}
+
+// The value of the basic type converted to the field type, typ is its name
+func convertTo(t types.Type, kind types.BasicKind, typ string, v string) string {
+
+	if types.Identical(t, types.Typ[kind]) {
+		return v
+	}
+	return fmt.Sprintf("%v(%v)", typ, v)
+}
+
+// The size in bits ParseInt, ParseUint and ParseFloat are given, int and uint are 32 bits on the Pico
+func sizeOf(basic *types.Basic) int {
+
+	switch basic.Kind() {
+	case types.Int8, types.Uint8:
+		return 8
+	case types.Int16, types.Uint16:
+		return 16
+	case types.Int32, types.Uint32, types.Float32, types.Int, types.Uint, types.Uintptr:
+		return 32
+	default:
+		return 64
+	}
+}
+
+// A round trip test for each message and a check a message with only its kind can be read
+func (g *generator) tests(messages []message) []byte {
+
+	g.use("reflect")
+	g.use("testing")
+
+	var b bytes.Buffer
+	for _, m := range messages {
+
+		fmt.Fprintf(&b, "func Test%vRoundTrip(t *testing.T) {\n\n", m.base)
+		fmt.Fprintf(&b, "want := %v{\nKind: MsgType(%q),\n", m.name, m.base)
+		for i, f := range m.fields {
+			fmt.Fprintf(&b, "%v: %v,\n", f.name, g.sample(f, i+1))
+		}
+		b.WriteString("}\n\n")
+
+		fmt.Fprintf(&b, "got := make%v(%vParts(want))\n", m.base, lowerCamel(m.base))
+		b.WriteString("if !reflect.DeepEqual(got, want) {\nt.Errorf(\"round trip = %+v, want %+v\", got, want)\n}\n\n")
+
+		b.WriteString("// A message cut short is read as far as it goes\n")
+		fmt.Fprintf(&b, "short := make%v([]string{%q})\n", m.base, m.base)
+		fmt.Fprintf(&b, "if short.Kind != MsgType(%q) {\nt.Errorf(\"short Kind = %%v\", short.Kind)\n}\n", m.base)
+		for _, f := range m.fields {
+			if f.nan {
+				g.use("math")
+				fmt.Fprintf(&b, "if !math.IsNaN(float64(short.%v)) {\nt.Errorf(\"short %v = %%v, want NaN\", short.%v)\n}\n", f.name, f.name, f.name)
+			}
+		}
+		b.WriteString("\n}\n\n")
+	}
+	return b.Bytes()
+}
+
+// A value for the field that is not its zero value and is sent without loss
+func (g *generator) sample(f field, i int) string {
+
+	if f.join != "" || f.rest {
+		return `[]string{"a", "b"}`
+	}
+
+	// A constant needs no conversion to a named type
+	info := f.typ.Underlying().(*types.Basic).Info()
+	switch {
+	case info&types.IsString != 0:
+		return strconv.Quote("v" + strconv.Itoa(i))
+	case info&types.IsBoolean != 0:
+		return "true"
+	case info&types.IsUnsigned != 0:
+		return strconv.Itoa(i)
+	case info&types.IsInteger != 0:
+		return strconv.Itoa(-100 * i)
+	case f.prec == 0:
+		return "12"
+	default:
+		return "12.5"
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 
 	"github.com/tonygilkerson/astroeq/pkg/driver"
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
 	"github.com/tonygilkerson/astroeq/pkg/msg"
 
 	"machine"
 	"math"
+	"strconv"
 	"time"
 )
 
@@ -69,22 +72,18 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	mb.SetAddress(msg.ADDR_RA_DRIVER)
 	mb.Configure()
 
 	//
+	// Subscribe to the messages the driver consumes
 	//
-	// Create subscription channels and
-	// Register the them with the broker
-	//
-	fooCh := make(chan msg.FooMsg)
-	mb.SetFooCh(fooCh)
+	fooCh, _ := msg.Subscribe[msg.FooMsg](&mb, msg.MSG_FOO, msg.SUBSCRIBE_BUFFER)
 
 	// DEVTODO - delete me soon if not needed, I dont think the ra-driver needs to consume this message only publish it
-	// raDriverCh := make(chan msg.RADriverMsg)
-	// mb.SetRADriverCh(raDriverCh)
+	// raDriverCh, _ := msg.Subscribe[msg.RADriverMsg](&mb, msg.MSG_RADRIVER, msg.SUBSCRIBE_BUFFER)
 
-	raDriverCmdCh := make(chan msg.RADriverCmdMsg)
-	mb.SetRADriverCmdCh(raDriverCmdCh)
+	raDriverCmdCh, _ := msg.Subscribe[msg.RADriverCmdMsg](&mb, msg.MSG_RADRIVER_CMD, msg.SUBSCRIBE_BUFFER)
 	//
 	// Start the subscription reader, it will read from the the UARTS
 	// and then dispatch message to the proper channels
@@ -113,25 +112,29 @@ func main() {
 	//
 
 	// Select the hardware PWM for the RA Driver
-	var raPWM driver.PWM
-	raPWM = machine.PWM4
+	var raPWM hal.PWM
+	raPWM = hal.NewPWM(machine.PWM4)
 
 	// Direction North or South
-	raDirectionPin := machine.GP8
+	raDirectionPin := hal.NewPin(machine.GP8)
 
 	// Enable motor
-	raEnableMotorPin := machine.GP13
+	raEnableMotorPin := hal.NewPin(machine.GP13)
 
-	raStep := machine.GP9
+	raStep := hal.NewPin(machine.GP9)
 	var raStepsPerRevolution int32 = 400
 	var raMaxHz int32 = 1000
 	var raMaxMicroStepSetting driver.MicroStep = 16
 	var raWormRatio int32 = 144
 	var raGearRatio int32 = 3
-	raMicroStep1 := machine.GP12
-	raMicroStep2 := machine.GP11
-	raEncoderSPI := *machine.SPI0
-	raEncoderCS := machine.GP20
+	raMicroStep1 := hal.NewPin(machine.GP12)
+	raMicroStep2 := hal.NewPin(machine.GP11)
+	raEncoderCS := hal.NewPin(machine.GP20)
+	raEncoder, err := encoder.NewAMT22(machine.SPI0, raEncoderCS, encoder.RES14)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	ra, _ := driver.NewRADriver(
 		raStep,
 		raPWM,
@@ -144,10 +147,44 @@ func main() {
 		raEnableMotorPin,
 		raWormRatio,
 		raGearRatio,
-		raEncoderSPI,
-		raEncoderCS,
+		raEncoder,
 	)
+	// The park position is saved in flash so the position survives a power cycle
+	ra.SetFlash(machine.Flash)
+
+	// Both hardware UARTs carry the bus so the TMC2208 is on a soft UART on GP10, see wire.md
+	raTMCUART, err := hal.NewSoftUART(hal.NewPin(machine.GP10), 19200)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	raTMCUART.Configure()
+	raTMC, err := driver.NewTMC2208(raTMCUART)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ra.SetTMC2208(&raTMC)
+	// Alarms raised by the driver are published on the bus
+	raAlarmCh := make(chan driver.Alarm, 4)
+	ra.SetAlarmCh(raAlarmCh)
+	raFaultCh := make(chan driver.Fault, 4)
+	ra.SetFaultCh(raFaultCh)
 	ra.Configure()
+
+	// ST-4 autoguider port
+	raST4West := hal.NewPin(machine.GP2)
+	raST4East := hal.NewPin(machine.GP3)
+	ra.ConfigureST4(raST4West, raST4East)
+
+	// Stepper driver temperature, the Pico's own sensor and a 10k NTC thermistor on GP26 stuck to the driver heat sink
+	machine.InitADC()
+	raThermistor, err := driver.NewThermistorSensor(hal.NewADC(machine.GP26), 10_000, 10_000, 3950)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ra.ConfigureTemperature(driver.InternalTemperatureSensor{}, raThermistor)
 	//ra.RunAtHz(700.0)
 	//ra.RunAtHz(300.0)
 	//ra.RunAtHz(200.0)
@@ -161,23 +198,24 @@ func main() {
 	go fooConsumerRoutine(fooCh, &mb)
 	go raCmdConsumeRoutine(raDriverCmdCh, &mb, &ra)
 	go raPublishInfoRoutine(&ra, &mb)
+	go raAlarmRoutine(raAlarmCh, &ra, &mb)
+	go raFaultRoutine(raFaultCh, &ra, &mb)
 
-	var position uint32 = 0
-	var lastPosition int = 0
+	var position int64 = 0
+	var lastPosition int64 = 0
 
 	//
-	// Track by the second
+	// Track by the second, the limits stop the motor if it tracks too far, they are on from
+	// the start a quarter turn either side of home and SetLimits saves its own with the park state
 	//
-
-	for i := 0; i < 6000; i++ {
+	for {
 
 		position = ra.GetPosition()
 
-		pos := int(position)
-		perSec := math.Abs(float64(pos - lastPosition))
+		perSec := math.Abs(float64(position - lastPosition))
 
-		fmt.Printf("[main] position: %v, per sec: %.2f (81.92 expected))\n", position, perSec)
-		lastPosition = pos
+		fmt.Printf("[main] position: %v, per sec: %.2f, tracking error: %.1f, correction: %.3f Hz\n", position, perSec, ra.GetTrackingError(), ra.GetTrackingCorrection())
+		lastPosition = position
 		time.Sleep(time.Millisecond * 1000)
 
 		//
@@ -187,34 +225,9 @@ func main() {
 		// The encoder positions are from 0 to 2^14 (16_384)
 		// So we should be able to just multiple by the gear ratios:
 		// 16_384 (1 motor turn) * 3 (main gear) * 144 (worm gear) = 7_077_888
-		// if position >= 7_077_888 {
-		// 	break
-		// }
 
 	}
 
-	fmt.Println("[main] Reset RA and track by min...")
-	ra.ZeroRA() // DEVTODO does not seem to work, make sure I am clearing the rotation count as well
-	time.Sleep(time.Millisecond * 5000)
-
-	//
-	// Track for a few min
-	for i := 0; i < 15; i++ {
-
-		position = ra.GetPosition()
-
-		pos := int(position)
-		perMin := math.Abs(float64(pos - lastPosition))
-
-		fmt.Printf("[main] position: %v, per min: %.2f (4915.2 expected))\n", position, perMin)
-		lastPosition = pos
-		time.Sleep(time.Millisecond * 60000)
-
-	}
-
-	// Done
-	println("[main] Done!")
-
 }
 
 func runLight() {
@@ -244,24 +257,184 @@ func raCmdConsumeRoutine(ch chan msg.RADriverCmdMsg, mb *msg.MsgBroker, ra *driv
 
 	for raCmdMsg := range ch {
 		fmt.Printf("[raCmdConsumeRoutine] - raCmdMsg: [%v]\n", raCmdMsg)
-		raDriverCtl(raCmdMsg, ra)
+
+		// A retry of a command already run is only replied to
+		if mb.IsRetry(msg.MSG_RADRIVER_CMD, raCmdMsg.From, raCmdMsg.Seq) {
+			continue
+		}
+
+		err := raDriverCtl(raCmdMsg, ra)
+		if err != nil {
+			fmt.Printf("[raCmdConsumeRoutine] - %v %v\n", raCmdMsg.Cmd, err)
+		}
+		mb.ReplyCmd(msg.MSG_RADRIVER_CMD, raCmdMsg.From, raCmdMsg.Seq, err)
 	}
 
 }
 
-func raDriverCtl(cmdMsg msg.RADriverCmdMsg, ra *driver.RADriver) {
+// Run a command, a *msg.CmdError says the command is unknown or its arguments are bad
+func raDriverCtl(cmdMsg msg.RADriverCmdMsg, ra *driver.RADriver) error {
+
+	args := cmdMsg.Args
 
 	switch cmdMsg.Cmd {
 
 	case msg.RA_CMD_SET_DIRECTION:
 		// The first argument is the direction "North" or "South"
-		ra.SetDirection(driver.RaValue(cmdMsg.Args[0]))
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		direction := driver.RaValue(args[0])
+		if direction != driver.RA_DIRECTION_NORTH && direction != driver.RA_DIRECTION_SOUTH {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad direction: [%v]", args[0])
+		}
+		ra.SetDirection(direction)
 
 	case msg.RA_CMD_SET_TRACKING:
 		// The first argument is the tracking "On" or "Off"
-		ra.SetTracking(driver.RaValue(cmdMsg.Args[0]))
-
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		tracking := driver.RaValue(args[0])
+		if tracking != driver.RA_TRACKING_ON && tracking != driver.RA_TRACKING_OFF {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad tracking: [%v]", args[0])
+		}
+		ra.SetTracking(tracking)
+
+	case msg.RA_CMD_SLEW_TO:
+		// The first argument is the target encoder position
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		target, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad slew target: [%v]", args[0])
+		}
+		return ra.SlewTo(target)
+
+	case msg.RA_CMD_ABORT:
+		ra.Abort()
+
+	case msg.RA_CMD_PARK:
+		return ra.Park()
+
+	case msg.RA_CMD_UNPARK:
+		return ra.Unpark()
+
+	case msg.RA_CMD_HOME:
+		return ra.Home()
+
+	case msg.RA_CMD_SET_PARK:
+		// The first argument is the park position, without it the current position is used
+		if len(args) == 0 || args[0] == "" {
+			return ra.SetPark()
+		}
+		position, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad park position: [%v]", args[0])
+		}
+		return ra.SetParkPosition(position)
+
+	case msg.RA_CMD_SET_LIMITS:
+		// The arguments are the min and max positions in encoder counts
+		if err := msg.NeedArgs(args, 2); err != nil {
+			return err
+		}
+		min, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad min limit: [%v]", args[0])
+		}
+		max, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad max limit: [%v]", args[1])
+		}
+		return ra.SetLimits(min, max)
+
+	case msg.RA_CMD_SET_TEMP_LIMITS:
+		// The arguments are the throttle and max temperatures in °C
+		if err := msg.NeedArgs(args, 2); err != nil {
+			return err
+		}
+		throttleC, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad throttle temperature: [%v]", args[0])
+		}
+		maxC, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad max temperature: [%v]", args[1])
+		}
+		return ra.SetTemperatureLimits(throttleC, maxC)
+
+	case msg.RA_CMD_CLEAR_ALARM:
+		ra.ClearAlarm()
+		ra.ClearFault()
+
+	case msg.RA_CMD_SET_BACKLASH:
+		// The arguments are the backlash in encoder counts and the take up rate in Hz
+		if err := msg.NeedArgs(args, 2); err != nil {
+			return err
+		}
+		counts, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad backlash counts: [%v]", args[0])
+		}
+		hz, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad backlash hz: [%v]", args[1])
+		}
+		return ra.SetBacklash(uint32(counts), hz)
+
+	case msg.RA_CMD_CAL_BACKLASH:
+		return ra.CalibrateBacklash()
+
+	case msg.RA_CMD_SET_TRACKING_RATE:
+		// The first argument is the rate, a custom rate has its arc seconds per second as the second argument
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		rate := driver.TrackingRate(args[0])
+		if rate == driver.TRACKING_RATE_CUSTOM && len(args) > 1 {
+			arcsecPerSecond, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad custom rate: [%v]", args[1])
+			}
+			return ra.SetCustomTrackingRate(arcsecPerSecond)
+		}
+		return ra.SetTrackingRate(rate)
+
+	case msg.RA_CMD_PEC_RECORD:
+		return ra.StartPECRecording()
+
+	case msg.RA_CMD_PEC_PLAYBACK:
+		// The first argument is playback "On" or "Off"
+		if err := msg.NeedArgs(args, 1); err != nil {
+			return err
+		}
+		playback := driver.RaValue(args[0])
+		if playback != driver.RA_PEC_PLAYBACK_ON && playback != driver.RA_PEC_PLAYBACK_OFF {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad playback: [%v]", args[0])
+		}
+		return ra.SetPECPlayback(playback == driver.RA_PEC_PLAYBACK_ON)
+
+	case msg.RA_CMD_PEC_CLEAR:
+		ra.ClearPEC()
+
+	case msg.RA_CMD_GUIDE:
+		// The arguments are the direction "West" or "East" and the duration in milliseconds
+		if err := msg.NeedArgs(args, 2); err != nil {
+			return err
+		}
+		ms, err := strconv.Atoi(args[1])
+		if err != nil {
+			return msg.NewCmdError(msg.NACK_BAD_ARGS, "bad guide duration: [%v]", args[1])
+		}
+		return ra.Guide(driver.GuideDirection(args[0]), time.Duration(ms)*time.Millisecond)
+
+	default:
+		return msg.NewCmdError(msg.NACK_UNKNOWN_CMD, "unknown command: [%v]", cmdMsg.Cmd)
 	}
+
+	return nil
 }
 
 func raPublishInfoRoutine(ra *driver.RADriver, mb *msg.MsgBroker) {
@@ -272,9 +445,46 @@ func raPublishInfoRoutine(ra *driver.RADriver, mb *msg.MsgBroker) {
 		raMsg.Tracking = ra.GetTracking()
 		raMsg.Direction = ra.GetDirection()
 		raMsg.Position = ra.GetPosition()
+		raMsg.Slewing = ra.IsSlewing()
+		raMsg.SlewProgress = ra.GetSlewProgress()
+		raMsg.TrackingRate = ra.GetTrackingRate()
+		raMsg.PEC = ra.GetPECState()
+		raMsg.Parked = ra.IsParked()
+		if status, err := ra.GetDriverStatus(); err == nil {
+			raMsg.DriverStatus = status.String()
+		}
+		raMsg.EncoderHealthy = ra.IsEncoderHealthy()
+		raMsg.EncoderStats = ra.GetEncoderStats().String()
+		raMsg.Temperature = ra.GetTemperature()
 
 		mb.PublishRADriver(raMsg)
 
 		time.Sleep(time.Second * 2)
 	}
 }
+
+func raAlarmRoutine(ch chan driver.Alarm, ra *driver.RADriver, mb *msg.MsgBroker) {
+
+	for alarm := range ch {
+		var alarmMsg msg.AlarmMsg
+		alarmMsg.Kind = msg.MSG_ALARM
+		alarmMsg.Source = "RA"
+		alarmMsg.Alarm = alarm
+		alarmMsg.Position = ra.GetPosition()
+
+		mb.PublishAlarm(alarmMsg)
+	}
+}
+
+func raFaultRoutine(ch chan driver.Fault, ra *driver.RADriver, mb *msg.MsgBroker) {
+
+	for fault := range ch {
+		var faultMsg msg.RADriverFaultMsg
+		faultMsg.Kind = msg.MSG_RADRIVER_FAULT
+		faultMsg.Fault = fault
+		faultMsg.Expected, faultMsg.Measured = ra.GetFaultSteps()
+		faultMsg.Position = ra.GetPosition()
+
+		mb.PublishRADriverFault(faultMsg)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !tinygo
+
+// Run the RA driver against the simulated mount on the desktop
+//
+//	go run ./cmd/ra-sim -scale 600 -pe 20 -minutes 30
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/driver"
+	"github.com/tonygilkerson/astroeq/pkg/sim"
+)
+
+func main() {
+
+	config := sim.DefaultConfig()
+	flag.Float64Var(&config.Scale, "scale", config.Scale, "how much faster than real time to run")
+	flag.Float64Var(&config.PeriodicErrorArcsec, "pe", 0, "periodic error, peak arc seconds")
+	flag.Float64Var(&config.BacklashArcsec, "backlash", 0, "backlash in arc seconds")
+	flag.Float64Var(&config.SPIErrorRate, "spi-errors", 0, "fraction of encoder reads to corrupt")
+	flag.IntVar(&config.EncoderNoiseCounts, "noise", 0, "encoder noise in counts")
+	minutes := flag.Int("minutes", 20, "simulated minutes to track for")
+	pec := flag.Bool("pec", false, "record PEC over the first worm turn then play it back")
+	flag.Parse()
+
+	mount := sim.NewMount(config, time.Now())
+	clock := mount.GetClock()
+
+	ra, err := mount.NewRADriver()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ra.Configure()
+	ra.RunAtSiderealRate()
+	ra.SetTracking(driver.RA_TRACKING_ON)
+
+	if *pec {
+		if err := ra.StartPECRecording(); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	start := clock.Now()
+	startArcsec := mount.GetAxisArcsec()
+
+	for i := 1; i <= *minutes; i++ {
+		clock.Sleep(time.Minute)
+
+		// Play back once the recording is done
+		if *pec && ra.GetPECState() == driver.PEC_OFF {
+			if err := ra.SetPECPlayback(true); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		elapsed := clock.Now().Sub(start).Seconds()
+		trackingError := mount.GetAxisArcsec() - startArcsec - driver.SIDEREAL_RATE_ARCSEC*elapsed
+		reads, badReads := mount.GetReads()
+
+		fmt.Printf("[main] %3d min, sky error: %7.2f arcsec, encoder error: %7.1f counts, pec: %v, fault: %q, reads: %v/%v, encoder: %v\n",
+			i, trackingError, ra.GetTrackingError(), ra.GetPECState(), ra.GetFault(), badReads, reads, ra.GetEncoderStats())
+	}
+
+}
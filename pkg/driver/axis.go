@@ -0,0 +1,680 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+type AxisDirection uint8
+
+const (
+	// Direction pin high, encoder counts go up
+	AXIS_FORWARD AxisDirection = iota
+	// Direction pin low, encoder counts go down
+	AXIS_REVERSE
+)
+
+// Encoder reads
+const (
+	// How often the position is read while tracking or stopped
+	POSITION_INTERVAL = time.Millisecond * 700 //DEVTODO - not sure if this is too short or too long?
+
+	// Read at least this often so the encoder turns less than POSITION_MAX_TURNS between reads
+	POSITION_MAX_TURNS    = 0.25
+	POSITION_MIN_INTERVAL = time.Millisecond * 5
+)
+
+// An Axis is one motor of the mount, a stepper on a TMC2208 with an AMT22 encoder on the
+// motor shaft driving the axis through a gear train
+//
+// The RADriver and DEDriver are thin configurations on top of an Axis
+type Axis struct {
+
+	// The monitor, slew, tracking, guide and temperature routines share the axis state with the
+	// caller, mu guards all of it. Exported methods take the lock, the unexported helpers expect it held.
+	mu *sync.Mutex
+
+	// Used to label log messages, for example "RA" or "DEC"
+	name string
+
+	// A pulse to this pin will step the motor
+	stepPin hal.Pin
+
+	// The hardware PWM that drives the stepPin
+	pwm hal.PWM
+
+	// The PWM channel for the stepPin
+	pwmChannel uint8
+
+	// The pin that controls the direction of the motor rotation
+	directionPin hal.Pin
+
+	// The pin that controls the enabling or disabling of the motor
+	enableMotorPin hal.Pin
+
+	// The steps need for one full revolution of the motor
+	// For example a 1.8° motor takes 200 steps per revolution, a 0.9° motor takes 400 steps per revolution, etc...
+	// This is a physical properity of the motor and should NOT account for micro stepping
+	stepsPerRevolution int32
+
+	// The maximum PWM cycle in Hz that the motor can accept
+	// This is a physical properity of the motor, and for my nima17 0.9° this is around 1_000 Hz
+	maxHz int32
+
+	runningHz float64
+
+	// Microstep Pins
+	//
+	//  ms1  ms2  Steps       Interpolation
+	//  ---  ---  ----------- -------------
+	//   H    L   1/2         1/256
+	//   L    H   1/4         1/256
+	//   L    L   1/8         1/256
+	//   H    H   1/16        1/256
+	//
+	microStep1 hal.Pin
+	microStep2 hal.Pin
+
+	// The micro stepping setting full, half, quarter, etc...
+	// Use 2 for half, 4 for quarter etc...
+	microStepSetting MicroStep
+
+	// The limit or "highest" setting, probably 16
+	maxMicroStepSetting MicroStep
+
+	// When slews switch to a coarser microstep, see microstep.go
+	microStepPolicy MicroStepPolicy
+
+	// The gear ratios of the axis
+	// reference: http://www.astrofriend.eu/astronomy/astronomy-calculations/mount-gearbox-ratio/mount-gearbox-ratio.html
+	// Common worm drives are 130:1, 135:1, 144:1, 180:1, 435:1; thus use values of 130, 135, 144, 180 or 435 respectively
+	wormRatio int32
+
+	// Common primary gear ratios are from 1:1 to 75:1; thus use values 1 to 75 respectively
+	// This is the total ratio of all gears combined, for example:
+	// if you have a primary gearbox with a ratio of 12:1 and a secondary gearbox with a ration of 10:1 then set GearRatio to (12*10) or 120
+	gearRatio int32
+
+	// The encoder on the motor shaft
+	enc encoder.Encoder
+
+	// The last position read from the encoder
+	position int64
+
+	// The time the position was last read from the encoder
+	positionTime time.Time
+
+	// GoTo slewing
+	slew slewState
+
+	// Backlash compensation
+	backlash backlashState
+
+	// Park position and the flash it is saved in
+	park parkState
+
+	// Software limits and the alarm raised when one is passed
+	limits limitState
+
+	// Stall and runaway detection
+	watchdog watchdogState
+
+	// The TMC2208 UART, nil if the microstep is set with the MS pins
+	tmc *TMC2208
+
+	// Driver temperature and thermal throttling
+	thermal thermalState
+
+	// The time the axis runs on, the wall clock unless it is simulated
+	clock hal.Clock
+}
+
+// Returns a new Axis
+func NewAxis(
+	name string,
+	stepPin hal.Pin,
+	pwm hal.PWM,
+	directionPin hal.Pin,
+	stepsPerRevolution int32,
+	maxHz int32,
+	microStep1 hal.Pin,
+	microStep2 hal.Pin,
+	maxMicroStepSetting MicroStep,
+	enableMotorPin hal.Pin,
+	wormRatio int32,
+	gearRatio int32,
+	enc encoder.Encoder,
+
+) (Axis, error) {
+
+	// Settings above 16 need the TMC2208 UART, see SetTMC2208
+	if !isMicroStep(maxMicroStepSetting) {
+		return Axis{}, errors.New("maxMicroStepSetting must be 2, 4, 8, 16, 32, 64, 128 or 256")
+	}
+
+	if stepsPerRevolution < 1 {
+		return Axis{}, errors.New("stepsPerRevolution must be greater than 0, typical values are 200 or 400")
+	}
+
+	if maxHz < 1 {
+		return Axis{}, errors.New("maxHz must be greater than 0, typical value is 1000")
+	}
+
+	if wormRatio < 1 {
+		return Axis{}, errors.New("wormRatio must be greater than 0, use 1 if not using a worm gear, typical value is 400")
+	}
+
+	if gearRatio < 1 {
+		return Axis{}, errors.New("gearRatio must be greater than 0, use 1 if not using a gearbox, typical values between 1 and 75")
+	}
+
+	if enc == nil {
+		return Axis{}, errors.New("an encoder is required, for example encoder.NewAMT22")
+	}
+
+	// Limits from the start so the axis is protected before SetLimits is called
+	limit := int64(LIMIT_DEFAULT_TURNS * float64(enc.CountsPerRevolution()) * float64(wormRatio) * float64(gearRatio))
+
+	slewMicroStep := MicroStep(MICROSTEP_DEFAULT_SLEW)
+	if slewMicroStep > maxMicroStepSetting {
+		slewMicroStep = maxMicroStepSetting
+	}
+
+	axis := Axis{
+		mu:                  new(sync.Mutex),
+		name:                name,
+		stepPin:             stepPin,
+		pwm:                 pwm,
+		directionPin:        directionPin,
+		stepsPerRevolution:  stepsPerRevolution,
+		maxHz:               maxHz,
+		runningHz:           0,
+		microStep1:          microStep1,
+		microStep2:          microStep2,
+		microStepSetting:    maxMicroStepSetting,
+		maxMicroStepSetting: maxMicroStepSetting,
+		microStepPolicy: MicroStepPolicy{
+			SlewMicroStep: slewMicroStep,
+			ThresholdHz:   float64(maxHz) * MICROSTEP_DEFAULT_THRESHOLD,
+		},
+		enableMotorPin: enableMotorPin,
+		wormRatio:      wormRatio,
+		gearRatio:      gearRatio,
+		slew: slewState{
+			accelHz: float64(maxHz) * SLEW_DEFAULT_ACCEL_FACTOR,
+		},
+		backlash: backlashState{
+			hz: float64(maxHz) * BACKLASH_DEFAULT_HZ_FACTOR,
+		},
+		limits: limitState{
+			enabled: true,
+			min:     HOME_POSITION - limit,
+			max:     HOME_POSITION + limit,
+		},
+		watchdog: watchdogState{
+			enabled: true,
+		},
+		thermal: thermalState{
+			celsius:   math.NaN(),
+			throttleC: TEMP_DEFAULT_THROTTLE_C,
+			maxC:      TEMP_DEFAULT_MAX_C,
+		},
+		clock: hal.SystemClock{},
+		enc:   enc,
+	}
+
+	return axis, nil
+}
+
+// Configure the pins and PWM, restore or zero the encoder and start monitoring the position
+//
+// The motor is left disabled
+func (ax *Axis) Configure() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	//
+	// Configure the machine PWM for the axis
+	// See https://datasheets.raspberrypi.com/rp2040/rp2040-datasheet.pdf
+	//     4.5.2. Programmer’s Model
+	//
+	ax.pwm.Configure(hal.PWMConfig{Period: 0})
+	ax.pwmChannel, _ = ax.pwm.Channel(ax.stepPin)
+	ax.pwm.Set(ax.pwmChannel, ax.pwm.Top()/2)
+
+	//
+	// Microstepping
+	//
+	microStep1 := ax.microStep1
+	microStep2 := ax.microStep2
+	microStep1.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	microStep2.Configure(hal.PinConfig{Mode: hal.PinOutput})
+
+	if ax.tmc != nil {
+		if err := ax.tmc.Configure(); err != nil {
+			fmt.Printf("[Configure] %v %v, using the MS pins\n", ax.name, err)
+			ax.tmc = nil
+		}
+	}
+
+	// The MS pins only go to 1/16
+	if ax.tmc == nil && ax.maxMicroStepSetting > MS_SIXTEENTH {
+		fmt.Printf("[Configure] %v maxMicroStepSetting %v needs the TMC2208 UART, using 16\n", ax.name, ax.maxMicroStepSetting)
+		ax.maxMicroStepSetting = MS_SIXTEENTH
+	}
+
+	// The rates are worked out from maxMicroStepSetting
+	ax.setMicroStepSetting(ax.maxMicroStepSetting)
+
+	// Direction
+	ax.directionPin.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	ax.setAxisDirection(AXIS_FORWARD)
+
+	// Enable Motor
+	ax.enableMotorPin.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	ax.setEnabled(false)
+
+	// Encoder, the position is restored if the axis was parked, see park.go
+	ax.restorePosition()
+
+	// Start go routine to monitor position
+	go ax.monitorPositionRoutine()
+
+}
+
+// If the TMC2208 does not take the new setting the old one is kept so the rates still match the driver
+func (ax *Axis) setMicroStepSetting(ms MicroStep) {
+
+	if ax.tmc != nil {
+		if err := ax.tmc.SetMicroStep(ms); err != nil {
+			fmt.Printf("[setMicroStepSetting] %v %v\n", ax.name, err)
+			return
+		}
+		ax.microStepSetting = ms
+		fmt.Printf("[setMicroStepSetting] %v microStepSetting %v over UART\n", ax.name, ms)
+		return
+	}
+
+	ax.microStepSetting = ms
+
+	//  ms1  ms2  Steps       Interpolation
+	//  ---  ---  ----------- -------------
+	//   H    L   1/2         1/256
+	//   L    H   1/4         1/256
+	//   L    L   1/8         1/256
+	//   H    H   1/16        1/256
+
+	switch ax.microStepSetting {
+	case 2:
+		ax.microStep1.High()
+		ax.microStep2.Low()
+		fmt.Printf("[setMicroStepSetting] %v microStepSetting 2-H L\n", ax.name)
+	case 4:
+		ax.microStep1.Low()
+		ax.microStep2.High()
+		fmt.Printf("[setMicroStepSetting] %v microStepSetting 4-L H\n", ax.name)
+	case 8:
+		ax.microStep1.Low()
+		ax.microStep2.Low()
+		fmt.Printf("[setMicroStepSetting] %v microStepSetting 8-L L\n", ax.name)
+	case 16:
+		ax.microStep1.High()
+		ax.microStep2.High()
+		fmt.Printf("[setMicroStepSetting] %v microStepSetting 16-H H\n", ax.name)
+	default:
+		ax.microStep1.High()
+		ax.microStep2.High()
+		fmt.Printf("[setMicroStepSetting] %v microStepSetting default 16-H H\n", ax.name)
+	}
+
+}
+
+// Step the motor at the given rate
+func (ax *Axis) RunAtHz(hz float64) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.runAtHz(hz)
+
+}
+
+func (ax *Axis) runAtHz(hz float64) {
+
+	fmt.Printf("[RunAtHz] Set %v hz to: %.2f\n", ax.name, hz)
+	ax.setPWMHz(hz)
+
+}
+
+// Stop stepping, the motor stays enabled and holds its position
+func (ax *Axis) Stop() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.stop()
+
+}
+
+func (ax *Axis) stop() {
+
+	ax.runningHz = 0
+	ax.pwm.Set(ax.pwmChannel, 0)
+
+}
+
+// Set the rate in steps a second at maxMicroStepSetting, the PWM is scaled to the microstep in use
+func (ax *Axis) setPWMHz(hz float64) {
+
+	pulseHz := hz / ax.microStepScale(ax.microStepSetting)
+	period := uint64(math.Round(1e9 / pulseHz))
+
+	// Save Hz on the axis
+	ax.runningHz = hz
+
+	// Set period for hardware PWM, the duty cycle is set again because Top changes with the period
+	ax.pwm.SetPeriod(period)
+	ax.pwm.Set(ax.pwmChannel, ax.pwm.Top()/2)
+}
+
+// Returns the rate the motor is being stepped at
+func (ax *Axis) GetRunningHz() float64 {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.runningHz
+}
+
+// Returns the motor steps for one encoder count at the highest microstep setting
+func (ax *Axis) stepsPerCount() float64 {
+	return float64(ax.stepsPerRevolution) * float64(ax.maxMicroStepSetting) / float64(ax.countsPerMotorRevolution())
+}
+
+// Returns the encoder counts for one turn of the motor, it depends on the encoder resolution
+func (ax *Axis) countsPerMotorRevolution() uint32 {
+	return ax.enc.CountsPerRevolution()
+}
+
+// Returns the encoder counts for one full turn of the axis
+//
+// The encoder turns with the motor so it sees the whole gear reduction
+func (ax *Axis) countsPerAxisRevolution() float64 {
+	return float64(ax.countsPerMotorRevolution()) * float64(ax.wormRatio) * float64(ax.gearRatio)
+}
+
+func (ax *Axis) monitorPositionRoutine() {
+
+	for {
+		ax.mu.Lock()
+
+		position, err := ax.enc.GetPosition()
+		if err == nil {
+			ax.position = position
+			ax.positionTime = ax.clock.Now()
+			ax.checkLimits()
+			ax.checkWatchdog()
+		} else {
+			fmt.Printf("[monitorPositionRoutine] Error getting %v position: %v\n", ax.name, err)
+			ax.checkEncoderHealth()
+		}
+		interval := ax.positionInterval()
+
+		ax.mu.Unlock()
+		ax.clock.Sleep(interval)
+	}
+}
+
+// Returns how long to wait before the next encoder read
+//
+// The slew ramp and backlash take up need a fresh position on every step, and the encoder
+// is read often enough that the motor turns less than POSITION_MAX_TURNS between reads
+func (ax *Axis) positionInterval() time.Duration {
+
+	interval := POSITION_INTERVAL
+	if ax.slew.active || ax.backlash.active {
+		interval = SLEW_INTERVAL
+	}
+
+	turnsPerSecond := ax.runningHz / (float64(ax.stepsPerRevolution) * float64(ax.maxMicroStepSetting))
+	if turnsPerSecond > 0 {
+		interval = time.Duration(math.Min(float64(interval), POSITION_MAX_TURNS/turnsPerSecond*1e9))
+	}
+
+	if interval < POSITION_MIN_INTERVAL {
+		interval = POSITION_MIN_INTERVAL
+	}
+	return interval
+}
+
+// Zero the encoder, the current position becomes position zero
+func (ax *Axis) Zero() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.zero()
+
+}
+
+func (ax *Axis) zero() {
+
+	if err := ax.enc.Zero(); err != nil {
+		fmt.Printf("[Zero] %v encoder not zeroed: %v\n", ax.name, err)
+		return
+	}
+	ax.position = 0
+	ax.positionTime = time.Time{}
+	ax.resetWatchdog()
+
+	// A parked axis must restore the new zero after a power cycle
+	if ax.park.parked {
+		ax.saveParkState()
+	}
+
+}
+
+func (ax *Axis) GetPosition() int64 {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.position
+}
+
+func (ax *Axis) GetAxisDirection() AxisDirection {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.axisDirection()
+}
+
+func (ax *Axis) axisDirection() AxisDirection {
+	if ax.directionPin.Get() {
+		return AXIS_FORWARD
+	} else {
+		return AXIS_REVERSE
+	}
+}
+
+// Set the direction of the motor, if the direction changes the backlash is taken up first
+func (ax *Axis) SetAxisDirection(direction AxisDirection) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.setAxisDirection(direction)
+
+}
+
+func (ax *Axis) setAxisDirection(direction AxisDirection) {
+
+	changed := direction != ax.axisDirection()
+
+	if direction == AXIS_FORWARD {
+		ax.directionPin.High()
+	} else {
+		ax.directionPin.Low()
+	}
+
+	// Past a limit the axis may only move back toward the safe side
+	if ax.isUnsafe(direction) && ax.isEnabled() {
+		fmt.Printf("[SetAxisDirection] %v %v, motor disabled\n", ax.name, ax.limits.alarm)
+		ax.stop()
+		ax.setEnabled(false)
+		return
+	}
+
+	if changed {
+		ax.takeUpBacklash()
+	}
+
+}
+
+// Returns true if the motor is enabled
+func (ax *Axis) IsEnabled() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.isEnabled()
+}
+
+func (ax *Axis) isEnabled() bool {
+	// Enabled if pin is low
+	return !ax.enableMotorPin.Get()
+}
+
+func (ax *Axis) SetEnabled(enabled bool) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.setEnabled(enabled)
+}
+
+// Returns why the motor can not be enabled to turn the axis in dir, nil if it can
+func (ax *Axis) canEnable(dir AxisDirection) error {
+
+	if ax.park.parked {
+		return fmt.Errorf("%v is parked, unpark it first", ax.name)
+	}
+
+	if ax.watchdog.fault != FAULT_NONE {
+		return fmt.Errorf("%v %v fault, clear the fault first", ax.name, ax.watchdog.fault)
+	}
+
+	if ax.thermal.overTemp {
+		return fmt.Errorf("%v is too hot, let it cool first", ax.name)
+	}
+
+	if ax.isUnsafe(dir) {
+		return fmt.Errorf("%v %v, clear the alarm or reverse first", ax.name, ax.limits.alarm)
+	}
+
+	return nil
+}
+
+func (ax *Axis) setEnabled(enabled bool) error {
+
+	if enabled {
+		if err := ax.canEnable(ax.axisDirection()); err != nil {
+			fmt.Printf("[SetEnabled] %v\n", err)
+			return err
+		}
+	}
+
+	if enabled {
+		ax.enableMotorPin.Low() // Enabled if pin is low
+	} else {
+		ax.enableMotorPin.High()
+	}
+
+	// The direction changed while the motor was disabled
+	if enabled && ax.backlash.pending {
+		ax.takeUpBacklash()
+	}
+
+	return nil
+}
+
+// Restart the encoder, for example after it became unhealthy, the position is kept
+func (ax *Axis) ResetEncoder() error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.enc.Reset()
+}
+
+// Returns the encoder read statistics, see encoder.ReadStats
+func (ax *Axis) GetEncoderStats() encoder.ReadStats {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.enc.GetStats()
+}
+
+// Returns false once the encoder has failed too many reads in a row
+func (ax *Axis) IsEncoderHealthy() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.enc.IsHealthy()
+}
+
+// Run the axis on another clock, for example a simulated one, call this before Configure
+func (ax *Axis) SetClock(clock hal.Clock) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.clock = clock
+
+	// Encoders that count turns in software time their reads as well
+	if enc, ok := ax.enc.(interface{ SetClock(hal.Clock) }); ok {
+		enc.SetClock(clock)
+	}
+
+}
+
+// Use the TMC2208 UART instead of the MS pins, call this before Configure
+func (ax *Axis) SetTMC2208(tmc *TMC2208) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.tmc = tmc
+
+}
+
+// Returns the TMC2208 status flags, an error if the TMC2208 UART is not used
+func (ax *Axis) GetDriverStatus() (TMCStatus, error) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if ax.tmc == nil {
+		return TMCStatus{}, errors.New("no TMC2208 UART")
+	}
+	return ax.tmc.ReadStatus()
+}
+
+// Sleep with the lock let go, called with the lock held
+func (ax *Axis) sleepUnlocked(d time.Duration) {
+
+	ax.mu.Unlock()
+	ax.clock.Sleep(d)
+	ax.mu.Lock()
+
+}
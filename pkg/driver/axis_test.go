@@ -0,0 +1,339 @@
+package driver
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+func TestMicroStepPins(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	//  ms1  ms2  Steps
+	//  ---  ---  -----
+	//   H    L   1/2
+	//   L    H   1/4
+	//   L    L   1/8
+	//   H    H   1/16
+	tests := []struct {
+		ms  MicroStep
+		ms1 bool
+		ms2 bool
+	}{
+		{MS_HALF, true, false},
+		{MS_QUARTER, false, true},
+		{MS_EIGHTH, false, false},
+		{MS_SIXTEENTH, true, true},
+	}
+
+	for _, tt := range tests {
+		ra.setMicroStepSetting(tt.ms)
+
+		if ms1, ms2 := hw.microStep1.Get(), hw.microStep2.Get(); ms1 != tt.ms1 || ms2 != tt.ms2 {
+			t.Errorf("1/%v: ms1 %v ms2 %v, want ms1 %v ms2 %v", tt.ms, ms1, ms2, tt.ms1, tt.ms2)
+		}
+		if ms := ra.GetMicroStepSetting(); ms != tt.ms {
+			t.Errorf("GetMicroStepSetting = %v, want %v", ms, tt.ms)
+		}
+	}
+
+}
+
+func TestMicroStepScalesPWM(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	// The rate is in steps at 1/16, at 1/4 each pulse is four of those steps
+	ra.setMicroStepSetting(MS_SIXTEENTH)
+	ra.RunAtHz(800)
+	if hz := hw.pwm.GetHz(0); math.Abs(hz-800) > 1e-3 {
+		t.Errorf("1/16: PWM = %v Hz, want 800 Hz", hz)
+	}
+
+	ra.setMicroStepSetting(MS_QUARTER)
+	ra.RunAtHz(800)
+	if hz := hw.pwm.GetHz(0); math.Abs(hz-200) > 1e-3 {
+		t.Errorf("1/4: PWM = %v Hz, want 200 Hz", hz)
+	}
+	if hz := ra.GetRunningHz(); hz != 800 {
+		t.Errorf("GetRunningHz = %v, want 800", hz)
+	}
+
+}
+
+func TestMicroStepPolicy(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+
+	// 1/4 is the default slew microstep, the switch is at 800 Hz
+	ra.setMicroStepSetting(MS_SIXTEENTH)
+
+	ra.applyMicroStepPolicy(700)
+	if ms := ra.GetMicroStepSetting(); ms != MS_SIXTEENTH {
+		t.Errorf("700 Hz: microstep %v, want %v", ms, MS_SIXTEENTH)
+	}
+
+	ra.applyMicroStepPolicy(900)
+	if ms := ra.GetMicroStepSetting(); ms != MS_QUARTER {
+		t.Errorf("900 Hz: microstep %v, want %v", ms, MS_QUARTER)
+	}
+
+	// Inside the hysteresis it stays at 1/4
+	ra.applyMicroStepPolicy(700)
+	if ms := ra.GetMicroStepSetting(); ms != MS_QUARTER {
+		t.Errorf("700 Hz after a slew: microstep %v, want %v", ms, MS_QUARTER)
+	}
+
+	ra.applyMicroStepPolicy(600)
+	if ms := ra.GetMicroStepSetting(); ms != MS_SIXTEENTH {
+		t.Errorf("600 Hz: microstep %v, want %v", ms, MS_SIXTEENTH)
+	}
+
+	if err := ra.SetMicroStepPolicy(MicroStepPolicy{SlewMicroStep: MS_THIRTY_SECOND, ThresholdHz: 800}); err == nil {
+		t.Error("SetMicroStepPolicy above maxMicroStepSetting should fail")
+	}
+
+	// Not MS_ settings, 0 would divide by zero
+	for _, ms := range []MicroStep{0, 1, 3} {
+		if err := ra.SetMicroStepPolicy(MicroStepPolicy{SlewMicroStep: ms, ThresholdHz: 800}); err == nil {
+			t.Errorf("SetMicroStepPolicy with SlewMicroStep %v should fail", ms)
+		}
+	}
+
+}
+
+func TestSlewRefused(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+
+	// The motor could not be enabled, the slew would wait for ever
+	ra.watchdog.fault = FAULT_STALL
+	if err := ra.SlewTo(10_000); err == nil {
+		t.Error("SlewTo with a fault should fail")
+	}
+	ra.watchdog.fault = FAULT_NONE
+
+	ra.thermal.overTemp = true
+	if err := ra.SlewTo(10_000); err == nil {
+		t.Error("SlewTo when too hot should fail")
+	}
+	ra.thermal.overTemp = false
+
+	if ra.IsSlewing() {
+		t.Error("a refused slew is in progress")
+	}
+
+}
+
+func TestSlewEndsWhenDisabled(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+
+	if err := ra.SlewTo(10_000); err != nil {
+		t.Fatalf("SlewTo: %v", err)
+	}
+
+	// Once the slew has the motor on, the encoder never moves so only the disabled motor ends it
+	deadline := time.Now().Add(time.Second)
+	for !ra.IsEnabled() {
+		if time.Now().After(deadline) {
+			ra.Abort()
+			t.Fatal("the slew did not enable the motor")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ra.SetEnabled(false)
+	for ra.IsSlewing() {
+		if time.Now().After(deadline) {
+			ra.Abort()
+			t.Fatal("the slew did not end after the motor was disabled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+}
+
+func TestParkRecord(t *testing.T) {
+
+	// Write blocks smaller and larger than the record
+	for _, writeBlockSize := range []int64{4, 256} {
+		ra, hw := newTestRADriver(t)
+		flash := hal.NewFakeFlash(8192, writeBlockSize, 4096)
+		ra.SetFlash(flash)
+
+		hw.enc.SetPosition(12_345)
+		ra.position = 12_345
+		ra.park.parked = true
+		if err := ra.SetParkPosition(12_000); err != nil {
+			t.Fatalf("write block %v: SetParkPosition: %v", writeBlockSize, err)
+		}
+
+		record, err := ra.loadParkState()
+		if err != nil {
+			t.Fatalf("write block %v: loadParkState: %v", writeBlockSize, err)
+		}
+		if !record.parked || record.parkPosition != 12_000 || record.position != 12_345 {
+			t.Errorf("write block %v: record = %+v", writeBlockSize, record)
+		}
+	}
+
+}
+
+func TestLimitsSaved(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+
+	// On from the start, a quarter turn of the axis either side of home
+	quarter := int64(LIMIT_DEFAULT_TURNS * ra.countsPerAxisRevolution())
+	if min, max, enabled := ra.GetLimits(); !enabled || min != -quarter || max != quarter {
+		t.Errorf("GetLimits = %v, %v, %v, want %v, %v, true", min, max, enabled, -quarter, quarter)
+	}
+
+	flash := hal.NewFakeFlash(8192, 256, 4096)
+	ra.SetFlash(flash)
+	if err := ra.SetLimits(-1000, 2000); err != nil {
+		t.Fatalf("SetLimits: %v", err)
+	}
+	ra.ClearLimits()
+
+	// After a power cycle the saved limits are back on
+	booted, _ := newTestRADriver(t)
+	booted.SetFlash(flash)
+	booted.restorePosition()
+	if min, max, enabled := booted.GetLimits(); !enabled || min != -1000 || max != 2000 {
+		t.Errorf("after boot GetLimits = %v, %v, %v, want -1000, 2000, true", min, max, enabled)
+	}
+
+}
+
+// A fake encoder that keeps its zero in software, like the AS5600
+type zeroOffsetEncoder struct {
+	*encoder.FakeEncoder
+	offset uint16
+}
+
+func (e *zeroOffsetEncoder) GetZeroOffset() uint16 {
+	return e.offset
+}
+
+func (e *zeroOffsetEncoder) SetZeroOffset(offset uint16) {
+	e.offset = offset
+}
+
+func TestZeroOffsetSaved(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+	flash := hal.NewFakeFlash(8192, 256, 4096)
+	ra.SetFlash(flash)
+	ra.enc = &zeroOffsetEncoder{FakeEncoder: hw.enc, offset: 1234}
+
+	hw.enc.SetPosition(5_000)
+	ra.position = 5_000
+	ra.park.parked = true
+	if err := ra.SetParkPosition(5_000); err != nil {
+		t.Fatalf("SetParkPosition: %v", err)
+	}
+
+	// After a power cycle the zero is back before the position is restored
+	booted, bootedHW := newTestRADriver(t)
+	booted.SetFlash(flash)
+	enc := &zeroOffsetEncoder{FakeEncoder: bootedHW.enc}
+	booted.enc = enc
+	bootedHW.enc.SetPosition(5_000)
+	booted.restorePosition()
+	if enc.offset != 1234 {
+		t.Errorf("zero offset = %v, want 1234", enc.offset)
+	}
+	if !booted.IsParked() || booted.GetPosition() != 5_000 {
+		t.Errorf("parked %v at %v, want parked at 5000", booted.IsParked(), booted.GetPosition())
+	}
+
+}
+
+func TestZeroOffsetNotSaved(t *testing.T) {
+
+	// Saved from an encoder that keeps its own zero
+	ra, hw := newTestRADriver(t)
+	flash := hal.NewFakeFlash(8192, 256, 4096)
+	ra.SetFlash(flash)
+	hw.enc.SetPosition(5_000)
+	ra.position = 5_000
+	ra.park.parked = true
+	if err := ra.SetParkPosition(5_000); err != nil {
+		t.Fatalf("SetParkPosition: %v", err)
+	}
+
+	// Restored to one that does not, the saved position is not trusted
+	booted, bootedHW := newTestRADriver(t)
+	booted.SetFlash(flash)
+	booted.enc = &zeroOffsetEncoder{FakeEncoder: bootedHW.enc}
+	bootedHW.enc.SetPosition(5_000)
+	booted.restorePosition()
+	if booted.IsParked() || booted.GetPosition() != 0 {
+		t.Errorf("parked %v at %v, want unparked at 0", booted.IsParked(), booted.GetPosition())
+	}
+
+}
+
+// A TMC2208 UART with nothing on the other end
+type deadTMCUART struct{}
+
+func (u deadTMCUART) Buffered() int {
+	return 0
+}
+
+func (u deadTMCUART) ReadByte() (byte, error) {
+	return 0, errors.New("no reply")
+}
+
+func (u deadTMCUART) Write(data []byte) (n int, err error) {
+	return 0, errors.New("not connected")
+}
+
+func TestMicroStepKeptOnTMCError(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+	tmc, err := NewTMC2208(deadTMCUART{})
+	if err != nil {
+		t.Fatalf("NewTMC2208: %v", err)
+	}
+	ra.tmc = &tmc
+
+	ra.setMicroStepSetting(MS_QUARTER)
+	if ms := ra.GetMicroStepSetting(); ms != MS_SIXTEENTH {
+		t.Errorf("GetMicroStepSetting = %v, want %v after the TMC2208 failed", ms, MS_SIXTEENTH)
+	}
+
+}
+
+func TestSlewTopHzOnTMCError(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+	tmc, err := NewTMC2208(deadTMCUART{})
+	if err != nil {
+		t.Fatalf("NewTMC2208: %v", err)
+	}
+	ra.tmc = &tmc
+
+	// The switch to 1/4 fails, at 1/16 the ramp must stop at maxHz, it gets there in one step
+	ra.SetSlewAcceleration(100_000)
+	if err := ra.SlewTo(1_000_000); err != nil {
+		t.Fatalf("SlewTo: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for ra.GetRunningHz() < 1000 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	hz := ra.GetRunningHz()
+	ra.Abort()
+
+	if hz != 1000 {
+		t.Errorf("slew rate %v Hz at %v, want the 1000 Hz maxHz", hz, ra.GetMicroStepSetting())
+	}
+
+}
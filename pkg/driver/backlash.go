@@ -0,0 +1,314 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Backlash compensation
+//
+// The worm and belt have slack that must be taken up after the motor reverses before the axis
+// moves. When the direction changes the motor is run at a fast rate until the encoder has moved
+// by the backlash amount, then the previous rate is restored.
+//
+// The encoder is on the motor shaft so it does not see the axis, but it does see the load. A
+// stepper driving the gears trails its step by a little, inside the slack it has no load and keeps
+// up. CalibrateBacklash reverses at a slow rate and times the dead band from the encoder against
+// the step count, the slack ends where the encoder falls behind the steps.
+const (
+	// The default take up rate as a fraction of maxHz
+	BACKLASH_DEFAULT_HZ_FACTOR = 0.5
+
+	// The calibration turns the motor this far each way, the slack must be less
+	BACKLASH_CALIBRATE_TURNS = 0.05
+
+	// The encoder must fall behind the steps by at least this many counts once the gears engage
+	BACKLASH_CALIBRATE_MIN_LAG = 4
+)
+
+type backlashState struct {
+	// The slack in encoder counts, 0 turns compensation off
+	counts uint32
+
+	// The rate the slack is taken up at
+	hz float64
+
+	// True while the slack is being taken up
+	active bool
+
+	// Set when the direction changes with the motor disabled, the slack is taken up once enabled
+	pending bool
+
+	// The encoder counts moved by the last take up
+	lastCounts uint32
+
+	// True while CalibrateBacklash runs
+	calibrating bool
+
+	// The error from the last calibration, nil if it measured the slack
+	calibrateErr error
+}
+
+// Set the backlash in encoder counts and the rate in Hz used to take it up, use 0 counts to turn it off
+func (ax *Axis) SetBacklash(counts uint32, hz float64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if hz <= 0 || hz > float64(ax.maxHz) {
+		return fmt.Errorf("backlash hz must be greater than 0 and at most maxHz (%v)", ax.maxHz)
+	}
+
+	// More than a full turn of the motor is not slack
+	if counts >= ax.countsPerMotorRevolution() {
+		return errors.New("backlash must be less than one motor revolution")
+	}
+
+	ax.backlash.counts = counts
+	ax.backlash.hz = hz
+
+	return nil
+}
+
+// Returns the backlash in encoder counts and the take up rate in Hz
+func (ax *Axis) GetBacklash() (counts uint32, hz float64) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.backlash.counts, ax.backlash.hz
+}
+
+// Returns the encoder counts the motor turned in the last take up, less than the backlash if it timed out
+func (ax *Axis) GetLastBacklashTakeUp() uint32 {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.backlash.lastCounts
+}
+
+// Run through the slack at the take up rate, blocks until the encoder has moved by the backlash amount
+//
+// Called with the lock held, it is let go while waiting so the monitor can read the encoder
+func (ax *Axis) takeUpBacklash() {
+
+	if ax.backlash.counts == 0 || ax.backlash.active {
+		return
+	}
+
+	if !ax.isEnabled() {
+		ax.backlash.pending = true
+		return
+	}
+	ax.backlash.pending = false
+
+	// The monitor polls faster while active, wait for a reading taken after the reversal
+	ax.backlash.active = true
+	ax.waitForReading()
+	start := ax.position
+
+	previousHz := ax.runningHz
+	ax.setPWMHz(ax.backlash.hz)
+
+	// Allow three times as long as it should take before giving up
+	stepsNeeded := float64(ax.backlash.counts) * ax.stepsPerCount()
+	timeout := ax.clock.Now().Add(time.Duration(3*stepsNeeded/ax.backlash.hz*1e9) + time.Second)
+
+	for absDiff(ax.position, start) < uint64(ax.backlash.counts) && ax.clock.Now().Before(timeout) {
+		ax.sleepUnlocked(SLEW_INTERVAL)
+	}
+
+	ax.backlash.lastCounts = uint32(absDiff(ax.position, start))
+	fmt.Printf("[takeUpBacklash] %v took up %v counts\n", ax.name, ax.backlash.lastCounts)
+
+	if previousHz > 0 {
+		ax.setPWMHz(previousHz)
+	} else {
+		ax.stop()
+	}
+	ax.backlash.active = false
+
+}
+
+// Measure the backlash with the encoder at hz, use a slow rate such as the tracking rate
+//
+// The motor turns forward to load the gears, then back until they engage the other way. On the
+// reversal the encoder jumps back as the load lets go, then keeps up with the steps through the
+// slack, then falls behind by the load once the gears engage. The steps made before it falls
+// behind are the slack. It returns right away, use IsCalibratingBacklash to follow it and
+// GetBacklash for the result. The take up rate is not changed.
+func (ax *Axis) CalibrateBacklash(hz float64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	previousHz := ax.runningHz
+	return ax.calibrateBacklash(hz, func() {
+		if previousHz > 0 {
+			ax.setPWMHz(previousHz)
+		}
+	})
+}
+
+// Start a calibration at hz, done is called with the lock held to restore the rate when it ends for any reason
+func (ax *Axis) calibrateBacklash(hz float64, done func()) error {
+
+	if hz <= 0 || hz > float64(ax.maxHz) {
+		return fmt.Errorf("calibration hz must be greater than 0 and at most maxHz (%v)", ax.maxHz)
+	}
+
+	if ax.backlash.calibrating {
+		return errors.New("backlash calibration already in progress")
+	}
+
+	if ax.slew.active {
+		return errors.New("slew in progress")
+	}
+
+	if err := ax.canEnable(AXIS_FORWARD); err != nil {
+		return err
+	}
+	if err := ax.canEnable(AXIS_REVERSE); err != nil {
+		return err
+	}
+
+	// The take up and tracking stay off and the monitor polls faster while active
+	ax.backlash.calibrating = true
+	ax.backlash.active = true
+	ax.backlash.calibrateErr = nil
+
+	go ax.calibrateBacklashRoutine(hz, done)
+
+	return nil
+}
+
+// Returns true while CalibrateBacklash runs
+func (ax *Axis) IsCalibratingBacklash() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.backlash.calibrating
+}
+
+// Returns why the last calibration failed, nil if it measured the slack
+func (ax *Axis) GetBacklashCalibrationError() error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.backlash.calibrateErr
+}
+
+func (ax *Axis) calibrateBacklashRoutine(hz float64, done func()) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	forward := ax.axisDirection()
+	reverse := AXIS_FORWARD
+	if forward == AXIS_FORWARD {
+		reverse = AXIS_REVERSE
+	}
+	wasEnabled := ax.isEnabled()
+
+	maxCounts := BACKLASH_CALIBRATE_TURNS * float64(ax.countsPerMotorRevolution())
+	runTime := time.Duration(maxCounts * ax.stepsPerCount() / hz * 1e9)
+
+	// Load the gears in the direction the axis was going
+	ax.setPWMHz(hz)
+	err := ax.setEnabled(true)
+	if err == nil {
+		ax.sleepUnlocked(runTime)
+		ax.stop()
+		ax.waitForReading()
+
+		err = ax.measureBacklash(reverse, hz, runTime)
+	}
+	ax.stop()
+
+	ax.backlash.active = false
+	ax.backlash.calibrating = false
+	ax.backlash.calibrateErr = err
+	if err != nil {
+		fmt.Printf("[calibrateBacklash] %v %v\n", ax.name, err)
+	}
+
+	// Back the way it was going, the new slack is taken up on the way
+	ax.setAxisDirection(forward)
+	done()
+	if !wasEnabled {
+		ax.setEnabled(false)
+	}
+
+}
+
+// Reverse from loaded gears for runTime and set the backlash to the steps made before the load came back
+//
+// Called with the lock held and the motor stopped, it is let go while waiting so the monitor can read the encoder
+func (ax *Axis) measureBacklash(reverse AxisDirection, hz float64, runTime time.Duration) error {
+
+	type sample struct {
+		stepped float64
+		lag     float64
+	}
+	var samples []sample
+
+	ax.setAxisDirection(reverse)
+	start := ax.position
+	startTime := ax.clock.Now()
+	ax.setPWMHz(hz)
+
+	// The steps made and how far the encoder is behind them, in encoder counts
+	for ax.clock.Now().Sub(startTime) < runTime {
+		ax.sleepUnlocked(SLEW_INTERVAL)
+
+		if !ax.isEnabled() {
+			return errors.New("the motor was disabled")
+		}
+
+		stepped := hz * ax.positionTime.Sub(startTime).Seconds() / ax.stepsPerCount()
+		if stepped <= 0 {
+			continue
+		}
+		moved := float64(ax.position - start)
+		if reverse == AXIS_REVERSE {
+			moved = -moved
+		}
+		samples = append(samples, sample{stepped, stepped - moved})
+	}
+	if len(samples) == 0 {
+		return errors.New("no encoder readings")
+	}
+
+	// The first reading is after the release, by the end the gears are driven and the encoder is
+	// further behind by the load, the slack ends half way up
+	firstLag := samples[0].lag
+	rise := samples[len(samples)-1].lag - firstLag
+	if rise < BACKLASH_CALIBRATE_MIN_LAG {
+		return fmt.Errorf("the encoder did not fall behind the steps within %v motor turns, no load was seen", BACKLASH_CALIBRATE_TURNS)
+	}
+
+	for _, s := range samples {
+		if s.lag > firstLag+rise/2 {
+			ax.backlash.counts = uint32(math.Round(s.stepped))
+			fmt.Printf("[calibrateBacklash] %v backlash %v counts\n", ax.name, ax.backlash.counts)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Wait for an encoder reading taken after now, called with the lock held
+func (ax *Axis) waitForReading() {
+
+	readTime := ax.positionTime
+	for i := 0; i < 20 && !ax.positionTime.After(readTime); i++ {
+		ax.sleepUnlocked(SLEW_INTERVAL)
+	}
+
+}
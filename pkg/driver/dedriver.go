@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+type DeValue string
+
+const (
+	DE_DIRECTION_NORTH DeValue = "North"
+	DE_DIRECTION_SOUTH         = "South"
+	DE_MOTOR_ON                = "On"
+	DE_MOTOR_OFF               = "Off"
+)
+
+// The driver that controls the DEC motor
+// Wired the same as the RA, a stepper on a TMC2208 with an AMT22 encoder on the motor shaft
+//
+// Unlike the RA the DEC does not track, it sits still until it is told to move.
+type DEDriver struct {
+	Axis
+}
+
+// Returns a new DEDriver
+func NewDEDriver(
+	stepPin hal.Pin,
+	pwm hal.PWM,
+	directionPin hal.Pin,
+	stepsPerRevolution int32,
+	maxHz int32,
+	microStep1 hal.Pin,
+	microStep2 hal.Pin,
+	maxMicroStepSetting MicroStep,
+	enableMotorPin hal.Pin,
+	wormRatio int32,
+	gearRatio int32,
+	enc encoder.Encoder,
+
+) (DEDriver, error) {
+
+	axis, err := NewAxis(
+		"DEC",
+		stepPin,
+		pwm,
+		directionPin,
+		stepsPerRevolution,
+		maxHz,
+		microStep1,
+		microStep2,
+		maxMicroStepSetting,
+		enableMotorPin,
+		wormRatio,
+		gearRatio,
+		enc,
+	)
+	if err != nil {
+		return DEDriver{}, err
+	}
+
+	return DEDriver{Axis: axis}, nil
+}
+
+func (de *DEDriver) Configure() {
+
+	de.Axis.Configure()
+
+	// The motor does not step until told to move
+	de.Stop()
+
+}
+
+// Zero the DEC encoder
+func (de *DEDriver) ZeroDE() {
+	de.Zero()
+}
+
+func (de *DEDriver) GetMotor() DeValue {
+
+	if de.IsEnabled() {
+		return DE_MOTOR_ON
+	} else {
+		return DE_MOTOR_OFF
+	}
+
+}
+
+func (de *DEDriver) SetMotor(motor DeValue) {
+	de.SetEnabled(motor == DE_MOTOR_ON)
+}
+
+func (de *DEDriver) GetDirection() DeValue {
+	if de.GetAxisDirection() == AXIS_FORWARD {
+		return DE_DIRECTION_NORTH
+	} else {
+		return DE_DIRECTION_SOUTH
+	}
+}
+
+func (de *DEDriver) SetDirection(direction DeValue) {
+
+	if direction == DE_DIRECTION_NORTH {
+		de.SetAxisDirection(AXIS_FORWARD)
+	} else {
+		de.SetAxisDirection(AXIS_REVERSE)
+	}
+
+}
@@ -4,11 +4,9 @@ package driver
 import (
 	"errors"
 	"fmt"
-	"machine"
-	"math"
-	"time"
 
 	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
 )
 
 type MicroStep uint16
@@ -20,8 +18,27 @@ const (
 	MS_QUARTER   MicroStep = 4
 	MS_EIGHTH    MicroStep = 8
 	MS_SIXTEENTH MicroStep = 16
+
+	// Only over the TMC2208 UART, see tmc2208.go
+	MS_THIRTY_SECOND     MicroStep = 32
+	MS_SIXTY_FOURTH      MicroStep = 64
+	MS_ONE_TWENTY_EIGHTH MicroStep = 128
+	MS_TWO_FIFTY_SIXTH   MicroStep = 256
 )
 
+// Returns true if ms is one of the MS_ settings
+func isMicroStep(ms MicroStep) bool {
+
+	switch ms {
+	case MS_HALF, MS_QUARTER, MS_EIGHTH, MS_SIXTEENTH,
+		MS_THIRTY_SECOND, MS_SIXTY_FOURTH, MS_ONE_TWENTY_EIGHTH, MS_TWO_FIFTY_SIXTH:
+		return true
+	default:
+		return false
+	}
+
+}
+
 type RaValue string
 
 const (
@@ -31,207 +48,114 @@ const (
 	RA_TRACKING_OFF            = "Off"
 )
 
+// PEC playback "On" or "Off", see pec.go
+const (
+	RA_PEC_PLAYBACK_ON  RaValue = "On"
+	RA_PEC_PLAYBACK_OFF RaValue = "Off"
+)
+
 const SIDEREAL_DAY_IN_SECONDS = 86_164.1
 
-type PWM interface {
-	Configure(config machine.PWMConfig) error
-	Channel(pin machine.Pin) (channel uint8, err error)
-	Top() uint32
-	Set(channel uint8, value uint32)
-	SetPeriod(period uint64) error
-}
+type TrackingRate string
+
+const (
+	TRACKING_RATE_SIDEREAL TrackingRate = "Sidereal"
+	TRACKING_RATE_LUNAR    TrackingRate = "Lunar"
+	TRACKING_RATE_SOLAR    TrackingRate = "Solar"
+	TRACKING_RATE_KING     TrackingRate = "King"
+	TRACKING_RATE_CUSTOM   TrackingRate = "Custom"
+)
+
+// Tracking rates in arc seconds per second of time
+//
+// King rate is the sidereal rate corrected for average refraction, it suits objects away from the zenith
+const (
+	ARCSEC_PER_REVOLUTION = 1_296_000
+	SIDEREAL_RATE_ARCSEC  = ARCSEC_PER_REVOLUTION / SIDEREAL_DAY_IN_SECONDS // 15.041
+	LUNAR_RATE_ARCSEC     = 14.685
+	SOLAR_RATE_ARCSEC     = 15.0
+	KING_RATE_ARCSEC      = 15.0369
+)
 
 // The driver that controls the RA motor
 // Based on the A4988 Stepstick Stepper Motor Driver
+//
+// The RA is an Axis that tracks the sky
 type RADriver struct {
+	Axis
 
-	// A pulse to this pin will step the motor
-	stepPin machine.Pin
-
-	// raPWM
-	pwm PWM
-
-	// The pin that controls the direction of the motor rotation
-	directionPin machine.Pin
-
-	// The pin that controls the enabling or disabling of the motor
-	enableMotorPin machine.Pin
-
-	// The steps need for one full revolution of the motor
-	// For example a 1.8° motor takes 200 steps per revolution, a 0.9° motor takes 400 steps per revolution, etc...
-	// This is a physical properity of the motor and should NOT account for micro stepping
-	stepsPerRevolution int32
-
-	// The maximum PWM cycle in Hz that the motor can accept
-	// This is a physical properity of the motor, and for my nima17 0.9° this is around 1_000 Hz
-	maxHz int32
-
-	runningHz int32
-
-	// Microstep Pins
-	//
-	//  ms1  ms2  Steps       Interpolation
-	//  ---  ---  ----------- -------------
-	//   H    L   1/2         1/256
-	//   L    H   1/4         1/256
-	//   L    L   1/8         1/256
-	//   H    H   1/16        1/256
-	//
-	microStep1 machine.Pin
-	microStep2 machine.Pin
-
-	// The micro stepping setting full, half, quarter, etc...
-	// Use 2 for half, 4 for quarter etc...
-	microStepSetting MicroStep
+	// Closed-loop sidereal tracking
+	tracking trackingController
 
-	// The limit or "highest" setting, probably 16
-	maxMicroStepSetting MicroStep
+	// The selected tracking rate, and the rate in arc seconds per second when it is TRACKING_RATE_CUSTOM
+	trackingRate     TrackingRate
+	customRateArcsec float64
 
-	// The gear ratios of your RA mount
-	// reference: http://www.astrofriend.eu/astronomy/astronomy-calculations/mount-gearbox-ratio/mount-gearbox-ratio.html
-	// Common worm drives are 130:1, 135:1, 144:1, 180:1, 435:1; thus use values of 130, 135, 144, 180 or 435 respectively
-	wormRatio int32
+	// Periodic error correction
+	pec pecTable
 
-	// Common primary gear ratios are from 1:1 to 75:1; thus use values 1 to 75 respectively
-	// This is the total ratio of all gears combined, for example:
-	// if you have a primary gearbox with a ratio of 12:1 and a secondary gearbox with a ration of 10:1 then set GearRatio to (12*10) or 120
-	gearRatio int32
-
-	// RA Encoder
-	encoder.RAEncoder
-
-	// RA Encoder
-	position uint32
+	// Autoguiding
+	guide guideState
 }
 
 // Returns a new RADriver
 func NewRADriver(
-	stepPin machine.Pin,
-	pwm PWM,
-	directionPin machine.Pin,
+	stepPin hal.Pin,
+	pwm hal.PWM,
+	directionPin hal.Pin,
 	stepsPerRevolution int32,
 	maxHz int32,
-	microStep1 machine.Pin,
-	microStep2 machine.Pin,
+	microStep1 hal.Pin,
+	microStep2 hal.Pin,
 	maxMicroStepSetting MicroStep,
-	enableMotorPin machine.Pin,
+	enableMotorPin hal.Pin,
 	wormRatio int32,
 	gearRatio int32,
-	encoderSPI machine.SPI,
-	encoderCS machine.Pin,
+	enc encoder.Encoder,
 
 ) (RADriver, error) {
 
-	if maxMicroStepSetting != MS_HALF &&
-		maxMicroStepSetting != MS_QUARTER &&
-		maxMicroStepSetting != MS_EIGHTH &&
-		maxMicroStepSetting != MS_SIXTEENTH {
-		return RADriver{}, errors.New("maxMicroStepSetting must be 2, 4, 8 or 16")
-	}
-
-	if stepsPerRevolution < 1 {
-		return RADriver{}, errors.New("stepsPerRevolution must be greater than 0, typical values are 200 or 400")
-	}
-
-	if wormRatio < 1 {
-		return RADriver{}, errors.New("wormRatio must be greater than 0, use 1 if not using a worm gear, typical value is 400")
-	}
-
-	if gearRatio < 1 {
-		return RADriver{}, errors.New("gearRatio must be greater than 0, use 1 if not using a gearbox, typical values between 1 and 75")
+	axis, err := NewAxis(
+		"RA",
+		stepPin,
+		pwm,
+		directionPin,
+		stepsPerRevolution,
+		maxHz,
+		microStep1,
+		microStep2,
+		maxMicroStepSetting,
+		enableMotorPin,
+		wormRatio,
+		gearRatio,
+		enc,
+	)
+	if err != nil {
+		return RADriver{}, err
 	}
 
 	raDriver := RADriver{
-		stepPin:             stepPin,
-		pwm:                 pwm,
-		directionPin:        directionPin,
-		stepsPerRevolution:  stepsPerRevolution,
-		maxHz:               maxHz,
-		runningHz:           0,
-		microStep1:          microStep1,
-		microStep2:          microStep2,
-		microStepSetting:    maxMicroStepSetting,
-		maxMicroStepSetting: maxMicroStepSetting,
-		enableMotorPin:      enableMotorPin,
-		wormRatio:           wormRatio,
-		gearRatio:           gearRatio,
+		Axis:         axis,
+		trackingRate: TRACKING_RATE_SIDEREAL,
+		pec:          pecTable{state: PEC_OFF},
+		guide:        guideState{rate: GUIDE_DEFAULT_RATE},
+		tracking: trackingController{
+			closedLoop:    true,
+			kp:            TRACKING_DEFAULT_KP,
+			ki:            TRACKING_DEFAULT_KI,
+			maxCorrection: TRACKING_DEFAULT_MAX_CORRECTION,
+		},
 	}
-	raDriver.ConfigureEncoder(encoderSPI, encoderCS, encoder.RES14)
 
 	return raDriver, nil
 }
 
 func (ra *RADriver) Configure() {
 
-	//
-	// Configure the machine PWM for the RA
-	// See https://datasheets.raspberrypi.com/rp2040/rp2040-datasheet.pdf
-	//     4.5.2. Programmer’s Model
-	//
-	ra.pwm.Configure(machine.PWMConfig{Period: 0})
-	chA, _ := ra.pwm.Channel(ra.stepPin)
-	ra.pwm.Set(chA, ra.pwm.Top()/2)
-
-	//
-	// Microstepping
-	//
-	microStep1 := ra.microStep1
-	microStep2 := ra.microStep2
-	microStep1.Configure(machine.PinConfig{Mode: machine.PinOutput})
-	microStep2.Configure(machine.PinConfig{Mode: machine.PinOutput})
+	ra.Axis.Configure()
 
-	// Default to microStepSetting of 16
-	ra.setMicroStepSetting(MS_SIXTEENTH)
-
-	// Direction
-	ra.directionPin.Configure(machine.PinConfig{Mode: machine.PinOutput})
-	ra.SetDirection(RA_DIRECTION_NORTH)
-
-	// Enable Motor
-	ra.enableMotorPin.Configure(machine.PinConfig{Mode: machine.PinOutput})
-	ra.SetTracking(RA_TRACKING_OFF)
-
-	// RA Encoder
-	ra.ZeroRA()
-
-	// Start go routine to monitor position
-	go ra.monitorPositionRoutine()
-
-}
-
-func (ra *RADriver) setMicroStepSetting(ms MicroStep) {
-
-	ra.microStepSetting = ms
-
-	//  ms1  ms2  Steps       Interpolation
-	//  ---  ---  ----------- -------------
-	//   H    L   1/2         1/256
-	//   L    H   1/4         1/256
-	//   L    L   1/8         1/256
-	//   H    H   1/16        1/256
-
-	switch ra.microStepSetting {
-	case 2:
-		ra.microStep1.High()
-		ra.microStep2.Low()
-		fmt.Println("[setMicroStepSetting] microStepSetting 2-H L")
-	case 4:
-		ra.microStep1.Low()
-		ra.microStep2.High()
-		fmt.Println("[setMicroStepSetting] microStepSetting 4-L H")
-	case 8:
-		ra.microStep1.Low()
-		ra.microStep2.Low()
-		fmt.Println("[setMicroStepSetting] microStepSetting 8-H H")
-	case 16:
-		ra.microStep1.High()
-		ra.microStep2.High()
-		fmt.Println("[setMicroStepSetting] microStepSetting 16-H H")
-	default:
-		ra.microStep1.High()
-		ra.microStep2.High()
-		fmt.Println("[setMicroStepSetting] microStepSetting default 16-H H")
-	}
+	// Start go routine to trim the rate from encoder feedback
+	go ra.trackingRoutine()
 
 }
 
@@ -248,57 +172,250 @@ func (ra *RADriver) setMicroStepSetting(ms MicroStep) {
 //
 //	 The cycle Hz = system ratio / number of seconds in a sideral day
 //	 The cycle perod = 1e9 / Hz
+//
+// The rate is then trimmed continuously from encoder feedback, see tracking.go
 func (ra *RADriver) RunAtSiderealRate() {
 
-	systemRatio := ra.stepsPerRevolution * int32(ra.maxMicroStepSetting) * ra.wormRatio * ra.gearRatio
-	sideralHz := float64(systemRatio) / SIDEREAL_DAY_IN_SECONDS
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.trackingRate = TRACKING_RATE_SIDEREAL
+	ra.runAtTrackingRate()
+
+}
+
+// Run at the selected tracking rate, see SetTrackingRate
+//
+//	The cycle Hz = system ratio * rate in arc seconds per second / arc seconds in one revolution
+func (ra *RADriver) RunAtTrackingRate() {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.runAtTrackingRate()
+
+}
+
+func (ra *RADriver) runAtTrackingRate() {
+
+	rateArcsec := ra.trackingRateArcsec()
+	systemRatio := float64(ra.stepsPerRevolution) * float64(ra.maxMicroStepSetting) * float64(ra.wormRatio) * float64(ra.gearRatio)
+	hz := systemRatio * rateArcsec / ARCSEC_PER_REVOLUTION
+
+	fmt.Printf("[RunAtTrackingRate] %v rate, set hz to: %.2f\n", ra.trackingRate, hz)
+	ra.tracking.start(hz, ra.countsPerAxisRevolution()*rateArcsec/ARCSEC_PER_REVOLUTION)
+	ra.setPWMHz(hz)
+
+}
+
+// Select the tracking rate, use SetCustomTrackingRate for TRACKING_RATE_CUSTOM
+//
+// If the RA is not slewing the new rate takes effect right away
+func (ra *RADriver) SetTrackingRate(rate TrackingRate) error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.setTrackingRate(rate)
+}
+
+func (ra *RADriver) setTrackingRate(rate TrackingRate) error {
+
+	switch rate {
+	case TRACKING_RATE_SIDEREAL, TRACKING_RATE_LUNAR, TRACKING_RATE_SOLAR, TRACKING_RATE_KING:
+		ra.trackingRate = rate
+	case TRACKING_RATE_CUSTOM:
+		if ra.customRateArcsec <= 0 {
+			return errors.New("set a custom rate with SetCustomTrackingRate first")
+		}
+		ra.trackingRate = rate
+	default:
+		return fmt.Errorf("unknown tracking rate: %v", rate)
+	}
+
+	// A slew or backlash calibration sets the rate when it ends
+	if !ra.slew.active && !ra.backlash.calibrating {
+		ra.runAtTrackingRate()
+	}
+
+	return nil
+}
+
+// Track at a custom rate given in arc seconds per second, for example a comet or the ISS
+func (ra *RADriver) SetCustomTrackingRate(arcsecPerSecond float64) error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	// More than 10x sidereal is a slew, not tracking
+	if arcsecPerSecond <= 0 || arcsecPerSecond > 10*SIDEREAL_RATE_ARCSEC {
+		return errors.New("custom rate must be greater than 0 and at most 10x the sidereal rate")
+	}
+
+	ra.customRateArcsec = arcsecPerSecond
+	return ra.setTrackingRate(TRACKING_RATE_CUSTOM)
+}
 
-	ra.RunAtHz(sideralHz)
+func (ra *RADriver) GetTrackingRate() TrackingRate {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.trackingRate
+}
+
+// Returns the selected tracking rate in arc seconds per second
+func (ra *RADriver) GetTrackingRateArcsec() float64 {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.trackingRateArcsec()
+}
+
+func (ra *RADriver) trackingRateArcsec() float64 {
+
+	switch ra.trackingRate {
+	case TRACKING_RATE_LUNAR:
+		return LUNAR_RATE_ARCSEC
+	case TRACKING_RATE_SOLAR:
+		return SOLAR_RATE_ARCSEC
+	case TRACKING_RATE_KING:
+		return KING_RATE_ARCSEC
+	case TRACKING_RATE_CUSTOM:
+		return ra.customRateArcsec
+	default:
+		return SIDEREAL_RATE_ARCSEC
+	}
 
 }
 
+// Run the motor at a fixed rate, this turns off closed-loop tracking
 func (ra *RADriver) RunAtHz(hz float64) {
 
-	fmt.Printf("[RunAtHz] Set hz to: %.2f\n", hz)
-	period := uint64(math.Round(1e9 / hz))
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.tracking.enabled = false
+	ra.runAtHz(hz)
+
+}
+
+func (ra *RADriver) siderealHz() float64 {
+
+	// In float64, at 1/256 the product of the int32 settings overflows
+	systemRatio := float64(ra.stepsPerRevolution) * float64(ra.maxMicroStepSetting) * float64(ra.wormRatio) * float64(ra.gearRatio)
+	return systemRatio / SIDEREAL_DAY_IN_SECONDS
+
+}
+
+// Move the RA to the target encoder position then resume tracking
+//
+// The slew ramps up from the sidereal rate, see Axis.SlewTo
+func (ra *RADriver) SlewTo(target int64) error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	trackingDirection := ra.direction()
+	ra.tracking.enabled = false
 
-	// Save Hz on RA Driver
-	ra.runningHz = int32(hz)
+	return ra.slewTo(target, ra.siderealHz(), func() {
+		ra.setDirection(trackingDirection)
+		ra.runAtTrackingRate()
+	})
 
-	// Set period for hardware PWM
-	ra.pwm.SetPeriod(period)
 }
 
-func (ra *RADriver) monitorPositionRoutine() {
+// Measure the RA backlash at the tracking rate, tracking resumes when it is done, see Axis.CalibrateBacklash
+func (ra *RADriver) CalibrateBacklash() error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.stopGuide()
 
-	for {
-		position, err := ra.GetPositionRA()
-		if err == nil {
-			ra.position = position
-		} else {
-			println("[monitorPositionRoutine] Error getting position")
+	// The tracking rate may change while it runs
+	wasRunning := ra.runningHz > 0
+	hz := ra.siderealHz() * ra.trackingRateArcsec() / SIDEREAL_RATE_ARCSEC
+	return ra.calibrateBacklash(hz, func() {
+		if wasRunning {
+			ra.runAtTrackingRate()
 		}
-		time.Sleep(time.Millisecond * 700) //DEVTODO - not sure if this is too short or too long?
+	})
+}
+
+// Stop tracking and slew to the park position, see Axis.Park
+func (ra *RADriver) Park() error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.tracking.enabled = false
+	ra.stopGuide()
+
+	return ra.slewToPark()
+}
+
+// Unpark and resume tracking at the selected rate
+func (ra *RADriver) Unpark() error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if err := ra.unpark(); err != nil {
+		return err
 	}
+
+	ra.runAtTrackingRate()
+	ra.setEnabled(true)
+
+	return nil
+}
+
+// Stop tracking and slew to the home position, see Axis.Home
+func (ra *RADriver) Home() error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.tracking.enabled = false
+	ra.stopGuide()
+
+	return ra.slewTo(HOME_POSITION, float64(ra.maxHz)/20, ra.stop)
+}
+
+// Zero the RA encoder, tracking is measured again from the new zero
+func (ra *RADriver) ZeroRA() {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.zero()
+	ra.tracking.resetReference()
+
 }
 
 func (ra *RADriver) GetTracking() RaValue {
 
-	// Enabled if pin is low, so if true return off
-	if ra.enableMotorPin.Get() {
-		return RA_TRACKING_OFF
-	} else {
+	if ra.IsEnabled() {
 		return RA_TRACKING_ON
+	} else {
+		return RA_TRACKING_OFF
 	}
 
 }
 
-func (ra *RADriver) GetPosition() uint32 {
-	return ra.position
+func (ra *RADriver) GetDirection() RaValue {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.direction()
 }
 
-func (ra *RADriver) GetDirection() RaValue {
-	if ra.directionPin.Get() {
+func (ra *RADriver) direction() RaValue {
+	if ra.axisDirection() == AXIS_FORWARD {
 		return RA_DIRECTION_NORTH
 	} else {
 		return RA_DIRECTION_SOUTH
@@ -307,20 +424,26 @@ func (ra *RADriver) GetDirection() RaValue {
 
 func (ra *RADriver) SetDirection(direction RaValue) {
 
-	if direction == RA_DIRECTION_NORTH {
-		ra.directionPin.High()
-	} else {
-		ra.directionPin.Low()
-	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.setDirection(direction)
 
 }
 
-func (ra *RADriver) SetTracking(tracking RaValue) {
+func (ra *RADriver) setDirection(direction RaValue) {
 
-	if tracking == RA_TRACKING_ON {
-		ra.enableMotorPin.Low() // Enabled if pin is low
+	if direction == RA_DIRECTION_NORTH {
+		ra.setAxisDirection(AXIS_FORWARD)
 	} else {
-		ra.enableMotorPin.High()
+		ra.setAxisDirection(AXIS_REVERSE)
 	}
 
+	// Motion before the reversal does not count toward tracking
+	ra.tracking.resetReference()
+
+}
+
+func (ra *RADriver) SetTracking(tracking RaValue) {
+	ra.SetEnabled(tracking == RA_TRACKING_ON)
 }
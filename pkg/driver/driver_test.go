@@ -0,0 +1,331 @@
+package driver
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// The fake hardware behind a test driver
+type testHardware struct {
+	step       *hal.FakePin
+	pwm        *hal.FakePWM
+	direction  *hal.FakePin
+	microStep1 *hal.FakePin
+	microStep2 *hal.FakePin
+	enable     *hal.FakePin
+	enc        *encoder.FakeEncoder
+}
+
+func newTestHardware() testHardware {
+	return testHardware{
+		step:       hal.NewFakePin(),
+		pwm:        hal.NewFakePWM(),
+		direction:  hal.NewFakePin(),
+		microStep1: hal.NewFakePin(),
+		microStep2: hal.NewFakePin(),
+		enable:     hal.NewFakePin(),
+		enc:        encoder.NewFakeEncoder(encoder.COUNTS_14),
+	}
+}
+
+// Returns an RADriver wired like cmd/ra-driver, 400 steps, 1/16, 144:1 worm and 3:1 gears
+func newTestRADriver(t *testing.T) (RADriver, testHardware) {
+
+	hw := newTestHardware()
+	ra, err := NewRADriver(
+		hw.step,
+		hw.pwm,
+		hw.direction,
+		400,
+		1000,
+		hw.microStep1,
+		hw.microStep2,
+		MS_SIXTEENTH,
+		hw.enable,
+		144,
+		3,
+		hw.enc,
+	)
+	if err != nil {
+		t.Fatalf("NewRADriver: %v", err)
+	}
+
+	// The motor starts disabled, as Configure leaves it
+	ra.SetEnabled(false)
+
+	return ra, hw
+}
+
+func TestNewRADriverValidates(t *testing.T) {
+
+	hw := newTestHardware()
+	tests := []struct {
+		name               string
+		stepsPerRevolution int32
+		maxHz              int32
+		microStep          MicroStep
+		wormRatio          int32
+		gearRatio          int32
+	}{
+		{"microstep", 400, 1000, 3, 144, 3},
+		{"stepsPerRevolution", 0, 1000, MS_SIXTEENTH, 144, 3},
+		{"maxHz", 400, 0, MS_SIXTEENTH, 144, 3},
+		{"wormRatio", 400, 1000, MS_SIXTEENTH, 0, 3},
+		{"gearRatio", 400, 1000, MS_SIXTEENTH, 144, 0},
+	}
+
+	if _, err := NewRADriver(hw.step, hw.pwm, hw.direction, 400, 1000,
+		hw.microStep1, hw.microStep2, MS_SIXTEENTH, hw.enable, 144, 3, nil); err == nil {
+		t.Error("encoder: expected an error")
+	}
+
+	for _, tt := range tests {
+		_, err := NewRADriver(hw.step, hw.pwm, hw.direction, tt.stepsPerRevolution, tt.maxHz,
+			hw.microStep1, hw.microStep2, tt.microStep, hw.enable, tt.wormRatio, tt.gearRatio, hw.enc)
+		if err == nil {
+			t.Errorf("%v: expected an error", tt.name)
+		}
+	}
+
+}
+
+func TestSiderealRate(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	// 400 * 16 * 144 * 3 = 2_764_800 steps for one turn of the RA in one sidereal day
+	wantHz := 2_764_800 / SIDEREAL_DAY_IN_SECONDS
+
+	if hz := ra.siderealHz(); math.Abs(hz-wantHz) > 1e-9 {
+		t.Errorf("siderealHz = %v, want %v", hz, wantHz)
+	}
+
+	ra.RunAtSiderealRate()
+
+	if hz := ra.GetRunningHz(); math.Abs(hz-wantHz) > 1e-9 {
+		t.Errorf("GetRunningHz = %v, want %v", hz, wantHz)
+	}
+
+	wantPeriod := uint64(math.Round(1e9 / wantHz))
+	if period := hw.pwm.GetPeriod(); period != wantPeriod {
+		t.Errorf("PWM period = %v ns, want %v ns", period, wantPeriod)
+	}
+
+	// 50% duty cycle
+	if level := hw.pwm.Get(0); level != hw.pwm.Top()/2 {
+		t.Errorf("PWM level = %v, want %v", level, hw.pwm.Top()/2)
+	}
+
+}
+
+func TestSiderealRateOverflow(t *testing.T) {
+
+	// 400 * 256 * 435 * 75 does not fit in an int32
+	hw := newTestHardware()
+	ra, err := NewRADriver(hw.step, hw.pwm, hw.direction, 400, 1000,
+		hw.microStep1, hw.microStep2, MS_TWO_FIFTY_SIXTH, hw.enable, 435, 75, hw.enc)
+	if err != nil {
+		t.Fatalf("NewRADriver: %v", err)
+	}
+
+	wantHz := 400.0 * 256 * 435 * 75 / SIDEREAL_DAY_IN_SECONDS
+	if hz := ra.siderealHz(); math.Abs(hz-wantHz) > 1e-6 {
+		t.Errorf("siderealHz = %v, want %v", hz, wantHz)
+	}
+
+}
+
+func TestSiderealRateArcsec(t *testing.T) {
+
+	// 360° in one sidereal day
+	if math.Abs(SIDEREAL_RATE_ARCSEC-15.041) > 0.001 {
+		t.Errorf("SIDEREAL_RATE_ARCSEC = %v, want 15.041", SIDEREAL_RATE_ARCSEC)
+	}
+
+}
+
+func TestTrackingRates(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+	siderealHz := ra.siderealHz()
+
+	tests := []struct {
+		rate   TrackingRate
+		arcsec float64
+	}{
+		{TRACKING_RATE_SIDEREAL, SIDEREAL_RATE_ARCSEC},
+		{TRACKING_RATE_LUNAR, LUNAR_RATE_ARCSEC},
+		{TRACKING_RATE_SOLAR, SOLAR_RATE_ARCSEC},
+		{TRACKING_RATE_KING, KING_RATE_ARCSEC},
+	}
+
+	for _, tt := range tests {
+		if err := ra.SetTrackingRate(tt.rate); err != nil {
+			t.Fatalf("SetTrackingRate(%v): %v", tt.rate, err)
+		}
+
+		if arcsec := ra.GetTrackingRateArcsec(); arcsec != tt.arcsec {
+			t.Errorf("%v: GetTrackingRateArcsec = %v, want %v", tt.rate, arcsec, tt.arcsec)
+		}
+
+		// The rate scales with the sidereal rate
+		wantHz := siderealHz * tt.arcsec / SIDEREAL_RATE_ARCSEC
+		if hz := ra.GetRunningHz(); math.Abs(hz-wantHz) > 1e-6 {
+			t.Errorf("%v: GetRunningHz = %v, want %v", tt.rate, hz, wantHz)
+		}
+		if hz := hw.pwm.GetHz(0); math.Abs(hz-wantHz) > 1e-3 {
+			t.Errorf("%v: PWM = %v Hz, want %v Hz", tt.rate, hz, wantHz)
+		}
+	}
+
+	if err := ra.SetTrackingRate(TRACKING_RATE_CUSTOM); err == nil {
+		t.Error("SetTrackingRate(TRACKING_RATE_CUSTOM) without a custom rate should fail")
+	}
+
+	if err := ra.SetCustomTrackingRate(7.5); err != nil {
+		t.Fatalf("SetCustomTrackingRate: %v", err)
+	}
+	if hz, wantHz := ra.GetRunningHz(), siderealHz*7.5/SIDEREAL_RATE_ARCSEC; math.Abs(hz-wantHz) > 1e-6 {
+		t.Errorf("custom: GetRunningHz = %v, want %v", hz, wantHz)
+	}
+
+	if err := ra.SetCustomTrackingRate(11 * SIDEREAL_RATE_ARCSEC); err == nil {
+		t.Error("SetCustomTrackingRate above 10x sidereal should fail")
+	}
+
+}
+
+func TestStop(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	ra.RunAtSiderealRate()
+	ra.Stop()
+
+	if hz := ra.GetRunningHz(); hz != 0 {
+		t.Errorf("GetRunningHz = %v, want 0", hz)
+	}
+	if hz := hw.pwm.GetHz(0); hz != 0 {
+		t.Errorf("PWM = %v Hz, want 0", hz)
+	}
+
+}
+
+func TestDirectionPin(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	ra.SetDirection(RA_DIRECTION_NORTH)
+	if !hw.direction.Get() {
+		t.Error("North: direction pin is low, want high")
+	}
+	if dir := ra.GetDirection(); dir != RA_DIRECTION_NORTH {
+		t.Errorf("GetDirection = %v, want %v", dir, RA_DIRECTION_NORTH)
+	}
+
+	ra.SetDirection(RA_DIRECTION_SOUTH)
+	if hw.direction.Get() {
+		t.Error("South: direction pin is high, want low")
+	}
+	if dir := ra.GetDirection(); dir != RA_DIRECTION_SOUTH {
+		t.Errorf("GetDirection = %v, want %v", dir, RA_DIRECTION_SOUTH)
+	}
+
+}
+
+func TestTrackingPin(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	// The enable pin is active low
+	ra.SetTracking(RA_TRACKING_ON)
+	if hw.enable.Get() {
+		t.Error("tracking on: enable pin is high, want low")
+	}
+	if tracking := ra.GetTracking(); tracking != RA_TRACKING_ON {
+		t.Errorf("GetTracking = %v, want %v", tracking, RA_TRACKING_ON)
+	}
+
+	ra.SetTracking(RA_TRACKING_OFF)
+	if !hw.enable.Get() {
+		t.Error("tracking off: enable pin is low, want high")
+	}
+	if tracking := ra.GetTracking(); tracking != RA_TRACKING_OFF {
+		t.Errorf("GetTracking = %v, want %v", tracking, RA_TRACKING_OFF)
+	}
+
+}
+
+func TestTrackingPinRefused(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+
+	ra.park.parked = true
+	ra.SetTracking(RA_TRACKING_ON)
+	if !hw.enable.Get() {
+		t.Error("parked: the motor was enabled")
+	}
+	ra.park.parked = false
+
+	ra.watchdog.fault = FAULT_STALL
+	ra.SetTracking(RA_TRACKING_ON)
+	if !hw.enable.Get() {
+		t.Error("stall fault: the motor was enabled")
+	}
+	ra.ClearFault()
+
+	ra.SetTracking(RA_TRACKING_ON)
+	if hw.enable.Get() {
+		t.Error("fault cleared: the motor was not enabled")
+	}
+
+}
+
+func TestTrackingSkipsBacklash(t *testing.T) {
+
+	ra, _ := newTestRADriver(t)
+	ra.RunAtSiderealRate()
+	ra.SetEnabled(true)
+	ra.positionTime = ra.clock.Now()
+
+	// The take up is in progress, the tracking loop must leave its rate alone
+	ra.backlash.active = true
+	ra.setPWMHz(ra.backlash.hz)
+	ra.updateTracking()
+	ra.positionTime = ra.positionTime.Add(TRACKING_INTERVAL)
+	ra.updateTracking()
+
+	if hz := ra.GetRunningHz(); hz != ra.backlash.hz {
+		t.Errorf("GetRunningHz = %v, want the take up rate %v", hz, ra.backlash.hz)
+	}
+
+}
+
+func TestEncoderFault(t *testing.T) {
+
+	ra, hw := newTestRADriver(t)
+	ra.SetEnabled(true)
+
+	// Every try of every read fails
+	hw.enc.Fail(encoder.ENCODER_UNHEALTHY_FAILURES * (1 + encoder.ENCODER_READ_RETRIES))
+	for i := 0; i < encoder.ENCODER_UNHEALTHY_FAILURES; i++ {
+		if _, err := ra.enc.GetPosition(); err == nil {
+			t.Fatal("expected the read to fail")
+		}
+		ra.checkEncoderHealth()
+	}
+
+	if ra.IsEncoderHealthy() {
+		t.Error("encoder still healthy")
+	}
+	if fault := ra.GetFault(); fault != FAULT_ENCODER {
+		t.Errorf("GetFault = %q, want %q", fault, FAULT_ENCODER)
+	}
+	if ra.IsEnabled() {
+		t.Error("the motor is still enabled")
+	}
+
+}
@@ -0,0 +1,209 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// Autoguiding
+//
+// A guide pulse speeds up or slows down the RA by a fraction of the tracking rate for a short time.
+// Pulses come from the UART bus or from an ST-4 port wired to the Pico.
+type GuideDirection string
+
+const (
+	GUIDE_WEST GuideDirection = "West" // Speed up
+	GUIDE_EAST GuideDirection = "East" // Slow down
+)
+
+const (
+	// The default guide rate, 0.5 is half the tracking rate
+	GUIDE_DEFAULT_RATE = 0.5
+
+	// Guide pulses longer than this are refused, a long pulse is a slew
+	GUIDE_MAX_DURATION = time.Second * 10
+
+	// How often the ST-4 pins are read
+	ST4_POLL_INTERVAL = time.Millisecond * 10
+)
+
+type guideState struct {
+	// The guide rate as a fraction of the tracking rate
+	rate float64
+
+	// The pulse in progress, factor is +rate for West and -rate for East
+	active bool
+	factor float64
+	start  time.Time
+
+	// Counts the pulses, a timer only ends the pulse it was started for
+	pulse uint32
+
+	// True if the pulse in progress came from the ST-4 port
+	fromST4 bool
+
+	// ST-4 inputs, pulled high and active low
+	st4West hal.Pin
+	st4East hal.Pin
+}
+
+// Set the guide rate as a fraction of the tracking rate, typical values are 0.25 to 0.9
+func (ra *RADriver) SetGuideRate(rate float64) error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	// At 1.0 an East pulse would stop the motor
+	if rate <= 0 || rate >= 1 {
+		return errors.New("guide rate must be greater than 0 and less than 1")
+	}
+	ra.guide.rate = rate
+
+	return nil
+}
+
+func (ra *RADriver) GetGuideRate() float64 {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.guide.rate
+}
+
+// Returns true while a guide pulse is in progress
+func (ra *RADriver) IsGuiding() bool {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.guide.active
+}
+
+// Speed up (West) or slow down (East) the RA by the guide rate for the duration of the pulse
+//
+// Guide returns right away, the tracking rate is restored when the pulse ends
+func (ra *RADriver) Guide(direction GuideDirection, duration time.Duration) error {
+
+	if direction != GUIDE_WEST && direction != GUIDE_EAST {
+		return fmt.Errorf("unknown guide direction: %v", direction)
+	}
+
+	if duration <= 0 || duration > GUIDE_MAX_DURATION {
+		return fmt.Errorf("guide duration must be greater than 0 and at most %v", GUIDE_MAX_DURATION)
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if err := ra.startGuide(direction, false); err != nil {
+		return err
+	}
+	pulse := ra.guide.pulse
+
+	go func() {
+		ra.clock.Sleep(duration)
+
+		// The pulse may have been ended early and another one started
+		ra.mu.Lock()
+		if ra.guide.active && ra.guide.pulse == pulse {
+			ra.stopGuide()
+		}
+		ra.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// Read guide pulses from an ST-4 port, the RA+ (West) and RA- (East) lines pull the pins low
+func (ra *RADriver) ConfigureST4(west hal.Pin, east hal.Pin) {
+
+	ra.mu.Lock()
+	ra.guide.st4West = west
+	ra.guide.st4East = east
+	ra.guide.st4West.Configure(hal.PinConfig{Mode: hal.PinInputPullup})
+	ra.guide.st4East.Configure(hal.PinConfig{Mode: hal.PinInputPullup})
+	ra.mu.Unlock()
+
+	go ra.st4Routine()
+
+}
+
+func (ra *RADriver) st4Routine() {
+
+	for {
+		ra.mu.Lock()
+
+		west := !ra.guide.st4West.Get()
+		east := !ra.guide.st4East.Get()
+
+		if ra.guide.active && ra.guide.fromST4 {
+			// End the pulse when the line is released
+			if (ra.guide.factor > 0 && !west) || (ra.guide.factor < 0 && !east) {
+				ra.stopGuide()
+			}
+		} else if !ra.guide.active {
+			// Both lines at once is a wiring fault, ignore it
+			if west && !east {
+				ra.startGuide(GUIDE_WEST, true)
+			} else if east && !west {
+				ra.startGuide(GUIDE_EAST, true)
+			}
+		}
+
+		ra.mu.Unlock()
+		ra.clock.Sleep(ST4_POLL_INTERVAL)
+	}
+
+}
+
+func (ra *RADriver) startGuide(direction GuideDirection, fromST4 bool) error {
+
+	if !ra.tracking.enabled || !ra.isEnabled() {
+		return errors.New("the RA must be tracking to guide")
+	}
+
+	if ra.guide.active {
+		return errors.New("guide pulse already in progress")
+	}
+
+	if ra.backlash.calibrating {
+		return errors.New("backlash calibration in progress")
+	}
+
+	if direction == GUIDE_WEST {
+		ra.guide.factor = ra.guide.rate
+	} else {
+		ra.guide.factor = -ra.guide.rate
+	}
+	ra.guide.fromST4 = fromST4
+	ra.guide.start = ra.clock.Now()
+	ra.guide.active = true
+	ra.guide.pulse++
+
+	ra.setPWMHz(ra.trackingHz())
+
+	return nil
+}
+
+func (ra *RADriver) stopGuide() {
+
+	if !ra.guide.active {
+		return
+	}
+
+	// The tracking loop expects the RA to have moved by the pulse
+	elapsed := ra.clock.Now().Sub(ra.guide.start).Seconds()
+	ra.tracking.expected += ra.tracking.countsPerSecond * ra.guide.factor * elapsed
+
+	ra.guide.active = false
+	ra.guide.factor = 0
+
+	// A slew may have started during the pulse
+	if ra.tracking.enabled {
+		ra.setPWMHz(ra.trackingHz())
+	}
+
+}
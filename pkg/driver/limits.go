@@ -0,0 +1,186 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Software axis limits
+//
+// The limits are encoder positions measured from home. When the axis moves past a limit the motor
+// is disabled and an alarm is raised. Until the alarm is cleared the axis can only be moved back
+// toward the safe side of the limit.
+//
+// The limits are on from the start, LIMIT_DEFAULT_TURNS either side of home. Limits set with
+// SetLimits are saved with the park state and come back on the next boot, see park.go.
+//
+// DEVTODO - hour angle limits, once there are sky coordinates they can be turned into positions here
+type Alarm string
+
+const (
+	ALARM_NONE      Alarm = ""
+	ALARM_LIMIT_MIN Alarm = "LimitMin"
+	ALARM_LIMIT_MAX Alarm = "LimitMax"
+	ALARM_OVER_TEMP Alarm = "OverTemp" // See temperature.go
+)
+
+// The default limits either side of home as a fraction of an axis turn, a quarter turn is 6 hours of RA
+const LIMIT_DEFAULT_TURNS = 0.25
+
+type limitState struct {
+	// True unless ClearLimits is called
+	enabled bool
+
+	// The lowest and highest safe positions in encoder counts
+	min int64
+	max int64
+
+	// The alarm raised, it stays until ClearAlarm
+	alarm Alarm
+
+	// Alarms are sent here so they can be published on the bus, nil if no one is listening
+	alarmCh chan Alarm
+}
+
+// Set the lowest and highest safe positions in encoder counts
+func (ax *Axis) SetLimits(min int64, max int64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if min >= max {
+		return errors.New("the min limit must be less than the max limit")
+	}
+
+	ax.limits.min = min
+	ax.limits.max = max
+	ax.limits.enabled = true
+	fmt.Printf("[SetLimits] %v limits set to %v - %v\n", ax.name, min, max)
+
+	return ax.saveParkState()
+}
+
+// Turn the limits off until the next boot, the saved limits are turned on again then
+func (ax *Axis) ClearLimits() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.limits.enabled = false
+
+}
+
+// Returns the limits and true if they are on
+func (ax *Axis) GetLimits() (min int64, max int64, enabled bool) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.limits.min, ax.limits.max, ax.limits.enabled
+}
+
+// Alarms are sent to this channel as they are raised, the send does not block
+func (ax *Axis) SetAlarmCh(ch chan Alarm) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.limits.alarmCh = ch
+
+}
+
+// Returns the alarm raised, ALARM_NONE if there is none
+func (ax *Axis) GetAlarm() Alarm {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.limits.alarm
+}
+
+// Clear the alarm so the axis can move in either direction again
+func (ax *Axis) ClearAlarm() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if ax.limits.alarm != ALARM_NONE {
+		fmt.Printf("[ClearAlarm] %v alarm %v cleared\n", ax.name, ax.limits.alarm)
+	}
+	ax.limits.alarm = ALARM_NONE
+
+}
+
+// Returns the direction that moves the axis further past the limit in alarm
+func (ax *Axis) unsafeDirection() (AxisDirection, bool) {
+
+	switch ax.limits.alarm {
+	case ALARM_LIMIT_MAX:
+		return AXIS_FORWARD, true
+	case ALARM_LIMIT_MIN:
+		return AXIS_REVERSE, true
+	default:
+		return AXIS_FORWARD, false
+	}
+
+}
+
+// Returns true if moving in the direction is refused because of an alarm
+func (ax *Axis) isUnsafe(direction AxisDirection) bool {
+
+	unsafe, inAlarm := ax.unsafeDirection()
+	return inAlarm && direction == unsafe
+}
+
+// Called from the monitor with each new position
+func (ax *Axis) checkLimits() {
+
+	if !ax.limits.enabled {
+		return
+	}
+
+	var alarm Alarm
+	if ax.position > ax.limits.max && ax.axisDirection() == AXIS_FORWARD {
+		alarm = ALARM_LIMIT_MAX
+	} else if ax.position < ax.limits.min && ax.axisDirection() == AXIS_REVERSE {
+		alarm = ALARM_LIMIT_MIN
+	} else {
+		return
+	}
+
+	// Already stopped for this alarm
+	if !ax.isEnabled() && ax.limits.alarm == alarm {
+		return
+	}
+
+	fmt.Printf("[checkLimits] %v %v at position %v, motor disabled\n", ax.name, alarm, ax.position)
+
+	ax.slew.abort = ax.slew.active
+	ax.stop()
+	ax.setEnabled(false)
+
+	ax.raiseAlarm(alarm)
+
+}
+
+func (ax *Axis) raiseAlarm(alarm Alarm) {
+
+	ax.limits.alarm = alarm
+	ax.sendAlarm(alarm)
+
+}
+
+// Send the alarm to the alarm channel without latching it as a limit alarm
+func (ax *Axis) sendAlarm(alarm Alarm) {
+
+	if ax.limits.alarmCh == nil {
+		return
+	}
+
+	select {
+	case ax.limits.alarmCh <- alarm:
+	default:
+		fmt.Printf("[sendAlarm] %v alarm channel full, %v not sent\n", ax.name, alarm)
+	}
+
+}
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"fmt"
+)
+
+// Microstep switching for fast slews
+//
+// The motor can only take maxHz pulses a second. At 1/16 that is a slow slew, at 1/4 the same pulse
+// rate turns the motor four times as fast. While slewing above the threshold the driver drops to the
+// slew microstep, then goes back to maxMicroStepSetting for tracking.
+//
+// All rates on the Axis (runningHz, the slew ramp, the backlash rate and the tracking rate) are in
+// steps at maxMicroStepSetting, setPWMHz scales the PWM to the microstep in use so the bookkeeping
+// does not change with the switch. The position always comes from the encoder.
+const (
+	// The default slew microstep and switch over point as a fraction of maxHz
+	MICROSTEP_DEFAULT_SLEW      = MS_QUARTER
+	MICROSTEP_DEFAULT_THRESHOLD = 0.8
+
+	// Switch back to the fine microstep below this fraction of the threshold so it does not flip back and forth
+	MICROSTEP_HYSTERESIS = 0.8
+)
+
+// Choose when the driver changes microstep during a slew
+type MicroStepPolicy struct {
+	// The microstep used while slewing fast, use maxMicroStepSetting to never switch
+	SlewMicroStep MicroStep
+
+	// Switch to SlewMicroStep when the rate goes above this many steps a second at maxMicroStepSetting,
+	// at most maxHz
+	ThresholdHz float64
+}
+
+// Set the microstep policy used by slews
+func (ax *Axis) SetMicroStepPolicy(policy MicroStepPolicy) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if !isMicroStep(policy.SlewMicroStep) {
+		return fmt.Errorf("SlewMicroStep must be %v, %v, %v, %v, %v, %v, %v or %v", MS_HALF, MS_QUARTER, MS_EIGHTH,
+			MS_SIXTEENTH, MS_THIRTY_SECOND, MS_SIXTY_FOURTH, MS_ONE_TWENTY_EIGHTH, MS_TWO_FIFTY_SIXTH)
+	}
+
+	if policy.SlewMicroStep > ax.maxMicroStepSetting || ax.maxMicroStepSetting%policy.SlewMicroStep != 0 {
+		return fmt.Errorf("SlewMicroStep must divide maxMicroStepSetting (%v)", ax.maxMicroStepSetting)
+	}
+
+	if ax.tmc == nil && policy.SlewMicroStep > MS_SIXTEENTH {
+		return fmt.Errorf("SlewMicroStep above %v needs the TMC2208 UART", MS_SIXTEENTH)
+	}
+
+	if policy.ThresholdHz <= 0 || policy.ThresholdHz > float64(ax.maxHz) {
+		return fmt.Errorf("ThresholdHz must be greater than 0 and at most maxHz (%v)", ax.maxHz)
+	}
+
+	ax.microStepPolicy = policy
+	return nil
+}
+
+func (ax *Axis) GetMicroStepPolicy() MicroStepPolicy {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.microStepPolicy
+}
+
+// Returns the microstep in use
+func (ax *Axis) GetMicroStepSetting() MicroStep {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.microStepSetting
+}
+
+// Returns the steps at maxMicroStepSetting that one pulse makes at the microstep
+func (ax *Axis) microStepScale(ms MicroStep) float64 {
+	return float64(ax.maxMicroStepSetting) / float64(ms)
+}
+
+// Returns the fastest slew rate in steps a second at maxMicroStepSetting
+func (ax *Axis) slewTopHz() float64 {
+	return float64(ax.maxHz) * ax.microStepScale(ax.microStepPolicy.SlewMicroStep)
+}
+
+// Returns the fastest rate the motor can take at the microstep in use, steps a second at
+// maxMicroStepSetting, it stays at maxHz when the switch to the slew microstep failed
+func (ax *Axis) pulseTopHz() float64 {
+	return float64(ax.maxHz) * ax.microStepScale(ax.microStepSetting)
+}
+
+// Called by the slew ramp with each new rate, switches microstep at the threshold
+func (ax *Axis) applyMicroStepPolicy(hz float64) {
+
+	policy := ax.microStepPolicy
+	if policy.SlewMicroStep == ax.maxMicroStepSetting {
+		return
+	}
+
+	if hz > policy.ThresholdHz && ax.microStepSetting != policy.SlewMicroStep {
+		ax.setMicroStepSetting(policy.SlewMicroStep)
+	} else if hz < policy.ThresholdHz*MICROSTEP_HYSTERESIS && ax.microStepSetting != ax.maxMicroStepSetting {
+		ax.setMicroStepSetting(ax.maxMicroStepSetting)
+	}
+
+}
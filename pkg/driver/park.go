@@ -0,0 +1,328 @@
+package driver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+)
+
+// Park, unpark and home
+//
+// Home is encoder position zero, the position the mount was in when the encoder was zeroed.
+// The park position is where the axis is sent at the end of the night. The AMT22 keeps its zero
+// through a power cycle but loses the rotation count, so the position is saved to flash when
+// the axis parks and restored on the next boot. The limits are saved in the same record, and the
+// zero of an encoder that keeps it in software, see encoder.ZeroOffsetEncoder.
+const (
+	HOME_POSITION int64 = 0
+
+	// The axis is parked if the slew stops within this many encoder counts of the park position
+	PARK_TOLERANCE = 4 * SLEW_TOLERANCE
+
+	// The saved park record, "PRK4" in little endian, "PRK3" did not hold the encoder zero
+	PARK_MAGIC       uint32 = 0x344B5250
+	PARK_RECORD_SIZE        = 48
+
+	// Park record flags
+	PARK_FLAG_PARKED      uint32 = 1 << 0
+	PARK_FLAG_ZERO_OFFSET uint32 = 1 << 1 // The encoder zero offset is saved
+)
+
+// The flash used to save the park state, machine.Flash on the Pico
+//
+// The park state is kept in the last erase block
+type Flash interface {
+	ReadAt(p []byte, off int64) (n int, err error)
+	WriteAt(p []byte, off int64) (n int, err error)
+	Size() int64
+	WriteBlockSize() int64
+	EraseBlockSize() int64
+	EraseBlocks(start, length int64) error
+}
+
+type parkState struct {
+	// Where the park state is saved, nil if it is not saved
+	flash Flash
+
+	// True once the axis has parked, motion is refused until it is unparked
+	parked bool
+
+	// The park position in encoder counts
+	position int64
+}
+
+// Set the flash used to save the park state, call this before Configure
+func (ax *Axis) SetFlash(flash Flash) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.park.flash = flash
+
+}
+
+// Returns true if the axis is parked
+func (ax *Axis) IsParked() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.park.parked
+}
+
+func (ax *Axis) GetParkPosition() int64 {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.park.position
+}
+
+// Set the park position in encoder counts and save it
+func (ax *Axis) SetParkPosition(position int64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.setParkPosition(position)
+}
+
+func (ax *Axis) setParkPosition(position int64) error {
+
+	ax.park.position = position
+	fmt.Printf("[SetParkPosition] %v park position set to %v\n", ax.name, position)
+
+	return ax.saveParkState()
+}
+
+// Make the current position the park position
+func (ax *Axis) SetPark() error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.setParkPosition(ax.position)
+}
+
+// Slew to the park position, then disable the motor and save the position
+//
+// Park returns right away, use IsParked to know when the axis has parked
+func (ax *Axis) Park() error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.slewToPark()
+}
+
+func (ax *Axis) slewToPark() error {
+
+	if ax.park.parked {
+		return nil
+	}
+
+	target := ax.park.position
+
+	return ax.slewTo(target, float64(ax.maxHz)/20, func() {
+
+		ax.stop()
+
+		if absDiff(ax.position, target) > PARK_TOLERANCE {
+			fmt.Printf("[Park] %v did not reach the park position, stopped at %v\n", ax.name, ax.position)
+			return
+		}
+
+		ax.setEnabled(false)
+		ax.park.parked = true
+		fmt.Printf("[Park] %v parked at %v\n", ax.name, ax.position)
+
+		if err := ax.saveParkState(); err != nil {
+			fmt.Printf("[Park] %v\n", err)
+		}
+	})
+
+}
+
+// Allow the axis to move again, the motor stays disabled until it is enabled
+func (ax *Axis) Unpark() error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.unpark()
+}
+
+func (ax *Axis) unpark() error {
+
+	if !ax.park.parked {
+		return nil
+	}
+
+	ax.park.parked = false
+	fmt.Printf("[Unpark] %v unparked at %v\n", ax.name, ax.position)
+
+	return ax.saveParkState()
+}
+
+// Slew to the home position, the motor stops and holds when it arrives
+func (ax *Axis) Home() error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.slewTo(HOME_POSITION, float64(ax.maxHz)/20, ax.stop)
+}
+
+// Restore the position saved when the axis parked, if the axis was not parked the encoder is zeroed
+//
+// The saved limits are restored either way, they are measured from home
+func (ax *Axis) restorePosition() {
+
+	record, err := ax.loadParkState()
+	if err != nil {
+		fmt.Printf("[restorePosition] %v %v, position set to zero\n", ax.name, err)
+		ax.zero()
+		return
+	}
+	ax.park.position = record.parkPosition
+	ax.limits.min = record.limitMin
+	ax.limits.max = record.limitMax
+	ax.limits.enabled = true
+
+	// The mount may have been moved since the position was saved
+	if !record.parked {
+		fmt.Printf("[restorePosition] %v was not parked, position set to zero\n", ax.name)
+		ax.zero()
+		return
+	}
+
+	// An encoder that keeps its zero in software needs it back before the position means anything
+	if enc, ok := ax.enc.(encoder.ZeroOffsetEncoder); ok {
+		if !record.zeroOffsetSaved {
+			fmt.Printf("[restorePosition] %v encoder zero was not saved, position set to zero\n", ax.name)
+			ax.zero()
+			return
+		}
+		enc.SetZeroOffset(record.zeroOffset)
+	}
+
+	position, err := ax.enc.RestorePosition(record.position)
+	if err != nil {
+		fmt.Printf("[restorePosition] %v %v, position set to zero\n", ax.name, err)
+		ax.zero()
+		return
+	}
+
+	ax.position = position
+	ax.park.parked = true
+	ax.resetWatchdog()
+
+}
+
+type parkRecord struct {
+	parked          bool
+	parkPosition    int64
+	position        int64
+	limitMin        int64
+	limitMax        int64
+	zeroOffsetSaved bool
+	zeroOffset      uint16
+}
+
+// Returns the offset of the erase block the park state is kept in
+func (ax *Axis) parkOffset() int64 {
+
+	flash := ax.park.flash
+	return flash.Size() - flash.EraseBlockSize()
+}
+
+func (ax *Axis) loadParkState() (parkRecord, error) {
+
+	if ax.park.flash == nil {
+		return parkRecord{}, errors.New("no flash set")
+	}
+
+	buf := make([]byte, PARK_RECORD_SIZE)
+	if _, err := ax.park.flash.ReadAt(buf, ax.parkOffset()); err != nil {
+		return parkRecord{}, err
+	}
+
+	//
+	// Record layout, little endian
+	//
+	//   0 magic
+	//   4 flags, PARK_FLAG_
+	//   8 park position, signed 64 bit
+	//  16 position, signed 64 bit
+	//  24 min limit, signed 64 bit
+	//  32 max limit, signed 64 bit
+	//  40 encoder zero offset, unsigned 32 bit
+	//  44 crc32 of bytes 0 to 43
+	//
+	if binary.LittleEndian.Uint32(buf[0:]) != PARK_MAGIC {
+		return parkRecord{}, errors.New("no park state saved")
+	}
+	if binary.LittleEndian.Uint32(buf[44:]) != crc32.ChecksumIEEE(buf[:44]) {
+		return parkRecord{}, errors.New("park state is corrupt")
+	}
+
+	flags := binary.LittleEndian.Uint32(buf[4:])
+	record := parkRecord{
+		parked:          flags&PARK_FLAG_PARKED != 0,
+		parkPosition:    int64(binary.LittleEndian.Uint64(buf[8:])),
+		position:        int64(binary.LittleEndian.Uint64(buf[16:])),
+		limitMin:        int64(binary.LittleEndian.Uint64(buf[24:])),
+		limitMax:        int64(binary.LittleEndian.Uint64(buf[32:])),
+		zeroOffsetSaved: flags&PARK_FLAG_ZERO_OFFSET != 0,
+		zeroOffset:      uint16(binary.LittleEndian.Uint32(buf[40:])),
+	}
+	if record.limitMin >= record.limitMax {
+		return parkRecord{}, errors.New("park state limits are corrupt")
+	}
+
+	return record, nil
+}
+
+func (ax *Axis) saveParkState() error {
+
+	flash := ax.park.flash
+	if flash == nil {
+		return nil
+	}
+
+	// Flash is written a whole block at a time, the record may take more than one
+	size := int64(PARK_RECORD_SIZE)
+	if block := flash.WriteBlockSize(); block > 0 {
+		size = (size + block - 1) / block * block
+	}
+	buf := make([]byte, size)
+	var flags, zeroOffset uint32
+	if ax.park.parked {
+		flags |= PARK_FLAG_PARKED
+	}
+	if enc, ok := ax.enc.(encoder.ZeroOffsetEncoder); ok {
+		flags |= PARK_FLAG_ZERO_OFFSET
+		zeroOffset = uint32(enc.GetZeroOffset())
+	}
+	binary.LittleEndian.PutUint32(buf[0:], PARK_MAGIC)
+	binary.LittleEndian.PutUint32(buf[4:], flags)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(ax.park.position))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(ax.position))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(ax.limits.min))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(ax.limits.max))
+	binary.LittleEndian.PutUint32(buf[40:], zeroOffset)
+	binary.LittleEndian.PutUint32(buf[44:], crc32.ChecksumIEEE(buf[:44]))
+
+	offset := ax.parkOffset()
+	if err := flash.EraseBlocks(offset/flash.EraseBlockSize(), 1); err != nil {
+		return fmt.Errorf("erase %v park state: %v", ax.name, err)
+	}
+	if _, err := flash.WriteAt(buf, offset); err != nil {
+		return fmt.Errorf("save %v park state: %v", ax.name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Periodic error correction (PEC)
+//
+// The worm turns once every wormRatio-th of a sidereal day, for a 144:1 worm that is just under
+// 10 minutes. Any error in the worm shows up once per worm revolution so it can be recorded over
+// one revolution and played back as a correction to the tracking rate.
+//
+// The closed-loop tracking already holds the encoder to the tracking rate, so the rate the encoder
+// measures is only what the loop has not yet removed. What is recorded is the loop's correction
+// term instead, the rate change it had to make at each point of the worm. Played back that change
+// is made ahead of time and the loop is left with only what PEC misses.
+const (
+	// The number of bins one worm revolution is divided into
+	PEC_BINS = 128
+
+	// The most PEC will change the tracking rate, as a fraction of the rate
+	PEC_MAX_CORRECTION = 0.1
+
+	// The width of the moving average used to smooth the recording, must be odd
+	PEC_SMOOTHING = 5
+)
+
+type PecState string
+
+const (
+	PEC_OFF       PecState = "Off"
+	PEC_RECORDING PecState = "Recording"
+	PEC_PLAYBACK  PecState = "Playback"
+)
+
+type pecTable struct {
+	state PecState
+
+	// The loop's correction summed per bin and the number of samples in each bin while recording
+	sum   [PEC_BINS]float64
+	count [PEC_BINS]uint16
+
+	// Recording is done once every bin has been passed through
+	lastBin  int
+	binsSeen int
+
+	// The correction for each bin as a fraction of the tracking rate
+	hasTable   bool
+	correction [PEC_BINS]float64
+}
+
+// Start recording the periodic error, recording takes one worm revolution
+//
+// The RA must be tracking closed-loop, any table already recorded is replaced when the recording is done
+func (ra *RADriver) StartPECRecording() error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if !ra.tracking.enabled || !ra.isEnabled() {
+		return errors.New("the RA must be tracking to record PEC")
+	}
+
+	if !ra.tracking.closedLoop {
+		return errors.New("PEC records the closed-loop correction, turn closed-loop tracking on first")
+	}
+
+	pec := &ra.pec
+	pec.sum = [PEC_BINS]float64{}
+	pec.count = [PEC_BINS]uint16{}
+	pec.lastBin = -1
+	pec.binsSeen = 0
+	pec.state = PEC_RECORDING
+
+	fmt.Println("[StartPECRecording] Recording PEC for one worm revolution")
+	return nil
+}
+
+// Turn PEC playback on or off, a table must have been recorded first
+func (ra *RADriver) SetPECPlayback(on bool) error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if !on {
+		if ra.pec.state == PEC_PLAYBACK {
+			ra.pec.state = PEC_OFF
+		}
+		return nil
+	}
+
+	if !ra.pec.hasTable {
+		return errors.New("no PEC table, record one first")
+	}
+	if ra.pec.state == PEC_RECORDING {
+		return errors.New("PEC is recording")
+	}
+
+	ra.pec.state = PEC_PLAYBACK
+	return nil
+}
+
+// Stop recording or playback and throw away the PEC table
+func (ra *RADriver) ClearPEC() {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.pec = pecTable{state: PEC_OFF}
+
+}
+
+func (ra *RADriver) GetPECState() PecState {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.pec.state
+}
+
+// Returns a copy of the correction table, one entry per bin as a fraction of the tracking rate
+func (ra *RADriver) GetPECTable() []float64 {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	table := make([]float64, PEC_BINS)
+	copy(table, ra.pec.correction[:])
+	return table
+}
+
+// Returns the encoder counts for one worm revolution
+//
+// The encoder is on the motor shaft, so one worm revolution is gearRatio motor revolutions
+func (ra *RADriver) countsPerWormRevolution() uint32 {
+	return ra.countsPerMotorRevolution() * uint32(ra.gearRatio)
+}
+
+// Returns the PEC bin for an encoder position, positions either side of home fall in the same bins
+func (ra *RADriver) pecBin(position int64) int {
+
+	wormCounts := int64(ra.countsPerWormRevolution())
+	offset := position % wormCounts
+	if offset < 0 {
+		offset += wormCounts
+	}
+	return int(offset * PEC_BINS / wormCounts)
+}
+
+// Returns the correction to apply at the current position, zero unless playing back
+func (ra *RADriver) pecCorrection() float64 {
+
+	if ra.pec.state != PEC_PLAYBACK {
+		return 0
+	}
+	return ra.pec.correction[ra.pecBin(ra.position)]
+}
+
+// Called from the tracking loop with each new correction
+func (ra *RADriver) recordPEC() {
+
+	pec := &ra.pec
+
+	if pec.state != PEC_RECORDING || ra.tracking.baseHz <= 0 {
+		return
+	}
+
+	// The correction as a fraction of the tracking rate, 0.01 is 1% faster
+	bin := ra.pecBin(ra.position)
+	pec.sum[bin] += ra.tracking.correctionHz / ra.tracking.baseHz
+	pec.count[bin]++
+
+	if pec.lastBin >= 0 && bin != pec.lastBin {
+		pec.binsSeen++
+	}
+	pec.lastBin = bin
+
+	// One full worm revolution has been recorded
+	if pec.binsSeen >= PEC_BINS {
+		ra.buildPECTable()
+	}
+
+}
+
+// Turn the recorded samples into a smoothed correction table
+func (ra *RADriver) buildPECTable() {
+
+	pec := &ra.pec
+
+	//
+	// Average each bin, bins with no samples are filled from the nearest bins that have one
+	//
+	var average [PEC_BINS]float64
+	for i := 0; i < PEC_BINS; i++ {
+		if pec.count[i] > 0 {
+			average[i] = pec.sum[i] / float64(pec.count[i])
+			continue
+		}
+		for d := 1; d < PEC_BINS/2; d++ {
+			before := (i - d + PEC_BINS) % PEC_BINS
+			after := (i + d) % PEC_BINS
+			if pec.count[before] > 0 && pec.count[after] > 0 {
+				average[i] = (pec.sum[before]/float64(pec.count[before]) + pec.sum[after]/float64(pec.count[after])) / 2
+				break
+			} else if pec.count[before] > 0 {
+				average[i] = pec.sum[before] / float64(pec.count[before])
+				break
+			} else if pec.count[after] > 0 {
+				average[i] = pec.sum[after] / float64(pec.count[after])
+				break
+			}
+		}
+	}
+
+	//
+	// Smooth with a moving average that wraps around, the worm error is periodic
+	//
+	var smooth [PEC_BINS]float64
+	var mean float64
+	half := PEC_SMOOTHING / 2
+	for i := 0; i < PEC_BINS; i++ {
+		var total float64
+		for d := -half; d <= half; d++ {
+			total += average[(i+d+PEC_BINS)%PEC_BINS]
+		}
+		smooth[i] = total / PEC_SMOOTHING
+		mean += smooth[i]
+	}
+	mean = mean / PEC_BINS
+
+	//
+	// The mean is a constant rate error that the tracking loop removes on its own,
+	// what is left is the correction for the periodic error
+	//
+	for i := 0; i < PEC_BINS; i++ {
+		correction := smooth[i] - mean
+		pec.correction[i] = math.Max(-PEC_MAX_CORRECTION, math.Min(PEC_MAX_CORRECTION, correction))
+	}
+
+	pec.hasTable = true
+	pec.state = PEC_OFF
+
+	fmt.Println("[buildPECTable] PEC recording done")
+}
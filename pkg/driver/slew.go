@@ -0,0 +1,234 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Slew settings
+const (
+	// How often the slew ramp is updated
+	SLEW_INTERVAL = time.Millisecond * 50
+
+	// The slew is done when the axis is this many encoder counts from the target
+	SLEW_TOLERANCE = 20
+
+	// The default acceleration as a fraction of maxHz per second, 0.5 reaches maxHz in 2 seconds
+	SLEW_DEFAULT_ACCEL_FACTOR = 0.5
+
+	// If the axis moves this many motor turns further away from the target the slew is stopped
+	SLEW_RUNAWAY_TURNS = 1
+)
+
+type slewState struct {
+	// True while a slew is in progress
+	active bool
+
+	// Set to stop the slew in progress
+	abort bool
+
+	// Where the slew started and where it is going
+	start  int64
+	target int64
+
+	// The remaining distance in encoder counts
+	remaining uint64
+
+	// Ramp acceleration in Hz per second
+	accelHz float64
+}
+
+// Set the slew ramp acceleration in Hz per second
+func (ax *Axis) SetSlewAcceleration(accelHz float64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if accelHz <= 0 {
+		return errors.New("accelHz must be greater than 0")
+	}
+	ax.slew.accelHz = accelHz
+
+	return nil
+}
+
+// Move the axis to the target encoder position, the motor stops and holds when it arrives
+//
+// The PWM frequency is ramped up and back down so the motor does not stall, above the threshold the
+// microstep is switched so the slew can go faster than maxHz allows at maxMicroStepSetting, see microstep.go.
+// SlewTo returns right away, use IsSlewing and GetSlewProgress to follow the slew and Abort to stop it.
+func (ax *Axis) SlewTo(target int64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.slewTo(target, float64(ax.maxHz)/20, ax.stop)
+}
+
+// Start a slew that ramps up from minHz, done is called with the lock held when the slew ends for any reason
+func (ax *Axis) slewTo(target int64, minHz float64, done func()) error {
+
+	if ax.slew.active {
+		return errors.New("slew already in progress")
+	}
+
+	if ax.backlash.calibrating {
+		return errors.New("backlash calibration in progress")
+	}
+
+	if ax.park.parked {
+		return fmt.Errorf("%v is parked, unpark it first", ax.name)
+	}
+
+	if (target > ax.position && ax.isUnsafe(AXIS_FORWARD)) || (target < ax.position && ax.isUnsafe(AXIS_REVERSE)) {
+		return fmt.Errorf("%v %v, the target is past the limit", ax.name, ax.limits.alarm)
+	}
+
+	// A motor that can not be enabled never moves and the slew would never end
+	dir := AXIS_REVERSE
+	if target > ax.position {
+		dir = AXIS_FORWARD
+	}
+	if err := ax.canEnable(dir); err != nil {
+		return err
+	}
+
+	ax.slew.active = true
+	ax.slew.abort = false
+	ax.slew.start = ax.position
+	ax.slew.target = target
+	ax.slew.remaining = absDiff(target, ax.position)
+
+	go ax.slewRoutine(minHz, done)
+
+	return nil
+}
+
+// Stop the slew in progress
+func (ax *Axis) Abort() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if ax.slew.active {
+		fmt.Printf("[Abort] Abort %v slew\n", ax.name)
+		ax.slew.abort = true
+	}
+
+}
+
+// Returns true while a slew is in progress
+func (ax *Axis) IsSlewing() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.slew.active
+}
+
+// Returns the slew progress from 0 to 100 percent
+func (ax *Axis) GetSlewProgress() float64 {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	total := absDiff(ax.slew.target, ax.slew.start)
+	if total == 0 {
+		return 100
+	}
+
+	progress := 100 * (1 - float64(ax.slew.remaining)/float64(total))
+	return math.Max(0, progress)
+}
+
+func (ax *Axis) slewRoutine(minHz float64, done func()) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	fmt.Printf("[slewRoutine] %v slew from %v to %v\n", ax.name, ax.slew.start, ax.slew.target)
+
+	topHz := ax.slewTopHz()
+	stepsPerCount := ax.stepsPerCount()
+
+	forward := ax.slew.target > ax.position
+	if forward {
+		ax.setAxisDirection(AXIS_FORWARD)
+	} else {
+		ax.setAxisDirection(AXIS_REVERSE)
+	}
+
+	hz := minHz
+	closest := ax.slew.remaining
+	ax.setPWMHz(hz)
+	ax.setEnabled(true)
+
+	for {
+
+		if ax.slew.abort {
+			fmt.Printf("[slewRoutine] %v slew aborted\n", ax.name)
+			break
+		}
+
+		// A fault, the temperature or a limit can disable the motor, it would never reach the target
+		if !ax.isEnabled() {
+			fmt.Printf("[slewRoutine] %v slew stopped, the motor is disabled\n", ax.name)
+			break
+		}
+
+		ax.slew.remaining = absDiff(ax.slew.target, ax.position)
+
+		// Done when within tolerance or once the target has been passed
+		if ax.slew.remaining <= SLEW_TOLERANCE || (forward && ax.position > ax.slew.target) || (!forward && ax.position < ax.slew.target) {
+			fmt.Printf("[slewRoutine] %v slew done at position %v\n", ax.name, ax.position)
+			break
+		}
+
+		// If the axis keeps moving away from the target the direction pin is wired backward
+		if ax.slew.remaining < closest {
+			closest = ax.slew.remaining
+		} else if ax.slew.remaining-closest > SLEW_RUNAWAY_TURNS*uint64(ax.countsPerMotorRevolution()) {
+			fmt.Printf("[slewRoutine] %v slew stopped, moving away from the target\n", ax.name)
+			break
+		}
+
+		//
+		// Ramp down when the remaining distance is within the stopping distance, otherwise ramp up
+		//
+		//   stopping steps = hz^2 / (2 * acceleration)
+		//
+		dHz := ax.slew.accelHz * SLEW_INTERVAL.Seconds()
+		remainingSteps := float64(ax.slew.remaining) * stepsPerCount
+		stoppingSteps := (hz * hz) / (2 * ax.slew.accelHz)
+
+		if remainingSteps <= stoppingSteps {
+			hz = math.Max(minHz, hz-dHz)
+		} else {
+			hz = math.Min(topHz, hz+dHz)
+		}
+		ax.applyMicroStepPolicy(hz)
+		hz = math.Min(hz, ax.pulseTopHz())
+		ax.setPWMHz(hz)
+
+		ax.sleepUnlocked(SLEW_INTERVAL)
+	}
+
+	// Back to the fine microstep before tracking or holding
+	if ax.microStepSetting != ax.maxMicroStepSetting {
+		ax.setMicroStepSetting(ax.maxMicroStepSetting)
+	}
+
+	ax.slew.active = false
+	ax.slew.abort = false
+	done()
+
+}
+
+func absDiff(a int64, b int64) uint64 {
+	if a > b {
+		return uint64(a - b)
+	}
+	return uint64(b - a)
+}
@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// Stepper driver temperature
+//
+// The hottest reading of the sensors is used. Above the throttle temperature the TMC2208 run current
+// is cut, above the max temperature the motor is disabled and an ALARM_OVER_TEMP alarm is raised.
+// The motor can not be enabled again until it has cooled below the max temperature less the hysteresis.
+//
+// With the MS pins the current is set by the VREF trimmer and can not be cut, the STEP duty cycle and
+// microstep do not change it, so without the TMC2208 UART only the max temperature cut out applies.
+const (
+	// How often the sensors are read
+	TEMP_INTERVAL = time.Second * 5
+
+	TEMP_DEFAULT_THROTTLE_C = 60.0
+	TEMP_DEFAULT_MAX_C      = 75.0
+	TEMP_HYSTERESIS_C       = 5.0
+
+	// The run current is multiplied by this while throttled
+	TEMP_THROTTLE_CURRENT_FACTOR = 0.5
+)
+
+// Returns a temperature in °C
+type TemperatureSensor interface {
+	ReadTemperature() (float64, error)
+}
+
+// The RP2040 internal temperature sensor, it reads the die temperature of the Pico
+// so it is only close to the driver temperature if the Pico is next to the driver
+type InternalTemperatureSensor struct{}
+
+func (s InternalTemperatureSensor) ReadTemperature() (float64, error) {
+
+	// hal.ReadTemperature returns milli °C
+	return float64(hal.ReadTemperature()) / 1000, nil
+}
+
+// An NTC thermistor on an ADC pin, wired as the bottom of a divider
+//
+//	3v3 -- seriesOhms -- ADC pin -- thermistor -- GND
+type ThermistorSensor struct {
+	adc hal.ADC
+
+	// The fixed resistor in the divider
+	seriesOhms float64
+
+	// The thermistor resistance at 25°C and its beta, a common part is 10k with a beta of 3950
+	nominalOhms float64
+	beta        float64
+}
+
+// Returns a new ThermistorSensor, the ADC must already be configured, see hal.NewADC
+func NewThermistorSensor(adc hal.ADC, seriesOhms float64, nominalOhms float64, beta float64) (ThermistorSensor, error) {
+
+	if adc == nil {
+		return ThermistorSensor{}, errors.New("adc must not be nil")
+	}
+
+	if seriesOhms <= 0 || nominalOhms <= 0 || beta <= 0 {
+		return ThermistorSensor{}, errors.New("seriesOhms, nominalOhms and beta must be greater than 0")
+	}
+
+	return ThermistorSensor{
+		adc:         adc,
+		seriesOhms:  seriesOhms,
+		nominalOhms: nominalOhms,
+		beta:        beta,
+	}, nil
+}
+
+// Beta equation: 1/T = 1/T0 + ln(R/R0)/beta, with T in kelvin
+func (s ThermistorSensor) ReadTemperature() (float64, error) {
+
+	// The ADC reading is scaled to 16 bits
+	reading := float64(s.adc.Get())
+	if reading <= 0 || reading >= 65535 {
+		return 0, errors.New("thermistor open or shorted")
+	}
+
+	ohms := s.seriesOhms * reading / (65535 - reading)
+	kelvin := 1 / (1/(25+273.15) + math.Log(ohms/s.nominalOhms)/s.beta)
+
+	return kelvin - 273.15, nil
+}
+
+type thermalState struct {
+	sensors []TemperatureSensor
+
+	// The hottest reading, NaN until the sensors are read
+	celsius float64
+
+	throttleC float64
+	maxC      float64
+
+	// True while the run current is cut, and the run current to go back to
+	throttled  bool
+	runCurrent uint8
+
+	// True from the time the max temperature is passed until the driver has cooled
+	overTemp bool
+}
+
+// Start reading the sensors, the hottest reading is used
+func (ax *Axis) ConfigureTemperature(sensors ...TemperatureSensor) {
+
+	ax.mu.Lock()
+	ax.thermal.sensors = sensors
+	if ax.tmc == nil {
+		fmt.Printf("[ConfigureTemperature] %v has no TMC2208 UART, the run current can not be throttled\n", ax.name)
+	}
+	ax.mu.Unlock()
+
+	go ax.temperatureRoutine()
+
+}
+
+// Set the throttle and max temperatures in °C
+func (ax *Axis) SetTemperatureLimits(throttleC float64, maxC float64) error {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if throttleC >= maxC {
+		return errors.New("the throttle temperature must be less than the max temperature")
+	}
+
+	ax.thermal.throttleC = throttleC
+	ax.thermal.maxC = maxC
+
+	return nil
+}
+
+func (ax *Axis) GetTemperatureLimits() (throttleC float64, maxC float64) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.thermal.throttleC, ax.thermal.maxC
+}
+
+// Returns the hottest reading in °C, NaN if there are no sensors
+func (ax *Axis) GetTemperature() float64 {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.thermal.celsius
+}
+
+// Returns true while the run current is cut
+func (ax *Axis) IsThrottled() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.thermal.throttled
+}
+
+func (ax *Axis) temperatureRoutine() {
+
+	for {
+		ax.mu.Lock()
+
+		hottest := math.NaN()
+		for _, sensor := range ax.thermal.sensors {
+			celsius, err := sensor.ReadTemperature()
+			if err != nil {
+				fmt.Printf("[temperatureRoutine] %v %v\n", ax.name, err)
+				continue
+			}
+			if math.IsNaN(hottest) || celsius > hottest {
+				hottest = celsius
+			}
+		}
+
+		ax.thermal.celsius = hottest
+		if !math.IsNaN(hottest) {
+			ax.checkTemperature()
+		}
+
+		ax.mu.Unlock()
+		ax.clock.Sleep(TEMP_INTERVAL)
+	}
+
+}
+
+func (ax *Axis) checkTemperature() {
+
+	th := &ax.thermal
+	celsius := th.celsius
+
+	//
+	// Over the max temperature, disable the motor
+	//
+	if celsius > th.maxC && !th.overTemp {
+		fmt.Printf("[checkTemperature] %v %.1f°C is over %.1f°C, motor disabled\n", ax.name, celsius, th.maxC)
+		th.overTemp = true
+
+		ax.slew.abort = ax.slew.active
+		ax.stop()
+		ax.setEnabled(false)
+		ax.sendAlarm(ALARM_OVER_TEMP)
+
+	} else if celsius < th.maxC-TEMP_HYSTERESIS_C && th.overTemp {
+		fmt.Printf("[checkTemperature] %v cooled to %.1f°C, the motor can be enabled\n", ax.name, celsius)
+		th.overTemp = false
+	}
+
+	//
+	// Over the throttle temperature, cut the run current
+	//
+	if ax.tmc == nil {
+		return
+	}
+
+	if celsius > th.throttleC && !th.throttled {
+		run, hold := ax.tmc.GetCurrent()
+		if err := ax.tmc.SetCurrent(uint8(float64(run)*TEMP_THROTTLE_CURRENT_FACTOR), hold); err != nil {
+			fmt.Printf("[checkTemperature] %v %v\n", ax.name, err)
+			return
+		}
+		fmt.Printf("[checkTemperature] %v %.1f°C is over %.1f°C, run current cut\n", ax.name, celsius, th.throttleC)
+		th.runCurrent = run
+		th.throttled = true
+
+	} else if celsius < th.throttleC-TEMP_HYSTERESIS_C && th.throttled {
+		_, hold := ax.tmc.GetCurrent()
+		if err := ax.tmc.SetCurrent(th.runCurrent, hold); err != nil {
+			fmt.Printf("[checkTemperature] %v %v\n", ax.name, err)
+			return
+		}
+		fmt.Printf("[checkTemperature] %v cooled to %.1f°C, run current restored\n", ax.name, celsius)
+		th.throttled = false
+	}
+
+}
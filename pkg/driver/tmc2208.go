@@ -0,0 +1,380 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TMC2208 UART register interface
+//
+// The TMC2208 has a single wire UART on the PDN_UART pin. Wire the Pico TX to PDN_UART through a 1k
+// resistor and the Pico RX straight to PDN_UART, the Pico then reads back its own bytes before the reply.
+// Without a spare hardware UART use hal.SoftUART on one GPIO wired to PDN_UART through the 1k resistor.
+// See the datasheet: https://www.trinamic.com/fileadmin/assets/Products/ICs_Documents/TMC220x_TMC2224_datasheet_Rev1.09.pdf
+//
+// Over the UART the driver can do 1/256 microstepping, set the run and hold current, choose StealthChop
+// or SpreadCycle and report its status. Once configured the MS1 and MS2 pins are ignored.
+const (
+	TMC_SYNC       byte = 0x05
+	TMC_SLAVE_ADDR byte = 0x00
+	TMC_WRITE      byte = 0x80
+	TMC_REPLY_ADDR byte = 0xFF
+
+	// How long to wait for a reply
+	TMC_TIMEOUT = time.Millisecond * 20
+)
+
+// Registers
+const (
+	TMC_GCONF      byte = 0x00
+	TMC_GSTAT      byte = 0x01
+	TMC_IFCNT      byte = 0x02
+	TMC_IHOLD_IRUN byte = 0x10
+	TMC_CHOPCONF   byte = 0x6C
+	TMC_DRV_STATUS byte = 0x6F
+)
+
+// Register bits and defaults
+const (
+	TMC_GCONF_I_SCALE_ANALOG   uint32 = 1 << 0 // VREF scales the current, set at power on
+	TMC_GCONF_EN_SPREADCYCLE   uint32 = 1 << 2
+	TMC_GCONF_PDN_DISABLE      uint32 = 1 << 6 // PDN_UART is used for the UART
+	TMC_GCONF_MSTEP_REG_SELECT uint32 = 1 << 7 // Microstep from MRES instead of the MS pins
+	TMC_GCONF_MULTISTEP_FILT   uint32 = 1 << 8
+
+	TMC_CHOPCONF_DEFAULT    uint32 = 0x10000053 // Power on value, interpolation to 1/256 and 1/16 microsteps
+	TMC_CHOPCONF_MRES_SHIFT        = 24
+	TMC_CHOPCONF_MRES_MASK  uint32 = 0xF << TMC_CHOPCONF_MRES_SHIFT
+
+	TMC_IHOLD_IRUN_DELAY_SHIFT  = 16
+	TMC_IHOLD_IRUN_DEFAULT_HOLD = 8
+	TMC_IHOLD_IRUN_DEFAULT_RUN  = 16
+	TMC_MAX_CURRENT             = 31
+)
+
+// The part of a UART the TMC2208 needs, machine.UART satisfies it
+type TMCUART interface {
+	Buffered() int
+	ReadByte() (byte, error)
+	Write(data []byte) (n int, err error)
+}
+
+// Driver status flags read from DRV_STATUS
+type TMCStatus struct {
+	OverTempWarning bool // otpw, above 120°C
+	OverTemp        bool // ot, the driver has shut down
+	ShortToGround   bool // s2ga or s2gb
+	ShortToSupply   bool // s2vsa or s2vsb
+	OpenLoad        bool // ola or olb, only valid while the motor is moving slowly
+	StealthChop     bool
+	Standstill      bool
+}
+
+// Returns the status as a short list of flags, for example "OTPW,OL", or "OK"
+func (s TMCStatus) String() string {
+
+	var flags []string
+	if s.OverTemp {
+		flags = append(flags, "OT")
+	}
+	if s.OverTempWarning {
+		flags = append(flags, "OTPW")
+	}
+	if s.ShortToGround {
+		flags = append(flags, "S2G")
+	}
+	if s.ShortToSupply {
+		flags = append(flags, "S2VS")
+	}
+	if s.OpenLoad {
+		flags = append(flags, "OL")
+	}
+
+	if len(flags) == 0 {
+		return "OK"
+	}
+	return strings.Join(flags, ",")
+}
+
+// Returns true if the driver has shut down or a coil is shorted
+func (s TMCStatus) IsFault() bool {
+	return s.OverTemp || s.ShortToGround || s.ShortToSupply
+}
+
+type TMC2208 struct {
+	uart TMCUART
+
+	// The register values last written, IHOLD_IRUN can not be read back
+	gconf     uint32
+	chopconf  uint32
+	ihold     uint8
+	irun      uint8
+	microStep MicroStep
+}
+
+// Returns a new TMC2208, the UART must already be configured
+func NewTMC2208(uart TMCUART) (TMC2208, error) {
+
+	if uart == nil {
+		return TMC2208{}, errors.New("uart must not be nil")
+	}
+
+	return TMC2208{
+		uart:      uart,
+		gconf:     TMC_GCONF_I_SCALE_ANALOG | TMC_GCONF_PDN_DISABLE | TMC_GCONF_MSTEP_REG_SELECT | TMC_GCONF_MULTISTEP_FILT,
+		chopconf:  TMC_CHOPCONF_DEFAULT,
+		ihold:     TMC_IHOLD_IRUN_DEFAULT_HOLD,
+		irun:      TMC_IHOLD_IRUN_DEFAULT_RUN,
+		microStep: MS_SIXTEENTH,
+	}, nil
+}
+
+// Take over the driver from the MS pins, StealthChop is on and the microstep is 1/16
+func (tmc *TMC2208) Configure() error {
+
+	// The interface counter goes up by one for every good write, use it to check the wiring
+	before, err := tmc.ReadRegister(TMC_IFCNT)
+	if err != nil {
+		return fmt.Errorf("TMC2208 not responding: %v", err)
+	}
+
+	// Keep the power on bits, I_scale_analog and internal_Rsense come from the OTP and the board is wired for them
+	gconf, err := tmc.ReadRegister(TMC_GCONF)
+	if err != nil {
+		return err
+	}
+	gconf = gconf&^TMC_GCONF_EN_SPREADCYCLE | TMC_GCONF_PDN_DISABLE | TMC_GCONF_MSTEP_REG_SELECT | TMC_GCONF_MULTISTEP_FILT
+	if err := tmc.WriteRegister(TMC_GCONF, gconf); err != nil {
+		return err
+	}
+	tmc.gconf = gconf
+
+	after, err := tmc.ReadRegister(TMC_IFCNT)
+	if err != nil {
+		return err
+	}
+	if after&0xFF != (before+1)&0xFF {
+		return errors.New("TMC2208 did not accept the write, check the PDN_UART wiring")
+	}
+
+	if err := tmc.SetCurrent(tmc.irun, tmc.ihold); err != nil {
+		return err
+	}
+
+	return tmc.SetMicroStep(tmc.microStep)
+}
+
+// Set the run and hold current, each from 0 to 31 as a fraction of the full scale current set by the sense resistors
+func (tmc *TMC2208) SetCurrent(run uint8, hold uint8) error {
+
+	if run > TMC_MAX_CURRENT || hold > TMC_MAX_CURRENT {
+		return fmt.Errorf("current must be from 0 to %v", TMC_MAX_CURRENT)
+	}
+
+	// IHOLDDELAY of 1 ramps down to the hold current over about 2^18 clocks
+	value := uint32(hold) | uint32(run)<<8 | 1<<TMC_IHOLD_IRUN_DELAY_SHIFT
+	if err := tmc.WriteRegister(TMC_IHOLD_IRUN, value); err != nil {
+		return err
+	}
+
+	tmc.irun = run
+	tmc.ihold = hold
+	return nil
+}
+
+func (tmc *TMC2208) GetCurrent() (run uint8, hold uint8) {
+	return tmc.irun, tmc.ihold
+}
+
+// StealthChop is quiet and good for tracking, SpreadCycle has more torque at speed
+func (tmc *TMC2208) SetStealthChop(on bool) error {
+
+	gconf := tmc.gconf
+	if on {
+		gconf &^= TMC_GCONF_EN_SPREADCYCLE
+	} else {
+		gconf |= TMC_GCONF_EN_SPREADCYCLE
+	}
+
+	if err := tmc.WriteRegister(TMC_GCONF, gconf); err != nil {
+		return err
+	}
+
+	tmc.gconf = gconf
+	return nil
+}
+
+func (tmc *TMC2208) GetStealthChop() bool {
+	return tmc.gconf&TMC_GCONF_EN_SPREADCYCLE == 0
+}
+
+// Set the microstep from MS_HALF to MS_TWO_FIFTY_SIXTH
+func (tmc *TMC2208) SetMicroStep(ms MicroStep) error {
+
+	var mres uint32
+	switch ms {
+	case MS_TWO_FIFTY_SIXTH:
+		mres = 0
+	case MS_ONE_TWENTY_EIGHTH:
+		mres = 1
+	case MS_SIXTY_FOURTH:
+		mres = 2
+	case MS_THIRTY_SECOND:
+		mres = 3
+	case MS_SIXTEENTH:
+		mres = 4
+	case MS_EIGHTH:
+		mres = 5
+	case MS_QUARTER:
+		mres = 6
+	case MS_HALF:
+		mres = 7
+	default:
+		return fmt.Errorf("microstep must be a power of 2 from %v to %v", MS_HALF, MS_TWO_FIFTY_SIXTH)
+	}
+
+	chopconf := (tmc.chopconf &^ TMC_CHOPCONF_MRES_MASK) | mres<<TMC_CHOPCONF_MRES_SHIFT
+	if err := tmc.WriteRegister(TMC_CHOPCONF, chopconf); err != nil {
+		return err
+	}
+
+	tmc.chopconf = chopconf
+	tmc.microStep = ms
+	return nil
+}
+
+func (tmc *TMC2208) GetMicroStep() MicroStep {
+	return tmc.microStep
+}
+
+// Read the driver status flags
+func (tmc *TMC2208) ReadStatus() (TMCStatus, error) {
+
+	value, err := tmc.ReadRegister(TMC_DRV_STATUS)
+	if err != nil {
+		return TMCStatus{}, err
+	}
+
+	bit := func(n uint) bool { return value&(1<<n) != 0 }
+
+	return TMCStatus{
+		OverTempWarning: bit(0),
+		OverTemp:        bit(1),
+		ShortToGround:   bit(2) || bit(3),
+		ShortToSupply:   bit(4) || bit(5),
+		OpenLoad:        bit(6) || bit(7),
+		StealthChop:     bit(30),
+		Standstill:      bit(31),
+	}, nil
+}
+
+// Write a register
+//
+//	sync | slave address | register + 0x80 | data MSB first (4 bytes) | CRC
+func (tmc *TMC2208) WriteRegister(register byte, value uint32) error {
+
+	datagram := []byte{
+		TMC_SYNC,
+		TMC_SLAVE_ADDR,
+		register | TMC_WRITE,
+		byte(value >> 24),
+		byte(value >> 16),
+		byte(value >> 8),
+		byte(value),
+		0,
+	}
+	datagram[7] = tmcCRC(datagram[:7])
+
+	tmc.flush()
+	if _, err := tmc.uart.Write(datagram); err != nil {
+		return err
+	}
+
+	// Throw away the echo of our own bytes
+	_, err := tmc.readBytes(len(datagram))
+	return err
+}
+
+// Read a register
+//
+//	request: sync | slave address | register | CRC
+//	reply:   sync | 0xFF | register | data MSB first (4 bytes) | CRC
+func (tmc *TMC2208) ReadRegister(register byte) (uint32, error) {
+
+	request := []byte{TMC_SYNC, TMC_SLAVE_ADDR, register, 0}
+	request[3] = tmcCRC(request[:3])
+
+	tmc.flush()
+	if _, err := tmc.uart.Write(request); err != nil {
+		return 0, err
+	}
+
+	// The echo of the request comes back first
+	reply, err := tmc.readBytes(len(request) + 8)
+	if err != nil {
+		return 0, err
+	}
+	reply = reply[len(request):]
+
+	if reply[0]&0x0F != TMC_SYNC || reply[1] != TMC_REPLY_ADDR || reply[2] != register {
+		return 0, fmt.Errorf("bad TMC2208 reply: %x", reply)
+	}
+	if reply[7] != tmcCRC(reply[:7]) {
+		return 0, errors.New("bad TMC2208 reply CRC")
+	}
+
+	return uint32(reply[3])<<24 | uint32(reply[4])<<16 | uint32(reply[5])<<8 | uint32(reply[6]), nil
+}
+
+// Throw away anything left in the receive buffer
+func (tmc *TMC2208) flush() {
+
+	for tmc.uart.Buffered() > 0 {
+		tmc.uart.ReadByte()
+	}
+
+}
+
+func (tmc *TMC2208) readBytes(n int) ([]byte, error) {
+
+	data := make([]byte, 0, n)
+	deadline := time.Now().Add(TMC_TIMEOUT)
+
+	for len(data) < n {
+		if tmc.uart.Buffered() == 0 {
+			if time.Now().After(deadline) {
+				return data, errors.New("TMC2208 reply timed out")
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		b, err := tmc.uart.ReadByte()
+		if err != nil {
+			return data, err
+		}
+		data = append(data, b)
+	}
+
+	return data, nil
+}
+
+// CRC8 with polynomial x^8 + x^2 + x + 1, bits are taken LSB first, see datasheet 4.2
+func tmcCRC(datagram []byte) byte {
+
+	var crc byte
+	for _, b := range datagram {
+		for i := 0; i < 8; i++ {
+			if (crc>>7)^(b&0x01) != 0 {
+				crc = (crc << 1) ^ 0x07
+			} else {
+				crc = crc << 1
+			}
+			b = b >> 1
+		}
+	}
+
+	return crc
+}
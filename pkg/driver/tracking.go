@@ -0,0 +1,243 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Closed-loop tracking defaults
+//
+// The error is measured in motor steps so the gains do not depend on the encoder resolution
+const (
+	TRACKING_DEFAULT_KP             = 0.05  // Hz of correction for each step the RA is behind
+	TRACKING_DEFAULT_KI             = 0.002 // Hz of correction for each step-second of accumulated error
+	TRACKING_DEFAULT_MAX_CORRECTION = 0.05  // The correction is limited to ±5% of the tracking rate
+	TRACKING_INTERVAL               = time.Second
+)
+
+// The tracking controller compares the encoder motion against the expected motion at the tracking rate
+// and trims the PWM rate so that the two stay together
+//
+// Open-loop tracking drifts when the motor slips or when the PWM period is rounded
+// to a whole number of nanoseconds, the controller removes both.
+type trackingController struct {
+	// The user setting, when false the rate is never trimmed
+	closedLoop bool
+
+	// True while running at a tracking rate, false while slewing or running at a fixed rate
+	enabled bool
+
+	// Controller gains
+	kp            float64
+	ki            float64
+	maxCorrection float64
+
+	// The open-loop tracking rate in Hz
+	baseHz float64
+
+	// The encoder counts per second expected at the tracking rate
+	countsPerSecond float64
+
+	// The position tracking is measured from
+	hasReference      bool
+	referencePosition int64
+
+	// The time of the last update and the encoder counts expected since the reference
+	lastTime time.Time
+	expected float64
+
+	// The accumulated error in step-seconds
+	integral float64
+
+	// The last computed error in encoder counts, positive means the RA is behind
+	trackingError float64
+
+	// The last correction applied on top of baseHz
+	correctionHz float64
+}
+
+func (tc *trackingController) start(baseHz float64, countsPerSecond float64) {
+
+	tc.baseHz = baseHz
+	tc.countsPerSecond = countsPerSecond
+	tc.enabled = true
+	tc.resetReference()
+
+}
+
+func (tc *trackingController) resetReference() {
+
+	tc.hasReference = false
+	tc.expected = 0
+	tc.integral = 0
+	tc.trackingError = 0
+	tc.correctionHz = 0
+
+}
+
+// Set the closed-loop tracking gains
+//
+//	kp            - Hz of correction for each step of position error
+//	ki            - Hz of correction for each step-second of accumulated error
+//	maxCorrection - the largest correction as a fraction of the tracking rate, for example 0.05 is ±5%
+func (ra *RADriver) SetTrackingGains(kp float64, ki float64, maxCorrection float64) error {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if kp < 0 || ki < 0 {
+		return errors.New("kp and ki must not be negative")
+	}
+
+	if maxCorrection < 0 || maxCorrection >= 1 {
+		return errors.New("maxCorrection must be between 0 and 1, typical value is 0.05")
+	}
+
+	ra.tracking.kp = kp
+	ra.tracking.ki = ki
+	ra.tracking.maxCorrection = maxCorrection
+	ra.tracking.resetReference()
+
+	return nil
+}
+
+// Returns the tracking gains kp, ki and maxCorrection
+func (ra *RADriver) GetTrackingGains() (kp float64, ki float64, maxCorrection float64) {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.tracking.kp, ra.tracking.ki, ra.tracking.maxCorrection
+}
+
+// Turn closed-loop tracking on or off, when off the motor runs at the open-loop tracking rate
+func (ra *RADriver) SetClosedLoop(closedLoop bool) {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.tracking.closedLoop = closedLoop
+	ra.tracking.resetReference()
+
+	if !closedLoop && ra.tracking.enabled {
+		ra.setPWMHz(ra.trackingHz())
+	}
+
+}
+
+// Returns true if the tracking rate is trimmed from encoder feedback
+func (ra *RADriver) GetClosedLoop() bool {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.tracking.closedLoop
+}
+
+// Returns the current tracking error in encoder counts, positive means the RA is behind the sky
+func (ra *RADriver) GetTrackingError() float64 {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.tracking.trackingError
+}
+
+// Returns the correction in Hz currently applied on top of the tracking rate
+func (ra *RADriver) GetTrackingCorrection() float64 {
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	return ra.tracking.correctionHz
+}
+
+func (ra *RADriver) trackingRoutine() {
+
+	for {
+		ra.clock.Sleep(TRACKING_INTERVAL)
+
+		ra.mu.Lock()
+		ra.updateTracking()
+		ra.mu.Unlock()
+	}
+
+}
+
+func (ra *RADriver) updateTracking() {
+
+	tc := &ra.tracking
+
+	// The pulse sets its own rate, the motion is added to the expected motion when the pulse ends
+	if !tc.enabled || ra.guide.active {
+		return
+	}
+
+	// The take up runs at its own rate and its motion does not count toward tracking
+	if ra.backlash.active {
+		tc.resetReference()
+		return
+	}
+
+	// Nothing to measure until the encoder has been read, or while the motor is disabled
+	if ra.positionTime.IsZero() || !ra.isEnabled() {
+		tc.resetReference()
+		return
+	}
+
+	if !tc.hasReference {
+		tc.referencePosition = ra.position
+		tc.lastTime = ra.positionTime
+		tc.hasReference = true
+		return
+	}
+
+	elapsed := ra.positionTime.Sub(tc.lastTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	tc.lastTime = ra.positionTime
+
+	// PEC cancels the periodic error, with it the encoder still follows the tracking rate
+	pec := ra.pecCorrection()
+	tc.expected += tc.countsPerSecond * elapsed
+
+	if tc.closedLoop {
+
+		// The direction is reset on reversal so only the distance moved matters here
+		moved := math.Abs(float64(ra.position) - float64(tc.referencePosition))
+		tc.trackingError = tc.expected - moved
+
+		errorSteps := tc.trackingError * ra.stepsPerCount()
+
+		integral := tc.integral + errorSteps*elapsed
+		correction := tc.kp*errorSteps + tc.ki*integral
+
+		// Limit the correction and stop integrating while limited so the loop does not wind up
+		limit := tc.maxCorrection * tc.baseHz
+		if correction > limit {
+			correction = limit
+		} else if correction < -limit {
+			correction = -limit
+		} else {
+			tc.integral = integral
+		}
+
+		tc.correctionHz = correction
+
+		fmt.Printf("[updateTracking] error: %.1f counts, correction: %.3f Hz, pec: %.4f\n", tc.trackingError, tc.correctionHz, pec)
+		ra.recordPEC()
+	}
+
+	ra.setPWMHz(ra.trackingHz())
+}
+
+// Returns the rate in Hz for the tracking rate with PEC, guiding and the closed-loop correction applied
+func (ra *RADriver) trackingHz() float64 {
+
+	factor := 1 + ra.pecCorrection() + ra.guide.factor
+	return ra.tracking.baseHz*factor + ra.tracking.correctionHz
+
+}
@@ -0,0 +1,262 @@
+package driver
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Stall and runaway watchdog
+//
+// The encoder is on the motor shaft so every step the driver is told to make should show up as
+// encoder motion. The watchdog adds up the steps expected from runningHz and the steps measured
+// by the encoder over a window and raises a fault when the two do not agree.
+type Fault string
+
+const (
+	FAULT_NONE    Fault = ""
+	FAULT_STALL   Fault = "Stall"   // The motor is not turning
+	FAULT_SLIP    Fault = "Slip"    // The motor is turning but losing steps
+	FAULT_RUNAWAY Fault = "Runaway" // The motor is turning faster than commanded or the wrong way
+	FAULT_MOVING  Fault = "Moving"  // The motor is turning when it should be stopped
+	FAULT_ENCODER Fault = "Encoder" // The encoder is unhealthy, the position can not be trusted
+)
+
+const (
+	// How long steps are added up before they are compared
+	WATCHDOG_WINDOW = time.Second * 2
+
+	// Windows with fewer expected steps than this are not checked, the encoder noise is too large
+	WATCHDOG_MIN_STEPS = 32
+
+	// The measured steps as a fraction of the expected steps
+	WATCHDOG_STALL_RATIO   = 0.1
+	WATCHDOG_SLIP_RATIO    = 0.5
+	WATCHDOG_RUNAWAY_RATIO = 1.5
+
+	// Encoder motion allowed in one window while stopped, as a fraction of a motor turn
+	WATCHDOG_STOPPED_TURNS = 1.0 / 32
+)
+
+type watchdogState struct {
+	// The user setting, true by default
+	enabled bool
+
+	// The fault raised, it stays until ClearFault
+	fault Fault
+
+	// The previous sample
+	hasLast      bool
+	lastPosition int64
+	lastTime     time.Time
+
+	// The current window
+	windowStart   time.Time
+	expectedSteps float64
+	measuredSteps float64
+	stoppedCounts uint64
+	running       bool
+
+	// The expected and measured steps of the window that raised the fault
+	faultExpected float64
+	faultMeasured float64
+
+	// Faults are sent here so they can be published on the bus, nil if no one is listening
+	faultCh chan Fault
+}
+
+// Turn the watchdog on or off
+func (ax *Axis) SetWatchdog(enabled bool) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.watchdog.enabled = enabled
+	ax.resetWatchdog()
+
+}
+
+func (ax *Axis) GetWatchdog() bool {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.watchdog.enabled
+}
+
+// Faults are sent to this channel as they are raised, the send does not block
+func (ax *Axis) SetFaultCh(ch chan Fault) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	ax.watchdog.faultCh = ch
+
+}
+
+// Returns the fault raised, FAULT_NONE if there is none
+func (ax *Axis) GetFault() Fault {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.watchdog.fault
+}
+
+// Returns the expected and measured motor steps of the window that raised the fault
+func (ax *Axis) GetFaultSteps() (expected float64, measured float64) {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	return ax.watchdog.faultExpected, ax.watchdog.faultMeasured
+}
+
+// Clear the fault so the motor can be enabled again
+func (ax *Axis) ClearFault() {
+
+	ax.mu.Lock()
+	defer ax.mu.Unlock()
+
+	if ax.watchdog.fault != FAULT_NONE {
+		fmt.Printf("[ClearFault] %v fault %v cleared\n", ax.name, ax.watchdog.fault)
+	}
+	ax.watchdog.fault = FAULT_NONE
+	ax.resetWatchdog()
+
+}
+
+// Start again from the next sample, used when the position jumps
+func (ax *Axis) resetWatchdog() {
+
+	wd := &ax.watchdog
+	wd.hasLast = false
+	wd.expectedSteps = 0
+	wd.measuredSteps = 0
+	wd.stoppedCounts = 0
+
+}
+
+// Called from the monitor with each new position
+func (ax *Axis) checkWatchdog() {
+
+	wd := &ax.watchdog
+
+	if !wd.enabled || wd.fault != FAULT_NONE {
+		return
+	}
+
+	if !wd.hasLast {
+		wd.lastPosition = ax.position
+		wd.lastTime = ax.positionTime
+		wd.windowStart = ax.positionTime
+		wd.running = ax.isEnabled() && ax.runningHz > 0
+		wd.hasLast = true
+		return
+	}
+
+	//
+	// Add this sample to the window, measured steps are positive in the commanded direction
+	//
+	elapsed := ax.positionTime.Sub(wd.lastTime).Seconds()
+	running := ax.isEnabled() && ax.runningHz > 0
+
+	delta := float64(ax.position) - float64(wd.lastPosition)
+	if ax.axisDirection() == AXIS_REVERSE {
+		delta = -delta
+	}
+
+	if running {
+		wd.expectedSteps += ax.runningHz * elapsed
+		wd.measuredSteps += delta * ax.stepsPerCount()
+	} else {
+		wd.stoppedCounts += absDiff(ax.position, wd.lastPosition)
+	}
+
+	// Starting or stopping starts a new window, the motor takes a moment to follow
+	if running != wd.running {
+		wd.running = running
+		wd.windowStart = ax.positionTime
+		wd.expectedSteps = 0
+		wd.measuredSteps = 0
+		wd.stoppedCounts = 0
+	}
+
+	wd.lastPosition = ax.position
+	wd.lastTime = ax.positionTime
+
+	if ax.positionTime.Sub(wd.windowStart) < WATCHDOG_WINDOW {
+		return
+	}
+
+	//
+	// Compare the window
+	//
+	fault := FAULT_NONE
+	if running && wd.expectedSteps >= WATCHDOG_MIN_STEPS {
+		ratio := wd.measuredSteps / wd.expectedSteps
+		if ratio < -WATCHDOG_STALL_RATIO || ratio > WATCHDOG_RUNAWAY_RATIO {
+			fault = FAULT_RUNAWAY
+		} else if ratio < WATCHDOG_STALL_RATIO {
+			fault = FAULT_STALL
+		} else if ratio < WATCHDOG_SLIP_RATIO {
+			fault = FAULT_SLIP
+		}
+	} else if !running && float64(wd.stoppedCounts) > WATCHDOG_STOPPED_TURNS*float64(ax.countsPerMotorRevolution()) {
+		fault = FAULT_MOVING
+		wd.measuredSteps = float64(wd.stoppedCounts) * ax.stepsPerCount()
+	}
+
+	if fault != FAULT_NONE {
+		ax.raiseFault(fault)
+	}
+
+	wd.windowStart = ax.positionTime
+	wd.expectedSteps = 0
+	wd.measuredSteps = 0
+	wd.stoppedCounts = 0
+
+}
+
+// Called from the monitor when a read fails, without a position the axis can not be
+// checked so a running motor is stopped once the encoder is unhealthy
+func (ax *Axis) checkEncoderHealth() {
+
+	wd := &ax.watchdog
+
+	if !wd.enabled || wd.fault != FAULT_NONE || ax.enc.IsHealthy() {
+		return
+	}
+
+	wd.expectedSteps = 0
+	wd.measuredSteps = 0
+	ax.raiseFault(FAULT_ENCODER)
+
+}
+
+func (ax *Axis) raiseFault(fault Fault) {
+
+	wd := &ax.watchdog
+
+	fmt.Printf("[raiseFault] %v %v, expected %.0f steps, measured %.0f steps, motor disabled\n",
+		ax.name, fault, wd.expectedSteps, math.Abs(wd.measuredSteps))
+
+	wd.fault = fault
+	wd.faultExpected = wd.expectedSteps
+	wd.faultMeasured = wd.measuredSteps
+
+	ax.slew.abort = ax.slew.active
+	ax.stop()
+	ax.setEnabled(false)
+
+	if wd.faultCh == nil {
+		return
+	}
+
+	select {
+	case wd.faultCh <- fault:
+	default:
+		fmt.Printf("[raiseFault] %v fault channel full, %v not sent\n", ax.name, fault)
+	}
+
+}
@@ -0,0 +1,384 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// AMT22 constants
+const AMT22_NOP byte = 0x00
+const AMT22_RESET byte = 0x60
+const AMT22_ZERO byte = 0x70
+const AMT22_READ_TURNS byte = 0xA0 // Multi-turn parts only
+const RES12 int8 = 12
+const RES14 int8 = 14
+
+// Counts in one turn for each resolution
+const COUNTS_12 uint32 = 4_096
+const COUNTS_14 uint32 = 16_384
+
+// How long the AMT22 takes to start after a reset or zero, see datasheet
+const AMT22_STARTUP = time.Millisecond * 240
+
+// The CUI AMT22 absolute encoder on SPI
+// See this datasheet: https://www.cuidevices.com/product/resource/amt22.pdf
+type AMT22 struct {
+	cs         hal.Pin
+	resolution int8
+	spi        hal.SPI
+
+	// The multi-turn AMT22 counts turns itself, see SetMultiTurn
+	multiTurn bool
+
+	turns turnCounter
+
+	// Read retries and statistics, see stats.go
+	stats ReadStats
+}
+
+// Returns a new AMT22 with its CS pin configured, resolution is RES12 or RES14
+func NewAMT22(spi hal.SPI, cs hal.Pin, resolution int8) (*AMT22, error) {
+
+	if resolution != RES12 && resolution != RES14 {
+		return nil, fmt.Errorf("AMT22 resolution must be %v or %v", RES12, RES14)
+	}
+
+	amt := &AMT22{
+		spi:        spi,
+		cs:         cs,
+		resolution: resolution,
+		turns:      turnCounter{clock: hal.SystemClock{}},
+	}
+
+	//
+	// Channel select for encoder on the SPI bus
+	// initialize high i.e. Not listening
+	//
+	amt.cs.Configure(hal.PinConfig{Mode: hal.PinOutput})
+	amt.cs.High()
+
+	return amt, nil
+}
+
+func (amt *AMT22) GetResolution() int8 {
+	return amt.resolution
+}
+
+// Returns the counts in one turn of the encoder, 4096 for RES12 and 16384 for RES14
+func (amt *AMT22) CountsPerRevolution() uint32 {
+
+	if amt.resolution == RES12 {
+		return COUNTS_12
+	}
+	return COUNTS_14
+}
+
+// Use the turn count kept by a multi-turn AMT22 instead of counting wraps in software
+func (amt *AMT22) SetMultiTurn(multiTurn bool) {
+	amt.multiTurn = multiTurn
+}
+
+func (amt *AMT22) GetMultiTurn() bool {
+	return amt.multiTurn
+}
+
+// Time the reads on another clock, for example a simulated one
+func (amt *AMT22) SetClock(clock hal.Clock) {
+	amt.turns.clock = clock
+}
+
+// Returns the speed in counts per second measured over the last two reads
+func (amt *AMT22) GetVelocity() float64 {
+	return amt.turns.velocity
+}
+
+// Zero the encoder
+func (amt *AMT22) Zero() error {
+
+	fmt.Println("[Zero] - Set AMT22 to position zero!")
+	if _, _, err := amt.WriteRead(AMT22_NOP, AMT22_ZERO); err != nil {
+		return err
+	}
+	amt.turns.zero()
+
+	// allow time to reset
+	amt.turns.clock.Sleep(AMT22_STARTUP)
+
+	p, e := amt.GetPosition()
+	fmt.Printf("[Zero] - Check to see if it works, current position is: %v or error: %v\n", p, e)
+
+	return nil
+}
+
+// Restart the AMT22, it keeps its zero and the turns are still counted
+func (amt *AMT22) Reset() error {
+
+	fmt.Println("[Reset] - Reset AMT22")
+	if _, _, err := amt.WriteRead(AMT22_NOP, AMT22_RESET); err != nil {
+		return err
+	}
+
+	amt.turns.clock.Sleep(AMT22_STARTUP)
+	return nil
+}
+
+// Restore the position after a power cycle
+//
+// The AMT22 keeps its zero through a power cycle but not the rotation count, the rotation count
+// is set so the position is the one closest to the saved position
+//
+// A multi-turn AMT22 keeps its turn count so the position is just read
+func (amt *AMT22) RestorePosition(saved int64) (position int64, err error) {
+
+	if amt.multiTurn {
+		return amt.GetPosition()
+	}
+
+	reading, err := amt.stats.read(amt.readSingleTurn)
+	if err != nil {
+		return 0, err
+	}
+
+	position = amt.turns.restore(uint32(reading), int64(amt.CountsPerRevolution()), saved)
+
+	fmt.Printf("[RestorePosition] - saved position: %v, restored position: %v\n", saved, position)
+	return position, nil
+
+}
+
+// Returns the position in encoder counts from zero, negative when the axis is on the other side of zero
+//
+// A failed read is tried again, see stats.go
+func (amt *AMT22) GetPosition() (position int64, err error) {
+
+	if amt.multiTurn {
+		return amt.stats.read(amt.getMultiTurnPosition)
+	}
+
+	reading, err := amt.stats.read(amt.readSingleTurn)
+	if err != nil {
+		return 0, err
+	}
+
+	return amt.turns.unwrap(uint32(reading), int64(amt.CountsPerRevolution())), nil
+
+}
+
+// Returns the read statistics
+func (amt *AMT22) GetStats() ReadStats {
+	return amt.stats
+}
+
+// Start the read statistics again from zero
+func (amt *AMT22) ResetStats() {
+	amt.stats = ReadStats{}
+}
+
+func (amt *AMT22) IsHealthy() bool {
+	return amt.stats.healthy()
+}
+
+// Returns the position in one turn
+func (amt *AMT22) readSingleTurn() (int64, error) {
+
+	r1, r2, err := amt.WriteRead(AMT22_NOP, AMT22_NOP)
+	if err != nil {
+		return 0, err
+	}
+
+	reading, err := amt.reading(r1, r2)
+	return int64(reading), err
+}
+
+// Read the position and the turn count from a multi-turn AMT22
+//
+//	send:    0x00     0xA0     0x00     0x00
+//	reply:   position (2 bytes) turns (2 bytes)
+//
+// The turns are a 14 bit signed count with the same check bits as the position
+func (amt *AMT22) getMultiTurnPosition() (position int64, err error) {
+
+	reply, err := amt.transfer([]byte{AMT22_NOP, AMT22_READ_TURNS, AMT22_NOP, AMT22_NOP})
+	if err != nil {
+		return 0, err
+	}
+
+	encoderReading, err := amt.reading(reply[0], reply[1])
+	if err != nil {
+		return 0, err
+	}
+
+	response := uint16(reply[2])<<8 | uint16(reply[3])
+	if !parityCheck(response) {
+		return 0, errors.New("Bad parity check on turns")
+	}
+
+	// Sign extend the 14 bit turn count
+	turns := response & 0x3FFF
+	if turns&0x2000 != 0 {
+		turns |= 0xC000
+	}
+	position = int64(encoderReading) + int64(int16(turns))*int64(amt.CountsPerRevolution())
+
+	amt.turns.set(position, amt.turns.clock.Now())
+	return position, nil
+
+}
+
+// Returns the position in one turn from the two reply bytes
+//
+// The reply always carries 14 bits, a 12 bit part leaves the two lowest bits at zero
+func (amt *AMT22) reading(r1 byte, r2 byte) (uint32, error) {
+
+	// Put r1 into the upper 8 bits and r2 into the lower 8 bits
+	response := uint16(r1)<<8 | uint16(r2)
+
+	if !parityCheck(response) {
+		return 0, errors.New("Bad parity check")
+	}
+
+	// Use the lower 14 bits, shifted down for a 12 bit part
+	return uint32(response&0x3FFF) >> (RES14 - amt.resolution), nil
+}
+
+func (amt *AMT22) WriteRead(b1 byte, b2 byte) (r1, r2 byte, err error) {
+
+	reply, err := amt.transfer([]byte{b1, b2})
+	if err != nil {
+		return 0, 0, err
+	}
+	return reply[0], reply[1], nil
+
+}
+
+// Send the bytes with CS held low and return the reply
+//
+// All the bytes are sent even if one fails so the AMT22 always sees a whole command
+func (amt *AMT22) transfer(send []byte) (reply []byte, err error) {
+
+	reply = make([]byte, len(send))
+
+	// Select encoder channel
+	amt.cs.Low()
+	time.Sleep(time.Microsecond * 3) // wait min time see datasheet
+
+	for i, b := range send {
+		r, e := amt.spi.Transfer(b)
+		if e != nil && err == nil {
+			err = busError{e}
+		}
+		reply[i] = r
+		time.Sleep(time.Microsecond * 3) // wait min time see datasheet
+	}
+
+	// de-select encoder channel
+	amt.cs.High()
+
+	return reply, err
+
+}
+
+func parityCheck(n uint16) bool {
+	/*
+		In the case of odd parity, For a given set of bits, if the count of bits with a value of 1 is even,
+		the parity bit value is set to 1 making the total count of 1s in the whole set (including the parity bit) an odd number.
+		If the count of bits with a value of 1 is odd, the count is already odd so the parity bit's value is 0
+
+		The following example taken from the data sheet: https://www.mouser.com/datasheet/2/670/amt22_v-1776172.pdf
+
+		Example:
+		Full response: 0x61AB (as bits 01100001 10101011)
+		14-bit position: 0x21AB (8619 decimal)
+
+		Checkbit Formula:
+			Odd:  K1 = !(H5^H3^H1^L7^L5^L3^L1)
+			Even: K0 = !(H4^H2^H0^L6^L4^L2^L0)
+
+			From the above response 0x61AB:
+			Odd:  0 = !(1^0^0^1^1^1^1) = correct  - There are five 1s, five is odd  thus the parity bit should be 0
+			Even: 1 = !(0^0^1^0^0^0^1) = correct  - There are two  1s, two  is even thus the parity bit should be 1
+
+					 H6
+					 | H5
+					 | | H4
+					 | | | H3
+					 | | | | H2
+					 | | | | | H1
+			  	 | | | | | | H0
+			  	 | | | | | | |
+			0 1  1 0 0 0 0 1 1  0 1 0 1 0 1 1
+			|	|                 | | | | | | |
+			|	K0                | | | | | | L0
+			K1	  							| | | | | L1
+													| | | | L2
+													| | | L3
+													| | L4
+													| L5
+													L6
+
+		If parity is good then use the lower 14 bits for the position,
+	*/
+
+	//
+	// Loop over the lower 14 bits, counting the 1s
+	// Count the number of 1s in odd and even positions
+	//
+	oddCount := 0
+	evenCount := 0
+	var i int8
+
+	for i = 0; i < 14; i++ {
+		if isKthBitSet(n, i) {
+			if i%2 == 0 {
+				evenCount++
+			} else {
+				oddCount++
+			}
+		}
+	}
+
+	//
+	// Are the counts even or odd.
+	// if even the parity bit is expected to be a 1
+	//
+	var isEvenCountEven bool = false
+	if evenCount%2 == 0 {
+		isEvenCountEven = true
+	}
+
+	var isOddCountEven bool = false
+	if oddCount%2 == 0 {
+		isOddCountEven = true
+	}
+
+	//
+	// Get the High and Low parity bits K1 and K0
+	//
+	highParityBitK1 := isKthBitSet(n, 15) // The 16th bit
+	lowParityBitK0 := isKthBitSet(n, 14)  // The 15th bit
+
+	//
+	// If k1 and k0 match what we found then all is good
+	//
+	if isEvenCountEven == lowParityBitK0 && isOddCountEven == highParityBitK1 {
+		return true
+	} else {
+		return false
+	}
+
+}
+
+func isKthBitSet(n uint16, k int8) bool {
+	// k starts at 0
+	flag := n & (1 << k)
+
+	if flag != 0 {
+		return true
+	} else {
+		return false
+	}
+
+}
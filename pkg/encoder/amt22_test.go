@@ -0,0 +1,210 @@
+package encoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// Returns the two AMT22 reply bytes for a 14 bit reading
+func reply(reading uint16) (byte, byte) {
+
+	var odd, even uint16
+	for i := 0; i < 14; i++ {
+		if i%2 == 0 {
+			even ^= (reading >> i) & 1
+		} else {
+			odd ^= (reading >> i) & 1
+		}
+	}
+	response := reading | (odd^1)<<15 | (even^1)<<14
+
+	return byte(response >> 8), byte(response)
+}
+
+// Returns an AMT22 on the fake bus
+func newTestAMT22(t *testing.T, spi *hal.FakeSPI, resolution int8) *AMT22 {
+
+	enc, err := NewAMT22(spi, hal.NewFakePin(), resolution)
+	if err != nil {
+		t.Fatalf("NewAMT22: %v", err)
+	}
+	return enc
+}
+
+func TestParityCheck(t *testing.T) {
+
+	// The datasheet example
+	if !parityCheck(0x61AB) {
+		t.Error("parityCheck(0x61AB) = false, want true")
+	}
+	if parityCheck(0x61AA) {
+		t.Error("parityCheck(0x61AA) = true, want false")
+	}
+
+}
+
+func TestResolution(t *testing.T) {
+
+	tests := []struct {
+		resolution int8
+		counts     uint32
+		position   int64
+	}{
+		// 0x61AB is 8619 at 14 bits, a 12 bit part drops the two lowest bits
+		{RES14, COUNTS_14, 8619},
+		{RES12, COUNTS_12, 8619 >> 2},
+	}
+
+	if _, err := NewAMT22(hal.NewFakeSPI(), hal.NewFakePin(), 13); err == nil {
+		t.Error("NewAMT22 with a resolution of 13 should fail")
+	}
+
+	for _, tt := range tests {
+		spi := hal.NewFakeSPI()
+		enc := newTestAMT22(t, spi, tt.resolution)
+
+		if counts := enc.CountsPerRevolution(); counts != tt.counts {
+			t.Errorf("RES%v: CountsPerRevolution = %v, want %v", tt.resolution, counts, tt.counts)
+		}
+
+		spi.Reply(0x61, 0xAB)
+		position, err := enc.GetPosition()
+		if err != nil {
+			t.Fatalf("RES%v: GetPosition: %v", tt.resolution, err)
+		}
+		if position != tt.position {
+			t.Errorf("RES%v: position %v, want %v", tt.resolution, position, tt.position)
+		}
+	}
+
+}
+
+func TestMultiTurn(t *testing.T) {
+
+	spi := hal.NewFakeSPI()
+	enc := newTestAMT22(t, spi, RES14)
+	enc.SetMultiTurn(true)
+
+	// Position 0x21AB and 2 turns, 0x0002 with its check bits is 0x4002
+	spi.Reply(0x61, 0xAB, 0x40, 0x02)
+	position, err := enc.GetPosition()
+	if err != nil {
+		t.Fatalf("GetPosition: %v", err)
+	}
+	if want := int64(8619 + 2*COUNTS_14); position != want {
+		t.Errorf("position %v, want %v", position, want)
+	}
+
+	if written := spi.GetWritten(); len(written) != 4 || written[1] != AMT22_READ_TURNS {
+		t.Errorf("sent %x, want 00 a0 00 00", written)
+	}
+
+}
+
+func TestNegativePosition(t *testing.T) {
+
+	spi := hal.NewFakeSPI()
+	clock := hal.NewFakeClock(time.Now())
+	enc := newTestAMT22(t, spi, RES14)
+	enc.SetClock(clock)
+
+	// A read a second from 100 counts back through zero into the turn below home
+	for _, want := range []int64{100, -100, -4000, -8000, -12000, -16000, -20000} {
+		reading := uint16(((want % int64(COUNTS_14)) + int64(COUNTS_14)) % int64(COUNTS_14))
+		spi.Reply(reply(reading))
+
+		position, err := enc.GetPosition()
+		if err != nil {
+			t.Fatalf("GetPosition: %v", err)
+		}
+		if position != want {
+			t.Errorf("position %v, want %v", position, want)
+		}
+
+		clock.Advance(time.Second)
+	}
+
+}
+
+func TestFastSlewUnwrap(t *testing.T) {
+
+	spi := hal.NewFakeSPI()
+	clock := hal.NewFakeClock(time.Now())
+	enc := newTestAMT22(t, spi, RES14)
+	enc.SetClock(clock)
+
+	// A read a second, speeding up to 0.6 and then 0.7 turns a second, more than half a turn between reads
+	counts := float64(COUNTS_14)
+	for _, turns := range []float64{0, 0.3, 0.6, 1.2, 1.9, 2.6} {
+		want := int64(turns * counts)
+		spi.Reply(reply(uint16(want % int64(COUNTS_14))))
+
+		position, err := enc.GetPosition()
+		if err != nil {
+			t.Fatalf("GetPosition: %v", err)
+		}
+		if position != want {
+			t.Errorf("%v turns: position %v, want %v", turns, position, want)
+		}
+
+		clock.Advance(time.Second)
+	}
+
+}
+
+func TestReadRetries(t *testing.T) {
+
+	spi := hal.NewFakeSPI()
+	enc := newTestAMT22(t, spi, RES14)
+
+	// One bad reply then a good one, the read is tried again
+	r1, r2 := reply(1234)
+	spi.Reply(r1^0x01, r2, r1, r2)
+
+	position, err := enc.GetPosition()
+	if err != nil || position != 1234 {
+		t.Fatalf("GetPosition = %v, %v, want 1234, nil", position, err)
+	}
+
+	// A failed transfer is tried again as well
+	spi.Fail(1)
+	spi.Reply(0, r1, r2)
+	if _, err := enc.GetPosition(); err != nil {
+		t.Fatalf("GetPosition after a failed transfer: %v", err)
+	}
+
+	stats := enc.GetStats()
+	if stats.Reads != 2 || stats.ParityFailures != 1 || stats.BusFailures != 1 || stats.Retries != 2 || stats.FailedReads != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Replies of 0 fail every try
+	for i := 0; i < ENCODER_UNHEALTHY_FAILURES; i++ {
+		if !enc.IsHealthy() {
+			t.Fatalf("unhealthy after %v failed reads", i)
+		}
+		if _, err := enc.GetPosition(); err == nil {
+			t.Fatal("a reply of 0 should fail the check bits")
+		}
+	}
+	if enc.IsHealthy() {
+		t.Errorf("healthy after %v failed reads", ENCODER_UNHEALTHY_FAILURES)
+	}
+
+	stats = enc.GetStats()
+	if stats.FailedReads != ENCODER_UNHEALTHY_FAILURES || stats.MaxConsecutiveFailures != ENCODER_UNHEALTHY_FAILURES {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.Retries != 2+ENCODER_UNHEALTHY_FAILURES*ENCODER_READ_RETRIES {
+		t.Errorf("Retries = %v, want %v", stats.Retries, 2+ENCODER_UNHEALTHY_FAILURES*ENCODER_READ_RETRIES)
+	}
+
+	// A good read makes it healthy again
+	spi.Reply(r1, r2)
+	if _, err := enc.GetPosition(); err != nil || !enc.IsHealthy() {
+		t.Errorf("after a good read: err %v, healthy %v", err, enc.IsHealthy())
+	}
+
+}
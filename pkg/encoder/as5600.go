@@ -0,0 +1,181 @@
+package encoder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// AS5600 constants
+const AS5600_ADDRESS uint16 = 0x36
+const AS5600_STATUS byte = 0x0B
+const AS5600_RAW_ANGLE byte = 0x0C // 12 bits, the upper 4 bits in the first byte
+const AS5600_STATUS_MD byte = 0x20 // Magnet detected
+const AS5600_STATUS_ML byte = 0x10 // Magnet too weak
+const AS5600_STATUS_MH byte = 0x08 // Magnet too strong
+const AS5600_COUNTS uint32 = 4_096
+
+// The ams AS5600 magnetic encoder on I2C
+// See this datasheet: https://ams.com/documents/20143/36005/AS5600_DS000365_5-00.pdf
+//
+// The AS5600 only reads the angle in one turn, the turns are counted in software like the
+// single turn AMT22. The zero is kept in software and is lost on a power cycle, save it with
+// GetZeroOffset and put it back with SetZeroOffset before restoring the position. The driver
+// does this with the park state.
+type AS5600 struct {
+	i2c     hal.I2C
+	address uint16
+
+	// The raw angle at position zero
+	zeroOffset uint16
+
+	turns turnCounter
+
+	// Read retries and statistics, see stats.go
+	stats ReadStats
+}
+
+// Returns a new AS5600 at AS5600_ADDRESS, an error if there is no magnet
+func NewAS5600(i2c hal.I2C) (*AS5600, error) {
+
+	as := &AS5600{
+		i2c:     i2c,
+		address: AS5600_ADDRESS,
+		turns:   turnCounter{clock: hal.SystemClock{}},
+	}
+
+	if err := as.Reset(); err != nil {
+		return nil, err
+	}
+
+	return as, nil
+}
+
+// Returns 4096, the AS5600 is 12 bits
+func (as *AS5600) CountsPerRevolution() uint32 {
+	return AS5600_COUNTS
+}
+
+// Time the reads on another clock, for example a simulated one
+func (as *AS5600) SetClock(clock hal.Clock) {
+	as.turns.clock = clock
+}
+
+// The current angle becomes position zero
+func (as *AS5600) Zero() error {
+
+	raw, err := as.stats.read(as.readRawAngle)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[Zero] - Set AS5600 to position zero, raw angle: %v\n", raw)
+	as.zeroOffset = uint16(raw)
+	as.turns.zero()
+
+	return nil
+}
+
+// Returns the raw angle at position zero
+func (as *AS5600) GetZeroOffset() uint16 {
+	return as.zeroOffset
+}
+
+// Put back a zero saved with GetZeroOffset
+func (as *AS5600) SetZeroOffset(offset uint16) {
+	as.zeroOffset = offset % uint16(AS5600_COUNTS)
+}
+
+// The AS5600 has no reset command, check the magnet is there and report how it is
+func (as *AS5600) Reset() error {
+
+	status := make([]byte, 1)
+	if err := as.i2c.Tx(as.address, []byte{AS5600_STATUS}, status); err != nil {
+		return err
+	}
+
+	if status[0]&AS5600_STATUS_MD == 0 {
+		return errors.New("AS5600 magnet not detected")
+	}
+	if status[0]&AS5600_STATUS_ML != 0 {
+		fmt.Println("[Reset] - AS5600 magnet too weak")
+	}
+	if status[0]&AS5600_STATUS_MH != 0 {
+		fmt.Println("[Reset] - AS5600 magnet too strong")
+	}
+
+	return nil
+}
+
+// Restore the position after a power cycle, the turn is the one that puts the position
+// closest to the saved position
+func (as *AS5600) RestorePosition(saved int64) (position int64, err error) {
+
+	reading, err := as.stats.read(as.readAngle)
+	if err != nil {
+		return 0, err
+	}
+
+	position = as.turns.restore(uint32(reading), int64(AS5600_COUNTS), saved)
+
+	fmt.Printf("[RestorePosition] - saved position: %v, restored position: %v\n", saved, position)
+	return position, nil
+}
+
+// Returns the position in counts from zero, negative on the other side of zero
+//
+// A failed read is tried again, see stats.go
+func (as *AS5600) GetPosition() (position int64, err error) {
+
+	reading, err := as.stats.read(as.readAngle)
+	if err != nil {
+		return 0, err
+	}
+
+	return as.turns.unwrap(uint32(reading), int64(AS5600_COUNTS)), nil
+}
+
+// Returns the read statistics
+func (as *AS5600) GetStats() ReadStats {
+	return as.stats
+}
+
+// Start the read statistics again from zero
+func (as *AS5600) ResetStats() {
+	as.stats = ReadStats{}
+}
+
+func (as *AS5600) IsHealthy() bool {
+	return as.stats.healthy()
+}
+
+// Returns the angle in one turn from zero
+func (as *AS5600) readAngle() (int64, error) {
+
+	raw, err := as.readRawAngle()
+	if err != nil {
+		return 0, err
+	}
+
+	counts := int64(AS5600_COUNTS)
+	return (raw - int64(as.zeroOffset) + counts) % counts, nil
+}
+
+// Returns the raw angle, the status is read with it so a missing magnet fails the read
+//
+//	send:    0x0B
+//	reply:   status, raw angle (2 bytes)
+func (as *AS5600) readRawAngle() (int64, error) {
+
+	reply := make([]byte, 3)
+	if err := as.i2c.Tx(as.address, []byte{AS5600_STATUS}, reply); err != nil {
+		return 0, busError{err}
+	}
+
+	if reply[0]&AS5600_STATUS_MD == 0 {
+		return 0, errors.New("AS5600 magnet not detected")
+	}
+
+	return int64(uint16(reply[1]&0x0F)<<8 | uint16(reply[2])), nil
+}
@@ -0,0 +1,94 @@
+package encoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// Set the status and raw angle registers of a fake AS5600
+func setAS5600(i2c *hal.FakeI2C, status byte, raw uint16) {
+
+	i2c.SetRegister(AS5600_ADDRESS, AS5600_STATUS, status)
+	i2c.SetRegister(AS5600_ADDRESS, AS5600_RAW_ANGLE, byte(raw>>8))
+	i2c.SetRegister(AS5600_ADDRESS, AS5600_RAW_ANGLE+1, byte(raw))
+
+}
+
+func TestAS5600NoMagnet(t *testing.T) {
+
+	i2c := hal.NewFakeI2C()
+	setAS5600(i2c, 0, 0)
+
+	if _, err := NewAS5600(i2c); err == nil {
+		t.Error("NewAS5600 without a magnet should fail")
+	}
+
+}
+
+func TestAS5600Position(t *testing.T) {
+
+	i2c := hal.NewFakeI2C()
+	setAS5600(i2c, AS5600_STATUS_MD, 1000)
+	clock := hal.NewFakeClock(time.Now())
+
+	enc, err := NewAS5600(i2c)
+	if err != nil {
+		t.Fatalf("NewAS5600: %v", err)
+	}
+	enc.SetClock(clock)
+
+	if err := enc.Zero(); err != nil {
+		t.Fatalf("Zero: %v", err)
+	}
+
+	// A read a second from zero back into the turn below, slowing to turn round and forward into the turn above
+	counts := int64(AS5600_COUNTS)
+	for _, want := range []int64{0, -500, -1500, -2500, -3500, -4500, -4800, -4600, -3800, -2000, 0, 2000, 4200} {
+		raw := uint16((1000 + want%counts + 2*counts) % counts)
+		setAS5600(i2c, AS5600_STATUS_MD, raw)
+
+		position, err := enc.GetPosition()
+		if err != nil {
+			t.Fatalf("GetPosition: %v", err)
+		}
+		if position != want {
+			t.Errorf("position %v, want %v", position, want)
+		}
+
+		clock.Advance(time.Second)
+	}
+
+	// Losing the magnet fails the read
+	setAS5600(i2c, 0, 0)
+	if _, err := enc.GetPosition(); err == nil {
+		t.Error("a read without a magnet should fail")
+	}
+	if stats := enc.GetStats(); stats.FailedReads != 1 || stats.ParityFailures != 1+ENCODER_READ_RETRIES {
+		t.Errorf("stats = %+v", stats)
+	}
+
+}
+
+func TestAS5600RestorePosition(t *testing.T) {
+
+	i2c := hal.NewFakeI2C()
+	setAS5600(i2c, AS5600_STATUS_MD, 300)
+
+	enc, err := NewAS5600(i2c)
+	if err != nil {
+		t.Fatalf("NewAS5600: %v", err)
+	}
+
+	// After a power cycle the saved zero is put back and the turn is the one nearest the saved position
+	enc.SetZeroOffset(100)
+	position, err := enc.RestorePosition(3*int64(AS5600_COUNTS) + 150)
+	if err != nil {
+		t.Fatalf("RestorePosition: %v", err)
+	}
+	if want := 3*int64(AS5600_COUNTS) + 200; position != want {
+		t.Errorf("position %v, want %v", position, want)
+	}
+
+}
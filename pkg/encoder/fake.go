@@ -0,0 +1,79 @@
+//go:build !tinygo
+
+package encoder
+
+import (
+	"errors"
+)
+
+// An encoder for tests, the position is set directly and reads can be made to fail
+type FakeEncoder struct {
+	position int64
+	counts   uint32
+	fails    int
+	resets   int
+
+	stats ReadStats
+}
+
+var _ Encoder = (*FakeEncoder)(nil)
+
+// Returns a fake with counts in one turn
+func NewFakeEncoder(counts uint32) *FakeEncoder {
+	return &FakeEncoder{counts: counts}
+}
+
+// Set the position the next reads return
+func (f *FakeEncoder) SetPosition(position int64) {
+	f.position = position
+}
+
+// Fail the next n tries, a read is tried ENCODER_READ_RETRIES more times before it fails
+func (f *FakeEncoder) Fail(n int) {
+	f.fails = n
+}
+
+// Returns how many times Reset was called
+func (f *FakeEncoder) GetResets() int {
+	return f.resets
+}
+
+func (f *FakeEncoder) GetPosition() (int64, error) {
+	return f.stats.read(f.read)
+}
+
+func (f *FakeEncoder) Zero() error {
+	f.position = 0
+	return nil
+}
+
+func (f *FakeEncoder) Reset() error {
+	f.resets++
+	return nil
+}
+
+// The fake keeps its position, so the saved position is not needed
+func (f *FakeEncoder) RestorePosition(saved int64) (int64, error) {
+	return f.GetPosition()
+}
+
+func (f *FakeEncoder) CountsPerRevolution() uint32 {
+	return f.counts
+}
+
+func (f *FakeEncoder) IsHealthy() bool {
+	return f.stats.healthy()
+}
+
+func (f *FakeEncoder) GetStats() ReadStats {
+	return f.stats
+}
+
+func (f *FakeEncoder) read() (int64, error) {
+
+	if f.fails > 0 {
+		f.fails--
+		return 0, errors.New("fake encoder read failed")
+	}
+	return f.position, nil
+}
@@ -0,0 +1,83 @@
+package encoder
+
+import (
+	"fmt"
+)
+
+// Read retries and statistics
+//
+// A read that fails the check bits or the bus transfer is tried again up to ENCODER_READ_RETRIES
+// times. A read that still fails counts as a failed read, after ENCODER_UNHEALTHY_FAILURES failed
+// reads in a row the encoder is unhealthy until the next good read.
+const (
+	ENCODER_READ_RETRIES       = 3
+	ENCODER_UNHEALTHY_FAILURES = 5
+)
+
+// Counts kept over all reads since the last ResetStats
+type ReadStats struct {
+	Reads                  uint32 // Reads asked for, retries are not counted
+	ParityFailures         uint32 // Bad replies, the AMT22 check bits or no AS5600 magnet, including retries
+	BusFailures            uint32 // SPI or I2C transfers that returned an error, including retries
+	Retries                uint32 // Reads tried again
+	FailedReads            uint32 // Reads that failed every try
+	ConsecutiveFailures    uint32 // Failed reads since the last good read
+	MaxConsecutiveFailures uint32
+}
+
+// Returns the stats as a short comma separated list
+//
+//	reads,parity failures,bus failures,retries,failed reads,max consecutive failures
+func (stats ReadStats) String() string {
+	return fmt.Sprintf("%v,%v,%v,%v,%v,%v", stats.Reads, stats.ParityFailures, stats.BusFailures, stats.Retries, stats.FailedReads, stats.MaxConsecutiveFailures)
+}
+
+// Returns false after ENCODER_UNHEALTHY_FAILURES failed reads in a row
+func (stats ReadStats) healthy() bool {
+	return stats.ConsecutiveFailures < ENCODER_UNHEALTHY_FAILURES
+}
+
+// Run read, trying again when it fails, and keep the statistics
+func (stats *ReadStats) read(read func() (int64, error)) (position int64, err error) {
+
+	stats.Reads++
+
+	for try := 0; try <= ENCODER_READ_RETRIES; try++ {
+		if try > 0 {
+			stats.Retries++
+		}
+
+		position, err = read()
+		if err == nil {
+			stats.ConsecutiveFailures = 0
+			return position, nil
+		}
+
+		if _, ok := err.(busError); ok {
+			stats.BusFailures++
+		} else {
+			stats.ParityFailures++
+		}
+	}
+
+	stats.FailedReads++
+	stats.ConsecutiveFailures++
+	if stats.ConsecutiveFailures > stats.MaxConsecutiveFailures {
+		stats.MaxConsecutiveFailures = stats.ConsecutiveFailures
+	}
+
+	if stats.ConsecutiveFailures == ENCODER_UNHEALTHY_FAILURES {
+		fmt.Printf("[read] - encoder unhealthy after %v failed reads, last error: %v\n", stats.ConsecutiveFailures, err)
+	}
+
+	return 0, err
+}
+
+// An error from the bus rather than a bad reply
+type busError struct {
+	err error
+}
+
+func (e busError) Error() string {
+	return "bus transfer: " + e.err.Error()
+}
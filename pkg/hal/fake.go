@@ -0,0 +1,338 @@
+//go:build !tinygo
+
+package hal
+
+import (
+	"errors"
+	"time"
+)
+
+// Host fakes, they keep the state the hardware would have so tests can check it
+
+// A pin that remembers its mode and level
+type FakePin struct {
+	mode  PinMode
+	value bool
+
+	// The number of times the level was set
+	writes int
+}
+
+func NewFakePin() *FakePin {
+	return &FakePin{mode: PinInput}
+}
+
+func (p *FakePin) Configure(config PinConfig) {
+
+	p.mode = config.Mode
+
+	// A pulled up input reads high until something pulls it low
+	if config.Mode == PinInputPullup {
+		p.value = true
+	}
+
+}
+
+func (p *FakePin) High() {
+	p.Set(true)
+}
+
+func (p *FakePin) Low() {
+	p.Set(false)
+}
+
+func (p *FakePin) Set(value bool) {
+	p.value = value
+	p.writes++
+}
+
+func (p *FakePin) Get() bool {
+	return p.value
+}
+
+func (p *FakePin) GetMode() PinMode {
+	return p.mode
+}
+
+// Returns the number of times the level was set
+func (p *FakePin) GetWrites() int {
+	return p.writes
+}
+
+// An SPI bus that replies with queued bytes and records what was written
+type FakeSPI struct {
+	replies []byte
+	written []byte
+	fails   int
+}
+
+func NewFakeSPI() *FakeSPI {
+	return &FakeSPI{}
+}
+
+// Queue bytes to be returned by the next transfers, 0 is returned once the queue is empty
+func (s *FakeSPI) Reply(b ...byte) {
+	s.replies = append(s.replies, b...)
+}
+
+func (s *FakeSPI) Transfer(w byte) (byte, error) {
+
+	s.written = append(s.written, w)
+
+	if s.fails > 0 {
+		s.fails--
+		return 0, errors.New("fake SPI transfer failed")
+	}
+
+	if len(s.replies) == 0 {
+		return 0, nil
+	}
+	r := s.replies[0]
+	s.replies = s.replies[1:]
+
+	return r, nil
+}
+
+// Returns every byte written
+// Fail the next n transfers
+func (s *FakeSPI) Fail(n int) {
+	s.fails = n
+}
+
+func (s *FakeSPI) GetWritten() []byte {
+	return s.written
+}
+
+// An I2C bus of register devices, the first byte written is the register, the rest are
+// written from there and reads carry on from there
+type FakeI2C struct {
+	registers map[uint16]map[byte]byte
+	fails     int
+}
+
+func NewFakeI2C() *FakeI2C {
+	return &FakeI2C{registers: map[uint16]map[byte]byte{}}
+}
+
+// Set a register of the device at addr
+func (b *FakeI2C) SetRegister(addr uint16, register byte, value byte) {
+
+	if b.registers[addr] == nil {
+		b.registers[addr] = map[byte]byte{}
+	}
+	b.registers[addr][register] = value
+
+}
+
+func (b *FakeI2C) GetRegister(addr uint16, register byte) byte {
+	return b.registers[addr][register]
+}
+
+// Fail the next n transactions
+func (b *FakeI2C) Fail(n int) {
+	b.fails = n
+}
+
+func (b *FakeI2C) Tx(addr uint16, w, r []byte) error {
+
+	if b.fails > 0 {
+		b.fails--
+		return errors.New("fake I2C transaction failed")
+	}
+
+	device, ok := b.registers[addr]
+	if !ok {
+		return errors.New("fake I2C no device at address")
+	}
+	if len(w) == 0 {
+		return nil
+	}
+
+	register := w[0]
+	for _, v := range w[1:] {
+		device[register] = v
+		register++
+	}
+	for i := range r {
+		r[i] = device[register]
+		register++
+	}
+
+	return nil
+}
+
+// The RP2040 PWM counts to Top at 125 MHz, the fake works out Top the same way
+const FAKE_PWM_CLOCK_HZ = 125_000_000
+
+// A PWM that remembers its period and channel levels
+type FakePWM struct {
+	period   uint64
+	top      uint32
+	channels map[uint8]uint32
+	pins     []Pin
+}
+
+func NewFakePWM() *FakePWM {
+	return &FakePWM{channels: map[uint8]uint32{}}
+}
+
+func (p *FakePWM) Configure(config PWMConfig) error {
+	return p.SetPeriod(config.Period)
+}
+
+// Pins get channels in the order they are asked for
+func (p *FakePWM) Channel(pin Pin) (channel uint8, err error) {
+
+	for i, known := range p.pins {
+		if known == pin {
+			return uint8(i), nil
+		}
+	}
+	p.pins = append(p.pins, pin)
+
+	return uint8(len(p.pins) - 1), nil
+}
+
+func (p *FakePWM) Top() uint32 {
+	return p.top
+}
+
+func (p *FakePWM) Set(channel uint8, value uint32) {
+	p.channels[channel] = value
+}
+
+func (p *FakePWM) SetPeriod(period uint64) error {
+
+	p.period = period
+	p.top = 0xFFFF
+	if period > 0 {
+		top := period * FAKE_PWM_CLOCK_HZ / 1e9
+		if top < 0xFFFF {
+			p.top = uint32(top)
+		}
+	}
+
+	return nil
+}
+
+// Returns the period in nanoseconds
+func (p *FakePWM) GetPeriod() uint64 {
+	return p.period
+}
+
+// Returns the level of the channel
+func (p *FakePWM) Get(channel uint8) uint32 {
+	return p.channels[channel]
+}
+
+// Returns the pulse rate in Hz, 0 if the channel is off
+func (p *FakePWM) GetHz(channel uint8) float64 {
+
+	if p.period == 0 || p.channels[channel] == 0 {
+		return 0
+	}
+	return 1e9 / float64(p.period)
+}
+
+// An ADC that returns Value
+type FakeADC struct {
+	Value uint16
+}
+
+func (a *FakeADC) Get() uint16 {
+	return a.Value
+}
+
+// The die temperature the fake returns in milli °C
+var FakeTemperature int32 = 25_000
+
+// Returns FakeTemperature
+func ReadTemperature() int32 {
+	return FakeTemperature
+}
+
+// A clock that only moves when it is told to, or when something sleeps on it
+type FakeClock struct {
+	now time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	return c.now
+}
+
+// Sleep returns right away with the clock moved on by d
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// Flash in memory, erased bytes read 0xFF and writes must be whole write blocks like the RP2040
+type FakeFlash struct {
+	data           []byte
+	writeBlockSize int64
+	eraseBlockSize int64
+}
+
+func NewFakeFlash(size int64, writeBlockSize int64, eraseBlockSize int64) *FakeFlash {
+
+	f := &FakeFlash{
+		data:           make([]byte, size),
+		writeBlockSize: writeBlockSize,
+		eraseBlockSize: eraseBlockSize,
+	}
+	for i := range f.data {
+		f.data[i] = 0xFF
+	}
+	return f
+}
+
+func (f *FakeFlash) ReadAt(p []byte, off int64) (n int, err error) {
+
+	if off < 0 || off+int64(len(p)) > int64(len(f.data)) {
+		return 0, errors.New("fake flash read out of range")
+	}
+	return copy(p, f.data[off:]), nil
+}
+
+func (f *FakeFlash) WriteAt(p []byte, off int64) (n int, err error) {
+
+	if off%f.writeBlockSize != 0 || int64(len(p))%f.writeBlockSize != 0 {
+		return 0, errors.New("fake flash write is not whole write blocks")
+	}
+	if off < 0 || off+int64(len(p)) > int64(len(f.data)) {
+		return 0, errors.New("fake flash write out of range")
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *FakeFlash) Size() int64 {
+	return int64(len(f.data))
+}
+
+func (f *FakeFlash) WriteBlockSize() int64 {
+	return f.writeBlockSize
+}
+
+func (f *FakeFlash) EraseBlockSize() int64 {
+	return f.eraseBlockSize
+}
+
+func (f *FakeFlash) EraseBlocks(start, length int64) error {
+
+	from := start * f.eraseBlockSize
+	to := from + length*f.eraseBlockSize
+	if from < 0 || to > int64(len(f.data)) {
+		return errors.New("fake flash erase out of range")
+	}
+	for i := from; i < to; i++ {
+		f.data[i] = 0xFF
+	}
+	return nil
+}
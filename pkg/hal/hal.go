@@ -0,0 +1,80 @@
+// This package is the hardware the mount uses, pins, the SPI and I2C buses, the PWM and the ADC
+//
+// The driver and encoder packages only see these interfaces so the mount logic builds and
+// tests on the host. With TinyGo the real implementations wrap the machine package, see
+// machine.go, on the host the fakes in fake.go record what was done to them.
+// The names follow the machine package.
+package hal
+
+import (
+	"time"
+)
+
+type PinMode uint8
+
+const (
+	PinOutput PinMode = iota
+	PinInput
+	PinInputPullup
+)
+
+type PinConfig struct {
+	Mode PinMode
+}
+
+// A GPIO pin
+type Pin interface {
+	Configure(config PinConfig)
+	High()
+	Low()
+	Set(value bool)
+	Get() bool
+}
+
+// An SPI bus, *machine.SPI satisfies it
+type SPI interface {
+	Transfer(w byte) (byte, error)
+}
+
+// An I2C bus, *machine.I2C satisfies it
+//
+// Tx writes w to the device at addr then reads len(r) bytes into r
+type I2C interface {
+	Tx(addr uint16, w, r []byte) error
+}
+
+type PWMConfig struct {
+	// The period in nanoseconds, 0 for the default
+	Period uint64
+}
+
+// A hardware PWM slice, the step pin is driven by one of its channels
+type PWM interface {
+	Configure(config PWMConfig) error
+	Channel(pin Pin) (channel uint8, err error)
+	Top() uint32
+	Set(channel uint8, value uint32)
+	SetPeriod(period uint64) error
+}
+
+// An ADC input, the reading is scaled to 16 bits, machine.ADC satisfies it
+type ADC interface {
+	Get() uint16
+}
+
+// The time the driver runs on, the simulator runs it faster than real time
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// The wall clock
+type SystemClock struct{}
+
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
@@ -0,0 +1,107 @@
+//go:build tinygo
+
+package hal
+
+import (
+	"errors"
+	"machine"
+)
+
+// A machine.Pin as a Pin
+type MachinePin machine.Pin
+
+// Returns the machine pin as a Pin
+func NewPin(pin machine.Pin) MachinePin {
+	return MachinePin(pin)
+}
+
+func (p MachinePin) Configure(config PinConfig) {
+
+	var mode machine.PinMode
+	switch config.Mode {
+	case PinInput:
+		mode = machine.PinInput
+	case PinInputPullup:
+		mode = machine.PinInputPullup
+	default:
+		mode = machine.PinOutput
+	}
+
+	machine.Pin(p).Configure(machine.PinConfig{Mode: mode})
+
+}
+
+func (p MachinePin) High() {
+	machine.Pin(p).High()
+}
+
+func (p MachinePin) Low() {
+	machine.Pin(p).Low()
+}
+
+func (p MachinePin) Set(value bool) {
+	machine.Pin(p).Set(value)
+}
+
+func (p MachinePin) Get() bool {
+	return machine.Pin(p).Get()
+}
+
+// The methods of a machine PWM slice such as machine.PWM4
+type machinePWM interface {
+	Configure(config machine.PWMConfig) error
+	Channel(pin machine.Pin) (channel uint8, err error)
+	Top() uint32
+	Set(channel uint8, value uint32)
+	SetPeriod(period uint64) error
+}
+
+// A machine PWM slice as a PWM
+type MachinePWM struct {
+	pwm machinePWM
+}
+
+// Returns the machine PWM slice as a PWM, for example NewPWM(machine.PWM4)
+func NewPWM(pwm machinePWM) MachinePWM {
+	return MachinePWM{pwm: pwm}
+}
+
+func (p MachinePWM) Configure(config PWMConfig) error {
+	return p.pwm.Configure(machine.PWMConfig{Period: config.Period})
+}
+
+// The pin must be a MachinePin
+func (p MachinePWM) Channel(pin Pin) (channel uint8, err error) {
+
+	machinePin, ok := pin.(MachinePin)
+	if !ok {
+		return 0, errors.New("the PWM needs a MachinePin")
+	}
+	return p.pwm.Channel(machine.Pin(machinePin))
+}
+
+func (p MachinePWM) Top() uint32 {
+	return p.pwm.Top()
+}
+
+func (p MachinePWM) Set(channel uint8, value uint32) {
+	p.pwm.Set(channel, value)
+}
+
+func (p MachinePWM) SetPeriod(period uint64) error {
+	return p.pwm.SetPeriod(period)
+}
+
+// Returns a configured ADC on the pin, call machine.InitADC first
+func NewADC(pin machine.Pin) machine.ADC {
+
+	adc := machine.ADC{Pin: pin}
+	adc.Configure(machine.ADCConfig{})
+
+	return adc
+}
+
+// Returns the RP2040 die temperature in milli °C
+func ReadTemperature() int32 {
+	return machine.ReadTemperature()
+}
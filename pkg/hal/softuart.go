@@ -0,0 +1,139 @@
+package hal
+
+import (
+	"errors"
+	"time"
+)
+
+// Soft UART timing
+const (
+	// The reply must start within this many bit times of the last byte sent, the TMC2208 waits 8
+	SOFT_UART_REPLY_BITS = 64
+
+	// The reply is over once the line has been idle for this many bit times
+	SOFT_UART_IDLE_BITS = 16
+)
+
+// A half duplex UART on one pin, bit-banged, 8 data bits, no parity and one stop bit
+//
+// Used for the TMC2208 PDN_UART pin when both hardware UARTs carry the bus. The pin idles high.
+// Write sends the bytes then listens for a reply until the line stays idle, so the reply is in the
+// receive buffer when Write returns. The bytes written are put in the receive buffer first, the
+// same echo a hardware UART sees on a single wire.
+type SoftUART struct {
+	pin Pin
+	bit time.Duration
+	rx  []byte
+}
+
+// Returns a new SoftUART, slow rates leave more room for the timing to be off, 19200 suits the TMC2208
+func NewSoftUART(pin Pin, baudRate uint32) (*SoftUART, error) {
+
+	if pin == nil {
+		return nil, errors.New("pin must not be nil")
+	}
+	if baudRate == 0 || baudRate > 115_200 {
+		return nil, errors.New("baudRate must be greater than 0 and at most 115200")
+	}
+
+	return &SoftUART{
+		pin: pin,
+		bit: time.Second / time.Duration(baudRate),
+	}, nil
+}
+
+// Let the line idle high
+func (u *SoftUART) Configure() {
+	u.pin.Configure(PinConfig{Mode: PinInputPullup})
+}
+
+// Returns the number of bytes in the receive buffer
+func (u *SoftUART) Buffered() int {
+	return len(u.rx)
+}
+
+func (u *SoftUART) ReadByte() (byte, error) {
+
+	if len(u.rx) == 0 {
+		return 0, errors.New("soft UART receive buffer is empty")
+	}
+	b := u.rx[0]
+	u.rx = u.rx[1:]
+
+	return b, nil
+}
+
+// Send the bytes, then receive the reply into the receive buffer
+func (u *SoftUART) Write(data []byte) (n int, err error) {
+
+	u.pin.Configure(PinConfig{Mode: PinOutput})
+	u.pin.High()
+
+	for _, b := range data {
+		u.writeByte(b)
+	}
+	u.rx = append(u.rx, data...)
+
+	u.pin.Configure(PinConfig{Mode: PinInputPullup})
+
+	wait := SOFT_UART_REPLY_BITS * u.bit
+	for {
+		b, ok := u.readByte(wait)
+		if !ok {
+			break
+		}
+		u.rx = append(u.rx, b)
+		wait = SOFT_UART_IDLE_BITS * u.bit
+	}
+
+	return len(data), nil
+}
+
+// Start bit low, the data bits LSB first, stop bit high, each bit is timed from the start bit
+func (u *SoftUART) writeByte(b byte) {
+
+	start := time.Now()
+
+	u.pin.Low()
+	u.waitUntil(start.Add(u.bit))
+
+	for i := 0; i < 8; i++ {
+		u.pin.Set(b&(1<<i) != 0)
+		u.waitUntil(start.Add(time.Duration(i+2) * u.bit))
+	}
+
+	u.pin.High()
+	u.waitUntil(start.Add(10 * u.bit))
+
+}
+
+// Wait up to timeout for a start bit then read the byte, each bit is sampled in its middle
+func (u *SoftUART) readByte(timeout time.Duration) (byte, bool) {
+
+	deadline := time.Now().Add(timeout)
+	for u.pin.Get() {
+		if time.Now().After(deadline) {
+			return 0, false
+		}
+	}
+	start := time.Now()
+
+	var b byte
+	for i := 0; i < 8; i++ {
+		u.waitUntil(start.Add(u.bit*time.Duration(i+1) + u.bit/2))
+		if u.pin.Get() {
+			b |= 1 << i
+		}
+	}
+
+	// Into the stop bit so its high level is not taken for the next start bit
+	u.waitUntil(start.Add(9*u.bit + u.bit/2))
+
+	return b, true
+}
+
+// Busy wait, a sleep can wake too late for the next bit
+func (u *SoftUART) waitUntil(t time.Time) {
+	for time.Now().Before(t) {
+	}
+}
@@ -1,9 +1,11 @@
 package hid
 
 import (
+	"errors"
 	"fmt"
 	"image/color"
 	"machine"
+	"math"
 	"strconv"
 	"time"
 
@@ -37,6 +39,7 @@ const (
 	UTILITY_MENU
 	SET_RA_TRACKING
 	SET_RA_DIRECTION
+	SET_RA_TRACKING_RATE
 	OBJECTS_MENU
 	LAST
 	SET_DATE_Error
@@ -79,6 +82,7 @@ const (
 type Handset struct {
 	Screen       *Screen
 	msgBroker    *msg.MsgBroker
+	cmdResultCh  chan CmdResult
 	isSetup      bool
 	state        State
 	scrollDnKey  machine.Pin
@@ -152,9 +156,34 @@ type Screen struct {
 	fontColor     color.RGBA
 	BodyText      string
 	// RA Data
-	Tracking  driver.RaValue
-	Direction driver.RaValue
-	Position  uint32
+	Tracking     driver.RaValue
+	Direction    driver.RaValue
+	Position     int64
+	TrackingRate driver.TrackingRate
+	// The last alarm raised by a driver, for example "RA LimitMax", empty if none
+	Alarm string
+	// The RA watchdog fault, for example "Stall", empty if none
+	Fault driver.Fault
+	// The RA stepper driver temperature in °C, NaN if unknown
+	Temperature float64
+	// The last command a driver did not acknowledge, for example "Track NoAck", empty if none
+	CmdFailure string
+}
+
+// The outcome of a command sent to a driver, Err is nil when the driver acknowledged it
+type CmdResult struct {
+	Name string
+	Err  error
+}
+
+// Returns a short reason the command failed for the screen, for example "Track BadArgs"
+func (r CmdResult) Failure() string {
+
+	var cmdErr *msg.CmdError
+	if errors.As(r.Err, &cmdErr) {
+		return r.Name + " " + cmdErr.Code.String()
+	}
+	return r.Name + " NoAck"
 }
 
 // Returns a new Handset
@@ -197,6 +226,7 @@ func NewHandset(
 	screen.ConfigureGrid(displayRows, displayCols)
 	screen.font = font
 	screen.fontColor = fontColor
+	screen.Temperature = math.NaN()
 
 	return Handset{
 		Screen:               &screen,
@@ -415,6 +445,25 @@ func (hs *Handset) GetKeyFromString(s string) Key {
 	}
 }
 
+func (hs *Handset) SetCmdResultCh(ch chan CmdResult) {
+	hs.cmdResultCh = ch
+}
+
+// Send a command in the background, waiting for the driver to acknowledge it does not hold up the keys
+func (hs *Handset) request(name string, send func() error) {
+
+	go func() {
+		err := send()
+		if err != nil {
+			fmt.Printf("[request] - %v: %v\n", name, err)
+		}
+		if hs.cmdResultCh != nil {
+			hs.cmdResultCh <- CmdResult{Name: name, Err: err}
+		}
+	}()
+
+}
+
 func (hs *Handset) StateMachine(key Key) string {
 
 	switch hs.state {
@@ -442,10 +491,10 @@ func (hs *Handset) StateMachine(key Key) string {
 
 		if !doNav(key, &hs.state) {
 			if key == KEY_ONE {
-				hs.msgBroker.PublishRACmdSetTracking(driver.RA_TRACKING_ON)
+				hs.request("Track", func() error { return hs.msgBroker.RequestRACmdSetTracking(driver.RA_TRACKING_ON) })
 				hs.state++
 			} else if key == KEY_TWO {
-				hs.msgBroker.PublishRACmdSetTracking(driver.RA_TRACKING_OFF)
+				hs.request("Track", func() error { return hs.msgBroker.RequestRACmdSetTracking(driver.RA_TRACKING_OFF) })
 				hs.state++
 			}
 		}
@@ -454,14 +503,32 @@ func (hs *Handset) StateMachine(key Key) string {
 
 		if !doNav(key, &hs.state) {
 			if key == KEY_ONE {
-				hs.msgBroker.PublishRACmdSetDirection(driver.RA_DIRECTION_NORTH)
+				hs.request("Dir", func() error { return hs.msgBroker.RequestRACmdSetDirection(driver.RA_DIRECTION_NORTH) })
 				hs.state = UTILITY_MENU
 			} else if key == KEY_TWO {
-				hs.msgBroker.PublishRACmdSetDirection(driver.RA_DIRECTION_SOUTH)
+				hs.request("Dir", func() error { return hs.msgBroker.RequestRACmdSetDirection(driver.RA_DIRECTION_SOUTH) })
 				hs.state = UTILITY_MENU
 			}
 		}
 
+	case SET_RA_TRACKING_RATE:
+
+		if key == KEY_ESC || key == KEY_ENTER {
+			hs.state = UTILITY_MENU
+		} else if key == KEY_ONE {
+			hs.request("Rate", func() error { return hs.msgBroker.RequestRACmdSetTrackingRate(driver.TRACKING_RATE_SIDEREAL) })
+			hs.state = UTILITY_MENU
+		} else if key == KEY_TWO {
+			hs.request("Rate", func() error { return hs.msgBroker.RequestRACmdSetTrackingRate(driver.TRACKING_RATE_LUNAR) })
+			hs.state = UTILITY_MENU
+		} else if key == KEY_THREE {
+			hs.request("Rate", func() error { return hs.msgBroker.RequestRACmdSetTrackingRate(driver.TRACKING_RATE_SOLAR) })
+			hs.state = UTILITY_MENU
+		} else if key == KEY_FOUR {
+			hs.request("Rate", func() error { return hs.msgBroker.RequestRACmdSetTrackingRate(driver.TRACKING_RATE_KING) })
+			hs.state = UTILITY_MENU
+		}
+
 	case SET_DATE:
 
 		if key == KEY_ENTER {
@@ -626,6 +693,15 @@ func (hs *Handset) StateMachine(key Key) string {
 			hs.state = FIRST
 		} else if key == KEY_ONE {
 			hs.state++
+		} else if key == KEY_TWO {
+			hs.state = SET_RA_TRACKING_RATE
+		} else if key == KEY_THREE {
+			// Clear the alarm on both drivers, the axes can move either way again
+			hs.request("Clr RA", hs.msgBroker.RequestRACmdClearAlarm)
+			hs.request("Clr DE", hs.msgBroker.RequestDECmdClearAlarm)
+			hs.Screen.Alarm = ""
+			hs.Screen.Fault = driver.FAULT_NONE
+			hs.Screen.CmdFailure = ""
 		}
 
 	case OBJECTS_MENU:
@@ -670,6 +746,14 @@ func (hs *Handset) StateMachine(key Key) string {
 	case SET_RA_DIRECTION:
 		hs.dspOut = "RA Dir\n1 - North\n2 - South\n" + string(hs.Screen.Direction)
 
+	case SET_RA_TRACKING_RATE:
+		// The current rate is marked with a *
+		hs.dspOut = "Track Rate\n" +
+			"1 Sidereal" + hs.rateMark(driver.TRACKING_RATE_SIDEREAL) + "\n" +
+			"2 Lunar" + hs.rateMark(driver.TRACKING_RATE_LUNAR) + "\n" +
+			"3 Solar" + hs.rateMark(driver.TRACKING_RATE_SOLAR) + "\n" +
+			"4 King" + hs.rateMark(driver.TRACKING_RATE_KING)
+
 	case SET_DATE:
 		hs.dspOut = "Set Date\nYYYY-MM-DD\n-----------\n" + hs.currentDateStr
 
@@ -693,9 +777,18 @@ func (hs *Handset) StateMachine(key Key) string {
 
 	case UTILITY_MENU:
 		hs.dspOut = "1 RA Setup\n" +
-			"2 todo\n" +
+			"2 Track Rate\n" +
+			"3 Clr Alarm\n" +
 			"\n"
 
+		if hs.Screen.Alarm != "" {
+			hs.dspOut = hs.dspOut + ">" + hs.Screen.Alarm + "<"
+		} else if hs.Screen.Fault != driver.FAULT_NONE {
+			hs.dspOut = hs.dspOut + ">RA " + string(hs.Screen.Fault) + "<"
+		} else if hs.Screen.CmdFailure != "" {
+			hs.dspOut = hs.dspOut + ">" + hs.Screen.CmdFailure + "<"
+		}
+
 	case OBJECTS_MENU:
 		hs.dspOut = "Objects\nMenu\n\nTODO\n"
 
@@ -709,6 +802,13 @@ func (hs *Handset) StateMachine(key Key) string {
 
 	return hs.dspOut
 }
+func (hs *Handset) rateMark(rate driver.TrackingRate) string {
+	if hs.Screen.TrackingRate == rate {
+		return "*"
+	}
+	return ""
+}
+
 func (hs *Handset) GetStatusLine() string {
 	status := []byte{' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
 
@@ -732,6 +832,26 @@ func (hs *Handset) GetStatusLine() string {
 		status[1] = 'S'
 	}
 
+	if hs.Screen.Alarm != "" {
+		// A driver has stopped on an alarm
+		status[2] = '!'
+	}
+
+	if hs.Screen.Fault != driver.FAULT_NONE {
+		// The RA watchdog has stopped the motor
+		status[3] = 'F'
+	}
+
+	if hs.Screen.CmdFailure != "" {
+		// A driver did not acknowledge a command
+		status[4] = '?'
+	}
+
+	if !math.IsNaN(hs.Screen.Temperature) {
+		// The driver temperature in the last four columns, for example " 38C"
+		copy(status[6:], fmt.Sprintf("%3.0fC", hs.Screen.Temperature))
+	}
+
 	return string(status)
 }
 
@@ -0,0 +1,300 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/driver"
+	"github.com/tonygilkerson/astroeq/pkg/msg/wire"
+)
+
+// Acknowledged commands
+//
+// A command sent with a Request function has a sequence number, the driver runs it and replies
+// to the node it came from with an Ack, or a Nack with an error code when it could not. With no reply in CMD_ACK_TIMEOUT the
+// command is sent again with the same sequence number, a driver that already ran it just
+// replies again. The sequence numbers are counted by each node, so a retry is known by its
+// sequence number and the node it came from, a node with no address can not be told apart and
+// its retries are run again. A reply is only kept for CMD_REPLY_WINDOW, a node that restarts
+// counts from 1 again and its new commands must not be taken for retries. A command with
+// sequence number 0 is not acknowledged, as before.
+//
+//	^RADriverCmd|SetTracking|On|17~
+//	^Ack|RADriverCmd|17|0|~
+//	^Nack|RADriverCmd|18|2|bad slew target: [abc]~
+const (
+	CMD_ACK_TIMEOUT = time.Millisecond * 1500
+	CMD_RETRIES     = 2
+
+	// The replies a driver keeps for each node, a retry of an older command is run again
+	CMD_REPLIES_KEPT = 4
+
+	// How long a reply is kept, as long as the node that sent the command keeps trying
+	CMD_REPLY_WINDOW = CMD_ACK_TIMEOUT * (CMD_RETRIES + 1)
+)
+
+type AckCode uint8
+
+const (
+	ACK_OK           AckCode = 0
+	NACK_UNKNOWN_CMD AckCode = 1 // The driver does not know the command
+	NACK_BAD_ARGS    AckCode = 2 // The arguments are missing or do not parse
+	NACK_FAILED      AckCode = 3 // The driver refused or failed to run the command
+)
+
+func (code AckCode) String() string {
+
+	switch code {
+	case ACK_OK:
+		return "OK"
+	case NACK_UNKNOWN_CMD:
+		return "UnknownCmd"
+	case NACK_BAD_ARGS:
+		return "BadArgs"
+	case NACK_FAILED:
+		return "Failed"
+	default:
+		return "Code" + strconv.Itoa(int(code))
+	}
+}
+
+// The reply to a command, Kind is MSG_ACK or MSG_NACK and Cmd is the kind of command it replies to
+type AckMsg struct {
+	Kind   MsgType
+	Cmd    MsgType
+	Seq    uint16
+	Code   AckCode
+	Detail string
+}
+
+// Returned when a driver replies with a Nack
+type CmdError struct {
+	Code   AckCode
+	Detail string
+}
+
+func (e *CmdError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Detail)
+}
+
+// Returns a CmdError, for a driver to say why it did not run a command
+func NewCmdError(code AckCode, format string, a ...any) *CmdError {
+	return &CmdError{Code: code, Detail: fmt.Sprintf(format, a...)}
+}
+
+// Returns a NACK_BAD_ARGS error unless a command has at least n non empty arguments
+func NeedArgs(args []string, n int) error {
+
+	if len(args) < n {
+		return NewCmdError(NACK_BAD_ARGS, "need %v arguments: [%v]", n, strings.Join(args, ","))
+	}
+	for _, arg := range args[:n] {
+		if arg == "" {
+			return NewCmdError(NACK_BAD_ARGS, "need %v arguments: [%v]", n, strings.Join(args, ","))
+		}
+	}
+	return nil
+}
+
+// Returned when a command is not acknowledged after all the retries
+var ErrNoAck = errors.New("no reply")
+
+// A command a driver ran from a node and the reply sent, so a retry is only replied to
+type lastCmd struct {
+	seq  uint16
+	ack  AckMsg
+	time time.Time
+}
+
+// Publish the command and wait for the RA driver to reply, see request
+func (mb *MsgBroker) RequestRADriverCmd(raDriverCmdMsg RADriverCmdMsg) error {
+
+	return mb.request(MSG_RADRIVER_CMD, func(seq uint16) {
+		raDriverCmdMsg.Seq = seq
+		mb.PublishRADriverCmd(raDriverCmdMsg)
+	})
+
+}
+
+// Publish the command and wait for the DEC driver to reply, see request
+func (mb *MsgBroker) RequestDEDriverCmd(deDriverCmdMsg DEDriverCmdMsg) error {
+
+	return mb.request(MSG_DEDRIVER_CMD, func(seq uint16) {
+		deDriverCmdMsg.Seq = seq
+		mb.PublishDEDriverCmd(deDriverCmdMsg)
+	})
+
+}
+
+func (mb *MsgBroker) RequestRACmdSetTracking(tracking driver.RaValue) error {
+	return mb.RequestRADriverCmd(RADriverCmdMsg{Kind: MSG_RADRIVER_CMD, Cmd: RA_CMD_SET_TRACKING, Args: []string{string(tracking)}})
+}
+
+func (mb *MsgBroker) RequestRACmdSetDirection(direction driver.RaValue) error {
+	return mb.RequestRADriverCmd(RADriverCmdMsg{Kind: MSG_RADRIVER_CMD, Cmd: RA_CMD_SET_DIRECTION, Args: []string{string(direction)}})
+}
+
+func (mb *MsgBroker) RequestRACmdSetTrackingRate(rate driver.TrackingRate) error {
+	return mb.RequestRADriverCmd(RADriverCmdMsg{Kind: MSG_RADRIVER_CMD, Cmd: RA_CMD_SET_TRACKING_RATE, Args: []string{string(rate)}})
+}
+
+func (mb *MsgBroker) RequestRACmdClearAlarm() error {
+	return mb.RequestRADriverCmd(RADriverCmdMsg{Kind: MSG_RADRIVER_CMD, Cmd: RA_CMD_CLEAR_ALARM})
+}
+
+func (mb *MsgBroker) RequestDECmdClearAlarm() error {
+	return mb.RequestDEDriverCmd(DEDriverCmdMsg{Kind: MSG_DEDRIVER_CMD, Cmd: DE_CMD_CLEAR_ALARM})
+}
+
+// Send with a new sequence number and wait for the reply, sending again on a timeout
+//
+// Returns nil on an Ack, a *CmdError on a Nack and ErrNoAck when there is no reply
+func (mb *MsgBroker) request(cmd MsgType, send func(seq uint16)) error {
+
+	ch := make(chan AckMsg, 1)
+
+	mb.ackMu.Lock()
+	mb.seq++
+	if mb.seq == 0 {
+		mb.seq++
+	}
+	seq := mb.seq
+	mb.pending[seq] = ch
+	mb.ackMu.Unlock()
+
+	defer func() {
+		mb.ackMu.Lock()
+		delete(mb.pending, seq)
+		mb.ackMu.Unlock()
+	}()
+
+	for try := 0; try <= CMD_RETRIES; try++ {
+		if try > 0 {
+			fmt.Printf("[request] - no reply to %v %v, try %v\n", cmd, seq, try+1)
+		}
+		send(seq)
+
+		if ack, ok := mb.waitAck(cmd, seq, ch); ok {
+			if ack.Kind == MSG_NACK {
+				return &CmdError{Code: ack.Code, Detail: ack.Detail}
+			}
+			return nil
+		}
+	}
+
+	return ErrNoAck
+}
+
+// Wait out the timeout for the reply to cmd, a reply to another command is not for this request
+func (mb *MsgBroker) waitAck(cmd MsgType, seq uint16, ch chan AckMsg) (AckMsg, bool) {
+
+	timeout := time.After(mb.ackTimeout)
+	for {
+		select {
+		case ack := <-ch:
+			if ack.Cmd != cmd {
+				fmt.Printf("[request] - %v %v reply is for %v, still waiting\n", cmd, seq, ack.Cmd)
+				continue
+			}
+			return ack, true
+		case <-timeout:
+			return AckMsg{}, false
+		}
+	}
+}
+
+// Hand a reply to the request waiting for it
+func (mb *MsgBroker) deliverAck(ack AckMsg) {
+
+	mb.ackMu.Lock()
+	ch, ok := mb.pending[ack.Seq]
+	mb.ackMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- ack:
+	default:
+	}
+
+}
+
+// Called by a driver before it runs a command, returns true if the command is a retry of
+// the last one, the reply is sent again and the command should not be run again
+func (mb *MsgBroker) IsRetry(cmd MsgType, from wire.Address, seq uint16) bool {
+
+	if seq == 0 || from == wire.ADDR_NONE {
+		return false
+	}
+
+	now := mb.clock.Now()
+	mb.ackMu.Lock()
+	var ack AckMsg
+	found := false
+	for _, last := range mb.lastCmd[from] {
+		if last.seq == seq && now.Sub(last.time) < CMD_REPLY_WINDOW {
+			ack = last.ack
+			found = true
+		}
+	}
+	mb.ackMu.Unlock()
+
+	if !found {
+		return false
+	}
+
+	fmt.Printf("[IsRetry] - %v %v already run, reply again\n", cmd, seq)
+	mb.PublishAck(from, ack)
+	return true
+}
+
+// Called by a driver after it runs a command, replies with an Ack when err is nil and a Nack
+// otherwise, the code comes from a *CmdError and is NACK_FAILED for any other error
+func (mb *MsgBroker) ReplyCmd(cmd MsgType, from wire.Address, seq uint16, err error) {
+
+	if seq == 0 {
+		return
+	}
+
+	ack := AckMsg{Kind: MSG_ACK, Cmd: cmd, Seq: seq, Code: ACK_OK}
+	if err != nil {
+		ack.Kind = MSG_NACK
+		ack.Code = NACK_FAILED
+		ack.Detail = err.Error()
+
+		var cmdErr *CmdError
+		if errors.As(err, &cmdErr) {
+			ack.Code = cmdErr.Code
+			ack.Detail = cmdErr.Detail
+		}
+	}
+
+	// A node with no address can not be told from another, see IsRetry
+	if from != wire.ADDR_NONE {
+		mb.ackMu.Lock()
+		kept := append(mb.lastCmd[from], lastCmd{seq: seq, ack: ack, time: mb.clock.Now()})
+		if len(kept) > CMD_REPLIES_KEPT {
+			kept = kept[len(kept)-CMD_REPLIES_KEPT:]
+		}
+		mb.lastCmd[from] = kept
+		mb.ackMu.Unlock()
+	}
+
+	mb.PublishAck(from, ack)
+
+}
+
+// Send the reply to the node at to, to every node when the command came from a node with no address
+func (mb *MsgBroker) PublishAck(to wire.Address, ackMsg AckMsg) {
+
+	if to == wire.ADDR_NONE {
+		to = wire.ADDR_BROADCAST
+	}
+	mb.SendMsg(to, ackParts(ackMsg))
+
+}
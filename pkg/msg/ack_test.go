@@ -0,0 +1,172 @@
+package msg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+	"github.com/tonygilkerson/astroeq/pkg/msg/wire"
+)
+
+// Returns a broker on no UARTs that gives up waiting for a reply quickly
+func newTestBroker(t *testing.T) *MsgBroker {
+
+	mb, err := NewBroker(nil, 0, 0, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("NewBroker: %v", err)
+	}
+	mb.ackTimeout = time.Millisecond * 50
+
+	return &mb
+}
+
+func TestRequestAck(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	sends := 0
+	err := mb.request(MSG_RADRIVER_CMD, func(seq uint16) {
+		sends++
+		mb.deliverAck(AckMsg{Kind: MSG_ACK, Cmd: MSG_RADRIVER_CMD, Seq: seq})
+	})
+	if err != nil || sends != 1 {
+		t.Errorf("request = %v after %v sends, want nil after 1", err, sends)
+	}
+
+}
+
+func TestRequestRetry(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	// The first send is lost, the retry has the same sequence number
+	var seqs []uint16
+	err := mb.request(MSG_RADRIVER_CMD, func(seq uint16) {
+		seqs = append(seqs, seq)
+		if len(seqs) == 2 {
+			mb.deliverAck(AckMsg{Kind: MSG_ACK, Cmd: MSG_RADRIVER_CMD, Seq: seq})
+		}
+	})
+	if err != nil || len(seqs) != 2 || seqs[0] != seqs[1] {
+		t.Errorf("request = %v, sent with %v, want nil after 2 sends with one sequence number", err, seqs)
+	}
+
+}
+
+func TestRequestTimeout(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	sends := 0
+	err := mb.request(MSG_RADRIVER_CMD, func(seq uint16) {
+		sends++
+	})
+	if !errors.Is(err, ErrNoAck) || sends != CMD_RETRIES+1 {
+		t.Errorf("request = %v after %v sends, want %v after %v", err, sends, ErrNoAck, CMD_RETRIES+1)
+	}
+
+}
+
+func TestRequestNack(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	err := mb.request(MSG_RADRIVER_CMD, func(seq uint16) {
+		mb.deliverAck(AckMsg{Kind: MSG_NACK, Cmd: MSG_RADRIVER_CMD, Seq: seq, Code: NACK_BAD_ARGS, Detail: "bad slew target: [abc]"})
+	})
+
+	var cmdErr *CmdError
+	if !errors.As(err, &cmdErr) || cmdErr.Code != NACK_BAD_ARGS || cmdErr.Detail != "bad slew target: [abc]" {
+		t.Errorf("request = %v, want a %v CmdError", err, NACK_BAD_ARGS)
+	}
+
+}
+
+func TestRequestWrongCmd(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	// A reply to another command does not use up a try, the right reply comes later in the same wait
+	sends := 0
+	err := mb.request(MSG_RADRIVER_CMD, func(seq uint16) {
+		sends++
+		mb.deliverAck(AckMsg{Kind: MSG_ACK, Cmd: MSG_DEDRIVER_CMD, Seq: seq})
+		go func() {
+			time.Sleep(mb.ackTimeout / 5)
+			mb.deliverAck(AckMsg{Kind: MSG_ACK, Cmd: MSG_RADRIVER_CMD, Seq: seq})
+		}()
+	})
+	if err != nil || sends != 1 {
+		t.Errorf("request = %v after %v sends, want nil after 1", err, sends)
+	}
+
+}
+
+func TestIsRetry(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	mb.ReplyCmd(MSG_RADRIVER_CMD, ADDR_HANDSET, 5, nil)
+	mb.ReplyCmd(MSG_RADRIVER_CMD, ADDR_HANDSET, 6, nil)
+	mb.ReplyCmd(MSG_RADRIVER_CMD, ADDR_DE_DRIVER, 7, nil)
+
+	tests := []struct {
+		name string
+		cmd  MsgType
+		from wire.Address
+		seq  uint16
+		want bool
+	}{
+		{"last command", MSG_RADRIVER_CMD, ADDR_HANDSET, 6, true},
+		{"command before the last", MSG_RADRIVER_CMD, ADDR_HANDSET, 5, true},
+		{"new command", MSG_RADRIVER_CMD, ADDR_HANDSET, 8, false},
+		{"sequence number from another node", MSG_RADRIVER_CMD, ADDR_HANDSET, 7, false},
+		{"not acknowledged", MSG_RADRIVER_CMD, ADDR_HANDSET, 0, false},
+	}
+	for _, test := range tests {
+		if got := mb.IsRetry(test.cmd, test.from, test.seq); got != test.want {
+			t.Errorf("%v: IsRetry = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Nodes with no address all look the same, their commands are always run
+	mb.ReplyCmd(MSG_RADRIVER_CMD, wire.ADDR_NONE, 9, nil)
+	if mb.IsRetry(MSG_RADRIVER_CMD, wire.ADDR_NONE, 9) {
+		t.Error("IsRetry = true from a node with no address")
+	}
+
+	// Only the last CMD_REPLIES_KEPT replies are kept
+	for seq := uint16(10); seq < 10+CMD_REPLIES_KEPT; seq++ {
+		mb.ReplyCmd(MSG_RADRIVER_CMD, ADDR_HANDSET, seq, nil)
+	}
+	if mb.IsRetry(MSG_RADRIVER_CMD, ADDR_HANDSET, 6) {
+		t.Error("IsRetry = true for a reply no longer kept")
+	}
+
+}
+
+func TestIsRetryAfterRestart(t *testing.T) {
+
+	mb := newTestBroker(t)
+	clock := hal.NewFakeClock(time.Now())
+	mb.SetClock(clock)
+
+	for seq := uint16(1); seq <= 3; seq++ {
+		mb.ReplyCmd(MSG_RADRIVER_CMD, ADDR_HANDSET, seq, nil)
+	}
+
+	// The handset restarts and counts from 1 again, by then it has stopped retrying the old command
+	clock.Advance(CMD_REPLY_WINDOW)
+	if mb.IsRetry(MSG_RADRIVER_CMD, ADDR_HANDSET, 1) {
+		t.Error("a new command after a restart was taken for a retry and not run")
+	}
+
+	// Its retries are still known
+	mb.ReplyCmd(MSG_RADRIVER_CMD, ADDR_HANDSET, 1, nil)
+	clock.Advance(CMD_ACK_TIMEOUT)
+	if !mb.IsRetry(MSG_RADRIVER_CMD, ADDR_HANDSET, 1) {
+		t.Error("a retry of the new command was run again")
+	}
+
+}
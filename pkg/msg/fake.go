@@ -0,0 +1,12 @@
+//go:build !tinygo
+
+package msg
+
+// On the host the messages build and test without the machine package, the names follow it
+type Pin uint8
+
+type UARTConfig struct {
+	BaudRate uint32
+	TX       Pin
+	RX       Pin
+}
@@ -0,0 +1,11 @@
+//go:build tinygo
+
+package msg
+
+import (
+	"machine"
+)
+
+// The UART pins and configuration, a machine.UART is a UART
+type Pin = machine.Pin
+type UARTConfig = machine.UARTConfig
@@ -2,33 +2,82 @@ package msg
 
 import (
 	"fmt"
-	"machine"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/tonygilkerson/astroeq/pkg/driver"
-)
-
-const (
-	TOKEN_HAT   byte = 94  // ^
-	TOKEN_ABOUT byte = 126 // ~
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+	"github.com/tonygilkerson/astroeq/pkg/msg/wire"
 )
 
 // Define message types
+//
+// A message is sent as its parts, the kind first, the samples below are shown in the legacy
+// ^...~ framing, on the wire they are in the version 2 framing unless SetWireVersion says
+// otherwise, see pkg/msg/wire
 type MsgType string
 type RADriverCmd string
+type DEDriverCmd string
 
 const (
 	MSG_FOO          MsgType = "Foo"
 	MSG_HANDSET      MsgType = "Handset"
 	MSG_RADRIVER     MsgType = "RADriver"
 	MSG_RADRIVER_CMD MsgType = "RADriverCmd"
+	MSG_DEDRIVER     MsgType = "DEDriver"
+	MSG_DEDRIVER_CMD MsgType = "DEDriverCmd"
+	MSG_ALARM        MsgType = "Alarm"
+
+	MSG_RADRIVER_FAULT MsgType = "RADriverFault"
+
+	MSG_ACK  MsgType = "Ack"
+	MSG_NACK MsgType = "Nack"
+)
+
+// Node addresses, commands and their replies go to one node and the rest to every node,
+// see wire.Router
+const (
+	ADDR_HANDSET   wire.Address = 1
+	ADDR_CONSOLE   wire.Address = 2
+	ADDR_RA_DRIVER wire.Address = 3
+	ADDR_DE_DRIVER wire.Address = 4
 )
 
 const (
 	RA_CMD_SET_TRACKING  RADriverCmd = "SetTracking"
 	RA_CMD_SET_DIRECTION RADriverCmd = "SetDirection"
+	RA_CMD_SLEW_TO       RADriverCmd = "SlewTo"
+	RA_CMD_ABORT         RADriverCmd = "Abort"
+
+	RA_CMD_SET_TRACKING_RATE RADriverCmd = "SetTrackingRate"
+	RA_CMD_PEC_RECORD        RADriverCmd = "PECRecord"
+	RA_CMD_PEC_PLAYBACK      RADriverCmd = "PECPlayback"
+	RA_CMD_PEC_CLEAR         RADriverCmd = "PECClear"
+	RA_CMD_GUIDE             RADriverCmd = "Guide"
+	RA_CMD_SET_BACKLASH      RADriverCmd = "SetBacklash"
+	RA_CMD_CAL_BACKLASH      RADriverCmd = "CalibrateBacklash"
+	RA_CMD_PARK              RADriverCmd = "Park"
+	RA_CMD_UNPARK            RADriverCmd = "Unpark"
+	RA_CMD_HOME              RADriverCmd = "Home"
+	RA_CMD_SET_PARK          RADriverCmd = "SetPark"
+	RA_CMD_SET_LIMITS        RADriverCmd = "SetLimits"
+	RA_CMD_CLEAR_ALARM       RADriverCmd = "ClearAlarm"
+	RA_CMD_SET_TEMP_LIMITS   RADriverCmd = "SetTempLimits"
+)
+
+const (
+	DE_CMD_SET_MOTOR     DEDriverCmd = "SetMotor"
+	DE_CMD_SET_DIRECTION DEDriverCmd = "SetDirection"
+	DE_CMD_SLEW_TO       DEDriverCmd = "SlewTo"
+	DE_CMD_ABORT         DEDriverCmd = "Abort"
+	DE_CMD_SET_BACKLASH  DEDriverCmd = "SetBacklash"
+	DE_CMD_PARK          DEDriverCmd = "Park"
+	DE_CMD_UNPARK        DEDriverCmd = "Unpark"
+	DE_CMD_HOME          DEDriverCmd = "Home"
+	DE_CMD_SET_PARK      DEDriverCmd = "SetPark"
+	DE_CMD_SET_LIMITS    DEDriverCmd = "SetLimits"
+	DE_CMD_CLEAR_ALARM   DEDriverCmd = "ClearAlarm"
 )
 
 // Foo message use for testing I will delete it eventually
@@ -43,36 +92,141 @@ type FooMsg struct {
 // ^Handset|somekey~
 type HandsetMsg struct {
 	Kind MsgType
-	Keys []string
+	Keys []string `msg:"rest"`
 }
 
 // RA Driver message used for sending commands to the RA Driver and for publishing it current status
 // The following are sample messages
 //
-// ^RADriver|On|North|12345~
+// ^RADriver|On|North|12345|false|0|Sidereal|Off|false||NaN|true|120,0,0,0,0,0~
+// ^RADriver|On|North|12345|true|42.5|Lunar|Playback|false|OK|38.5|false|980,31,0,31,7,7~
+//
+// DriverStatus is the TMC2208 status flags, for example "OK" or "OTPW,OL", empty if the TMC2208 UART is not used
+// Temperature is the stepper driver temperature in °C, NaN if there is no sensor
+// EncoderStats is encoder.ReadStats as a string, see ReadStats.String
 type RADriverMsg struct {
-	Kind      MsgType
-	Tracking  driver.RaValue
-	Direction driver.RaValue
-	Position  uint32
+	Kind           MsgType
+	Tracking       driver.RaValue
+	Direction      driver.RaValue
+	Position       int64
+	Slewing        bool
+	SlewProgress   float64 `msg:"prec=1"`
+	TrackingRate   driver.TrackingRate
+	PEC            driver.PecState
+	Parked         bool
+	DriverStatus   string
+	Temperature    float64 `msg:"prec=1 nan"`
+	EncoderHealthy bool
+	EncoderStats   string
 }
 
 // ^RADriverCmd|SetTracking|On~
 // ^RADriverCmd|SetTracking|Off~
 // ^RADriverCmd|SetDirection|North~
 // ^RADriverCmd|SetDirection|South~
+// ^RADriverCmd|SlewTo|12345~
+// ^RADriverCmd|Abort|~
+// ^RADriverCmd|SetTrackingRate|Lunar~
+// ^RADriverCmd|SetTrackingRate|Custom,15.2~
+// ^RADriverCmd|PECRecord|~
+// ^RADriverCmd|PECPlayback|On~
+// ^RADriverCmd|PECPlayback|Off~
+// ^RADriverCmd|PECClear|~
+// ^RADriverCmd|Guide|West,250~    guide pulse direction and duration in milliseconds
+// ^RADriverCmd|SetBacklash|300,500~ backlash in encoder counts and the take up rate in Hz
+// ^RADriverCmd|Park|~
+// ^RADriverCmd|Unpark|~
+// ^RADriverCmd|Home|~
+// ^RADriverCmd|SetPark|~         the current position becomes the park position
+// ^RADriverCmd|SetPark|12345~    set the park position in encoder counts
+// ^RADriverCmd|SetLimits|1000,7000000~ min and max positions in encoder counts
+// ^RADriverCmd|ClearAlarm|~        clears limit alarms and watchdog faults
+// ^RADriverCmd|SetTempLimits|60,75~ throttle and max stepper driver temperatures in °C
+// ^RADriverCmd|SetTracking|On|17~  with a sequence number the driver replies with an Ack or Nack, see ack.go
 type RADriverCmdMsg struct {
 	Kind MsgType
 	Cmd  RADriverCmd
-	Args []string
+	Args []string `msg:"join=,"`
+	Seq  uint16   `msg:"omitempty"`
+	// The node the command came from, not sent
+	From wire.Address `msg:"-"`
+}
+
+// DEC Driver message used for publishing its current status
+// The following are sample messages
+//
+// ^DEDriver|On|North|12345|false|0|false|OK|true|120,0,0,0,0,0~
+type DEDriverMsg struct {
+	Kind           MsgType
+	Motor          driver.DeValue
+	Direction      driver.DeValue
+	Position       int64
+	Slewing        bool
+	SlewProgress   float64 `msg:"prec=1"`
+	Parked         bool
+	DriverStatus   string
+	EncoderHealthy bool
+	EncoderStats   string
+}
+
+// ^DEDriverCmd|SetMotor|On~
+// ^DEDriverCmd|SetMotor|Off~
+// ^DEDriverCmd|SetDirection|North~
+// ^DEDriverCmd|SetDirection|South~
+// ^DEDriverCmd|SlewTo|12345~
+// ^DEDriverCmd|Abort|~
+// ^DEDriverCmd|SetBacklash|300,500~
+// ^DEDriverCmd|Park|~
+// ^DEDriverCmd|Unpark|~
+// ^DEDriverCmd|Home|~
+// ^DEDriverCmd|SetPark|~
+// ^DEDriverCmd|SetPark|12345~
+// ^DEDriverCmd|SetLimits|1000,7000000~
+// ^DEDriverCmd|ClearAlarm|~
+// ^DEDriverCmd|SetMotor|On|17~
+type DEDriverCmdMsg struct {
+	Kind MsgType
+	Cmd  DEDriverCmd
+	Args []string `msg:"join=,"`
+	Seq  uint16   `msg:"omitempty"`
+	// The node the command came from, not sent
+	From wire.Address `msg:"-"`
+}
+
+// Published by a driver when it raises an alarm
+// The following is a sample message
+//
+// ^Alarm|RA|LimitMax|7000123~
+type AlarmMsg struct {
+	Kind     MsgType
+	Source   string
+	Alarm    driver.Alarm
+	Position int64
 }
 
+// Published by the RA Driver when the watchdog disables the motor
+// The steps are the motor steps expected and measured over the window that raised the fault
+// The following is a sample message
+//
+// ^RADriverFault|Stall|64|2|123456~
+type RADriverFaultMsg struct {
+	Kind     MsgType
+	Fault    driver.Fault
+	Expected float64 `msg:"prec=0"`
+	Measured float64 `msg:"prec=0"`
+	Position int64
+}
+
+// The messages sent on the bus, the encode and decode functions for each are generated from
+// its struct, the msg field tags say how a field is sent, see cmd/msggen
+//
+//go:generate go run ../../cmd/msggen
 type MsgInterface interface {
-	FooMsg | HandsetMsg | RADriverMsg | RADriverCmdMsg
+	FooMsg | HandsetMsg | RADriverMsg | RADriverCmdMsg | DEDriverMsg | DEDriverCmdMsg | AlarmMsg | RADriverFaultMsg | AckMsg
 }
 
 type UART interface {
-	Configure(config machine.UARTConfig) error
+	Configure(config UARTConfig) error
 	Buffered() int
 	ReadByte() (byte, error)
 	Write(data []byte) (n int, err error)
@@ -81,31 +235,58 @@ type UART interface {
 // Message Broker
 type MsgBroker struct {
 	uartUp      UART
-	uartUpTxPin machine.Pin
-	uartUpRxPin machine.Pin
+	uartUpTxPin Pin
+	uartUpRxPin Pin
 
 	uartDn      UART
-	uartDnTxPin machine.Pin
-	uartDnRxPin machine.Pin
-
-	fooCh         chan FooMsg
-	handsetCh     chan HandsetMsg
-	raDriverCh    chan RADriverMsg
-	raDriverCmdCh chan RADriverCmdMsg
+	uartDnTxPin Pin
+	uartDnRxPin Pin
+
+	// The channels messages are sent to, see registry.go
+	subscribers []*subscriber
+	subMu       *sync.Mutex
+
+	// The framing messages are published in and a decoder for each UART, see pkg/msg/wire
+	wireVersion byte
+	upDecoder   *wire.Decoder
+	dnDecoder   *wire.Decoder
+
+	// The address of this node and what to do with each message read
+	router  *wire.Router
+	routeMu *sync.Mutex
+
+	// Acknowledged commands, see ack.go
+	ackMu      *sync.Mutex
+	ackTimeout time.Duration
+	clock      hal.Clock
+	seq        uint16
+	pending    map[uint16]chan AckMsg
+	lastCmd    map[wire.Address][]lastCmd
 }
 
 func NewBroker(
 	uartUp UART,
-	uartUpTxPin machine.Pin,
-	uartUpRxPin machine.Pin,
+	uartUpTxPin Pin,
+	uartUpRxPin Pin,
 
 	uartDn UART,
-	uartDnTxPin machine.Pin,
-	uartDnRxPin machine.Pin,
+	uartDnTxPin Pin,
+	uartDnRxPin Pin,
 
 ) (MsgBroker, error) {
 
 	var mb MsgBroker
+	mb.subMu = new(sync.Mutex)
+	mb.wireVersion = wire.VERSION_2
+	mb.upDecoder = wire.NewDecoder()
+	mb.dnDecoder = wire.NewDecoder()
+	mb.router, _ = wire.NewRouter(wire.ADDR_NONE)
+	mb.routeMu = new(sync.Mutex)
+	mb.ackMu = new(sync.Mutex)
+	mb.ackTimeout = CMD_ACK_TIMEOUT
+	mb.clock = hal.SystemClock{}
+	mb.pending = make(map[uint16]chan AckMsg)
+	mb.lastCmd = make(map[wire.Address][]lastCmd)
 
 	if uartUp != nil {
 		mb.uartUp = uartUp
@@ -127,283 +308,555 @@ func (mb *MsgBroker) Configure() {
 
 	// Upstream UART
 	if mb.uartUp != nil {
-		mb.uartUp.Configure(machine.UARTConfig{TX: mb.uartUpTxPin, RX: mb.uartUpRxPin})
+		mb.uartUp.Configure(UARTConfig{TX: mb.uartUpTxPin, RX: mb.uartUpRxPin})
 	}
 
 	// Downstream UART
 	if mb.uartDn != nil {
-		mb.uartDn.Configure(machine.UARTConfig{TX: mb.uartDnTxPin, RX: mb.uartDnRxPin})
+		mb.uartDn.Configure(UARTConfig{TX: mb.uartDnTxPin, RX: mb.uartDnRxPin})
 	}
 }
 
-func (mb *MsgBroker) SetFooCh(ch chan FooMsg) {
-	mb.fooCh = ch
+// Publish in wire.VERSION_2, the default, or wire.VERSION_LEGACY while there are nodes on the old firmware
+//
+// Both framings are always read
+func (mb *MsgBroker) SetWireVersion(version byte) error {
+
+	if version != wire.VERSION_LEGACY && version != wire.VERSION_2 {
+		return fmt.Errorf("unknown wire version: %v", version)
+	}
+
+	mb.wireVersion = version
+	return nil
 }
-func (mb *MsgBroker) SetHandsetCh(ch chan HandsetMsg) {
-	mb.handsetCh = ch
+
+func (mb *MsgBroker) GetWireVersion() byte {
+	return mb.wireVersion
 }
-func (mb *MsgBroker) SetRADriverCh(ch chan RADriverMsg) {
-	mb.raDriverCh = ch
+
+// Use a fake clock in tests, it times how long a reply is kept, see ack.go
+func (mb *MsgBroker) SetClock(clock hal.Clock) {
+	mb.clock = clock
 }
-func (mb *MsgBroker) SetRADriverCmdCh(ch chan RADriverCmdMsg) {
-	mb.raDriverCmdCh = ch
+
+// Returns the decoder counts for the upstream and downstream UARTs
+func (mb *MsgBroker) GetWireStats() (up wire.DecoderStats, dn wire.DecoderStats) {
+	return mb.upDecoder.GetStats(), mb.dnDecoder.GetStats()
+}
+
+// Set the address of this node, one of the ADDR_ constants, a node with no address only
+// reads broadcasts and can not tell its own messages from another's
+func (mb *MsgBroker) SetAddress(addr wire.Address) error {
+
+	router, err := wire.NewRouter(addr)
+	if err != nil {
+		return err
+	}
+
+	mb.routeMu.Lock()
+	mb.router = router
+	mb.routeMu.Unlock()
+	return nil
+}
+
+func (mb *MsgBroker) GetAddress() wire.Address {
+
+	mb.routeMu.Lock()
+	defer mb.routeMu.Unlock()
+	return mb.router.GetAddress()
+}
+
+// Returns the counts of messages read, passed on and dropped
+func (mb *MsgBroker) GetRouteStats() wire.RouterStats {
+
+	mb.routeMu.Lock()
+	defer mb.routeMu.Unlock()
+	return mb.router.GetStats()
 }
 
 func (mb *MsgBroker) SubscriptionReaderRoutine() {
 
 	for {
 
-		mb.uartReader(mb.uartUp, mb.uartDn)
+		mb.uartReader(mb.uartUp, mb.uartDn, mb.upDecoder)
 		time.Sleep(time.Millisecond * 100)
 
-		mb.uartReader(mb.uartDn, mb.uartUp)
+		mb.uartReader(mb.uartDn, mb.uartUp, mb.dnDecoder)
 		time.Sleep(time.Millisecond * 100)
 	}
 }
 
-func (mb *MsgBroker) uartReader(readFromUart UART, forwardToUart UART) {
+// Read what is buffered, a message cut short stays in the decoder until the rest arrives
+func (mb *MsgBroker) uartReader(readFromUart UART, forwardToUart UART, decoder *wire.Decoder) {
 
-	// If no data, quit
-	if readFromUart == nil || readFromUart.Buffered() == 0 {
+	if readFromUart == nil {
 		return
 	}
 
-	data, _ := readFromUart.ReadByte()
+	for readFromUart.Buffered() > 0 {
+
+		data, err := readFromUart.ReadByte()
+		if err != nil {
+			return
+		}
+
+		message, ok := decoder.Feed(data)
+		if !ok {
+			continue
+		}
 
-	// the "^" character is the start of a message
-	if data == TOKEN_HAT {
-		message := make([]byte, 0, 255) //capacity of 255
+		mb.routeMu.Lock()
+		deliver, forward, next := mb.router.Route(message)
+		mb.routeMu.Unlock()
 
 		//
-		// Start loop read a message
+		// At this point we have an entire message, so dispatch it if it is for this node!
 		//
-		var abortCount int
-
-		for {
+		if deliver {
+			mb.DispatchMsgToChannel(message.Header.Src, message.Parts)
+		}
 
-			// If we see the start of a message but don't get the end in less than a second then abort
-			if abortCount > 100 {
-				return
+		// Forward message for other potential consumers in the framing this node publishes in,
+		// a legacy message stays legacy as a node on the old firmware may be waiting for it
+		if forward && forwardToUart != nil {
+			version := mb.wireVersion
+			if message.Version == wire.VERSION_LEGACY {
+				version = wire.VERSION_LEGACY
 			}
+			mb.writeMsg(forwardToUart, version, next, message.Parts)
+		}
 
-			// If no data wait and try again
-			if readFromUart.Buffered() == 0 {
-				abortCount++
-				time.Sleep(time.Millisecond * 10)
-				continue
-			}
+	}
+}
 
-			// the "~" character is the end of a message
-			data, _ := readFromUart.ReadByte()
+func (mb *MsgBroker) PublishFoo(foo FooMsg) {
+	mb.PublishMsg(fooParts(foo))
+}
 
-			if data == TOKEN_ABOUT {
-				break
-			} else {
-				message = append(message, data)
-			}
+func (mb *MsgBroker) PublishRADriver(raDriverMsg RADriverMsg) {
+	mb.PublishMsg(raDriverParts(raDriverMsg))
+}
 
-		}
+func (mb *MsgBroker) PublishRADriverCmd(raDriverCmdMsg RADriverCmdMsg) {
+	mb.SendMsg(ADDR_RA_DRIVER, raDriverCmdParts(raDriverCmdMsg))
+}
 
-		//
-		// At this point we have an entire message, so dispatch it!
-		//
-		msgParts := strings.Split(string(message), "|")
+func (mb *MsgBroker) PublishRACmdSetDirection(direction driver.RaValue) {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_DIRECTION
 
-		mb.DispatchMsgToChannel(msgParts)
+	if direction == driver.RA_DIRECTION_NORTH {
+		raCmdMsg.Args = append(raCmdMsg.Args, string(driver.RA_DIRECTION_NORTH))
+	} else {
+		raCmdMsg.Args = append(raCmdMsg.Args, string(driver.RA_DIRECTION_SOUTH))
+	}
 
-		// Forward message for other potential consumers
-		if forwardToUart != nil {
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
 
-			// rewrap the message to start with ^ and end with ~
-			message = append([]byte{TOKEN_HAT}, message...)
-			message = append(message, TOKEN_ABOUT)
+func (mb *MsgBroker) PublishRACmdSetTracking(tracking driver.RaValue) {
+	var raCmdMsg RADriverCmdMsg
 
-			forwardToUart.Write(message)
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_TRACKING
+	raCmdMsg.Args = append(raCmdMsg.Args, string(tracking))
 
-		}
+	mb.PublishRADriverCmd(raCmdMsg)
 
-	}
 }
 
-func (mb *MsgBroker) DispatchMsgToChannel(msgParts []string) {
+func (mb *MsgBroker) PublishRACmdSetTrackingRate(rate driver.TrackingRate) {
+	var raCmdMsg RADriverCmdMsg
 
-	switch msgParts[0] {
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_TRACKING_RATE
+	raCmdMsg.Args = append(raCmdMsg.Args, string(rate))
 
-	case string(MSG_FOO):
-		fmt.Printf("[DispatchMsgToChannel] - %v\n", MSG_FOO)
-		msg := makeFoo(msgParts)
-		if mb.fooCh != nil {
-			mb.fooCh <- *msg
-		}
-	case string(MSG_HANDSET):
-		fmt.Printf("[DispatchMsgToChannel] - %v\n", MSG_HANDSET)
-		msg := makeHandset(msgParts)
-		if mb.handsetCh != nil {
-			mb.handsetCh <- *msg
-		}
-	case string(MSG_RADRIVER):
-		fmt.Printf("[DispatchMsgToChannel] - %v\n", MSG_RADRIVER)
-		msg := makeRADriver(msgParts)
-		if mb.raDriverCh != nil {
-			mb.raDriverCh <- *msg
-		}
-	case string(MSG_RADRIVER_CMD):
-		fmt.Printf("[DispatchMsgToChannel] - %v\n", MSG_RADRIVER_CMD)
-		msg := makeRADriverCmd(msgParts)
-		if mb.raDriverCmdCh != nil {
-			mb.raDriverCmdCh <- *msg
-		}
-	default:
-		fmt.Println("[DispatchMsgToChannel] - no match found")
-	}
+	mb.PublishRADriverCmd(raCmdMsg)
 
 }
 
-func (mb *MsgBroker) PublishFoo(foo FooMsg) {
+func (mb *MsgBroker) PublishRACmdSetCustomTrackingRate(arcsecPerSecond float64) {
+	var raCmdMsg RADriverCmdMsg
 
-	msgStr := "^" + string(foo.Kind)
-	msgStr = msgStr + "|" + string(foo.Name) + "~"
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_TRACKING_RATE
+	raCmdMsg.Args = append(raCmdMsg.Args, string(driver.TRACKING_RATE_CUSTOM))
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatFloat(arcsecPerSecond, 'f', -1, 64))
 
-	mb.PublishMsg(msgStr)
+	mb.PublishRADriverCmd(raCmdMsg)
 
 }
 
-func (mb *MsgBroker) PublishRADriver(raDriverMsg RADriverMsg) {
+func (mb *MsgBroker) PublishRACmdPECRecord() {
+	var raCmdMsg RADriverCmdMsg
 
-	msgStr := "^" + string(raDriverMsg.Kind)
-	msgStr = msgStr + "|" + fmt.Sprintf("%v", raDriverMsg.Tracking)
-	msgStr = msgStr + "|" + fmt.Sprintf("%v", raDriverMsg.Direction)
-	msgStr = msgStr + "|" + fmt.Sprintf("%v", raDriverMsg.Position) + "~"
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_PEC_RECORD
 
-	mb.PublishMsg(msgStr)
+	mb.PublishRADriverCmd(raCmdMsg)
 
 }
 
-func (mb *MsgBroker) PublishRADriverCmd(raDriverCmdMsg RADriverCmdMsg) {
+// Turn PEC playback "On" or "Off"
+func (mb *MsgBroker) PublishRACmdPECPlayback(playback driver.RaValue) {
+	var raCmdMsg RADriverCmdMsg
 
-	msgStr := "^" + string(raDriverCmdMsg.Kind)
-	msgStr = msgStr + "|" + fmt.Sprintf("%v", raDriverCmdMsg.Cmd)
-	msgStr = msgStr + "|" + strings.Join(raDriverCmdMsg.Args, ",") + "~"
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_PEC_PLAYBACK
+	raCmdMsg.Args = append(raCmdMsg.Args, string(playback))
 
-	mb.PublishMsg(msgStr)
+	mb.PublishRADriverCmd(raCmdMsg)
 
 }
 
-func (mb *MsgBroker) PublishRACmdSetDirection(direction driver.RaValue) {
+func (mb *MsgBroker) PublishRACmdPECClear() {
 	var raCmdMsg RADriverCmdMsg
 
 	raCmdMsg.Kind = MSG_RADRIVER_CMD
-	raCmdMsg.Cmd = RA_CMD_SET_DIRECTION
+	raCmdMsg.Cmd = RA_CMD_PEC_CLEAR
 
-	if direction == driver.RA_DIRECTION_NORTH {
-		raCmdMsg.Args = append(raCmdMsg.Args, string(driver.RA_DIRECTION_NORTH))
-	} else {
-		raCmdMsg.Args = append(raCmdMsg.Args, string(driver.RA_DIRECTION_SOUTH))
-	}
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishRACmdGuide(direction driver.GuideDirection, duration time.Duration) {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_GUIDE
+	raCmdMsg.Args = append(raCmdMsg.Args, string(direction))
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatInt(duration.Milliseconds(), 10))
 
 	mb.PublishRADriverCmd(raCmdMsg)
 
 }
 
-func (mb *MsgBroker) PublishRACmdSetTracking(tracking driver.RaValue) {
+func (mb *MsgBroker) PublishRACmdSetBacklash(counts uint32, hz float64) {
 	var raCmdMsg RADriverCmdMsg
 
 	raCmdMsg.Kind = MSG_RADRIVER_CMD
-	raCmdMsg.Cmd = RA_CMD_SET_TRACKING
-	raCmdMsg.Args = append(raCmdMsg.Args, string(tracking))
+	raCmdMsg.Cmd = RA_CMD_SET_BACKLASH
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatUint(uint64(counts), 10))
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatFloat(hz, 'f', -1, 64))
 
 	mb.PublishRADriverCmd(raCmdMsg)
 
 }
 
-func (mb *MsgBroker) PublishMsg(msg string) {
+func (mb *MsgBroker) PublishRACmdCalibrateBacklash() {
+	var raCmdMsg RADriverCmdMsg
 
-	if mb.uartUp != nil {
-		mb.uartUp.Write([]byte(msg))
-		// Print a new line between messages for readability in the serial monitor
-		mb.uartUp.Write([]byte("\n"))
-	}
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_CAL_BACKLASH
+
+	mb.PublishRADriverCmd(raCmdMsg)
 
-	if mb.uartDn != nil {
-		mb.uartDn.Write([]byte(msg))
-		// Print a new line between messages for readability in the serial monitor
-		mb.uartDn.Write([]byte("\n"))
-	}
 }
 
-func makeFoo(msgParts []string) *FooMsg {
+func (mb *MsgBroker) PublishRACmdSlewTo(position int64) {
+	var raCmdMsg RADriverCmdMsg
 
-	fooMsg := new(FooMsg)
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SLEW_TO
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatInt(position, 10))
 
-	if len(msgParts) > 0 {
-		fooMsg.Kind = MSG_FOO
-	}
-	if len(msgParts) > 1 {
-		fooMsg.Name = msgParts[1]
-	}
+	mb.PublishRADriverCmd(raCmdMsg)
 
-	return fooMsg
 }
 
-func makeHandset(msgParts []string) *HandsetMsg {
+func (mb *MsgBroker) PublishRACmdAbort() {
+	var raCmdMsg RADriverCmdMsg
 
-	handsetMsg := new(HandsetMsg)
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_ABORT
 
-	if len(msgParts) > 0 {
-		handsetMsg.Kind = MSG_HANDSET
-	}
-	if len(msgParts) > 1 {
-		handsetMsg.Keys = msgParts[1:]
-	}
+	mb.PublishRADriverCmd(raCmdMsg)
 
-	return handsetMsg
 }
 
-func makeRADriver(msgParts []string) *RADriverMsg {
+func (mb *MsgBroker) PublishRACmdPark() {
+	var raCmdMsg RADriverCmdMsg
 
-	// DEVTODO - I need a way to make the compiler complain when this does not match the struct
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_PARK
 
-	raDriverMsg := new(RADriverMsg)
+	mb.PublishRADriverCmd(raCmdMsg)
 
-	if len(msgParts) > 0 {
-		raDriverMsg.Kind = MSG_RADRIVER
-	}
+}
 
-	if len(msgParts) > 1 {
-		// index 1 is "On" of "Off"
-		tracking := driver.RaValue(msgParts[1])
-		raDriverMsg.Tracking = tracking
-	}
+func (mb *MsgBroker) PublishRACmdUnpark() {
+	var raCmdMsg RADriverCmdMsg
 
-	if len(msgParts) > 2 {
-		if RADriverCmd(msgParts[2]) == "North" {
-			raDriverMsg.Direction = driver.RA_DIRECTION_NORTH
-		} else {
-			raDriverMsg.Direction = driver.RA_DIRECTION_SOUTH
-		}
-	}
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_UNPARK
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishRACmdHome() {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_HOME
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+// Set the park position in encoder counts
+func (mb *MsgBroker) PublishRACmdSetPark(position int64) {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_PARK
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatInt(position, 10))
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+// The current position becomes the park position
+func (mb *MsgBroker) PublishRACmdSetParkHere() {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_PARK
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+// Set the min and max positions in encoder counts
+func (mb *MsgBroker) PublishRACmdSetLimits(min int64, max int64) {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_LIMITS
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatInt(min, 10))
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatInt(max, 10))
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+// Set the throttle and max stepper driver temperatures in °C
+func (mb *MsgBroker) PublishRACmdSetTempLimits(throttleC float64, maxC float64) {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_SET_TEMP_LIMITS
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatFloat(throttleC, 'f', -1, 64))
+	raCmdMsg.Args = append(raCmdMsg.Args, strconv.FormatFloat(maxC, 'f', -1, 64))
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishRACmdClearAlarm() {
+	var raCmdMsg RADriverCmdMsg
+
+	raCmdMsg.Kind = MSG_RADRIVER_CMD
+	raCmdMsg.Cmd = RA_CMD_CLEAR_ALARM
+
+	mb.PublishRADriverCmd(raCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDEDriver(deDriverMsg DEDriverMsg) {
+	mb.PublishMsg(deDriverParts(deDriverMsg))
+}
+
+func (mb *MsgBroker) PublishDEDriverCmd(deDriverCmdMsg DEDriverCmdMsg) {
+	mb.SendMsg(ADDR_DE_DRIVER, deDriverCmdParts(deDriverCmdMsg))
+}
+
+func (mb *MsgBroker) PublishDECmdSetMotor(motor driver.DeValue) {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SET_MOTOR
+	deCmdMsg.Args = append(deCmdMsg.Args, string(motor))
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
 
-	if len(msgParts) > 3 {
-		p, _ := strconv.Atoi(msgParts[3])
-		raDriverMsg.Position = uint32(p)
+func (mb *MsgBroker) PublishDECmdSetDirection(direction driver.DeValue) {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SET_DIRECTION
+
+	if direction == driver.DE_DIRECTION_NORTH {
+		deCmdMsg.Args = append(deCmdMsg.Args, string(driver.DE_DIRECTION_NORTH))
+	} else {
+		deCmdMsg.Args = append(deCmdMsg.Args, string(driver.DE_DIRECTION_SOUTH))
 	}
 
-	return raDriverMsg
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDECmdSlewTo(position int64) {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SLEW_TO
+	deCmdMsg.Args = append(deCmdMsg.Args, strconv.FormatInt(position, 10))
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDECmdSetBacklash(counts uint32, hz float64) {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SET_BACKLASH
+	deCmdMsg.Args = append(deCmdMsg.Args, strconv.FormatUint(uint64(counts), 10))
+	deCmdMsg.Args = append(deCmdMsg.Args, strconv.FormatFloat(hz, 'f', -1, 64))
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDECmdAbort() {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_ABORT
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDECmdPark() {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_PARK
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDECmdUnpark() {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_UNPARK
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
 }
-func makeRADriverCmd(msgParts []string) *RADriverCmdMsg {
 
-	raDriverCmdMsg := new(RADriverCmdMsg)
+func (mb *MsgBroker) PublishDECmdHome() {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_HOME
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+// Set the park position in encoder counts
+func (mb *MsgBroker) PublishDECmdSetPark(position int64) {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SET_PARK
+	deCmdMsg.Args = append(deCmdMsg.Args, strconv.FormatInt(position, 10))
+
+	mb.PublishDEDriverCmd(deCmdMsg)
 
-	if len(msgParts) > 0 {
-		raDriverCmdMsg.Kind = MSG_RADRIVER_CMD
+}
+
+// The current position becomes the park position
+func (mb *MsgBroker) PublishDECmdSetParkHere() {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SET_PARK
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+// Set the min and max positions in encoder counts
+func (mb *MsgBroker) PublishDECmdSetLimits(min int64, max int64) {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_SET_LIMITS
+	deCmdMsg.Args = append(deCmdMsg.Args, strconv.FormatInt(min, 10))
+	deCmdMsg.Args = append(deCmdMsg.Args, strconv.FormatInt(max, 10))
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishDECmdClearAlarm() {
+	var deCmdMsg DEDriverCmdMsg
+
+	deCmdMsg.Kind = MSG_DEDRIVER_CMD
+	deCmdMsg.Cmd = DE_CMD_CLEAR_ALARM
+
+	mb.PublishDEDriverCmd(deCmdMsg)
+
+}
+
+func (mb *MsgBroker) PublishAlarm(alarmMsg AlarmMsg) {
+	mb.PublishMsg(alarmParts(alarmMsg))
+}
+
+func (mb *MsgBroker) PublishRADriverFault(faultMsg RADriverFaultMsg) {
+	mb.PublishMsg(raDriverFaultParts(faultMsg))
+}
+
+// Publish the message parts, the kind first, to every node
+func (mb *MsgBroker) PublishMsg(msgParts []string) {
+	mb.SendMsg(wire.ADDR_BROADCAST, msgParts)
+}
+
+// Send the message to the node at dst, it goes out both UARTs as this node does not know which
+// side dst is on, the nodes in between pass it on
+func (mb *MsgBroker) SendMsg(dst wire.Address, msgParts []string) {
+
+	mb.routeMu.Lock()
+	header := mb.router.NewHeader(dst)
+	mb.routeMu.Unlock()
+
+	if mb.uartUp != nil {
+		mb.writeMsg(mb.uartUp, mb.wireVersion, header, msgParts)
 	}
-	if len(msgParts) > 1 {
-		raDriverCmdMsg.Cmd = RADriverCmd(msgParts[1])
+
+	if mb.uartDn != nil {
+		mb.writeMsg(mb.uartDn, mb.wireVersion, header, msgParts)
 	}
+}
+
+// Frame the message parts and write them to the UART, a legacy frame has no header
+func (mb *MsgBroker) writeMsg(uart UART, version byte, header wire.Header, msgParts []string) {
+
+	var frame []byte
+	var err error
 
-	if len(msgParts) > 2 {
-		raDriverCmdMsg.Args = strings.Split(msgParts[2], ",")
+	if version == wire.VERSION_LEGACY {
+		frame, err = wire.EncodeLegacy(msgParts)
+	} else {
+		frame, err = wire.Encode(header, msgParts)
+	}
+	if err != nil {
+		fmt.Printf("[writeMsg] - %v message not sent: %v\n", msgParts[0], err)
+		return
 	}
 
-	return raDriverCmdMsg
+	uart.Write(frame)
+
 }
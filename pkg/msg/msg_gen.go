@@ -0,0 +1,385 @@
+// Code generated by msggen from the message structs. DO NOT EDIT.
+
+package msg
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tonygilkerson/astroeq/pkg/driver"
+)
+
+func fooParts(m FooMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, m.Name)
+
+	return msgParts
+}
+
+func makeFoo(msgParts []string) FooMsg {
+
+	var m FooMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Name = msgParts[1]
+	}
+
+	return m
+}
+
+func handsetParts(m HandsetMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, m.Keys...)
+
+	return msgParts
+}
+
+func makeHandset(msgParts []string) HandsetMsg {
+
+	var m HandsetMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Keys = msgParts[1:]
+	}
+
+	return m
+}
+
+func raDriverParts(m RADriverMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, string(m.Tracking))
+	msgParts = append(msgParts, string(m.Direction))
+	msgParts = append(msgParts, strconv.FormatInt(m.Position, 10))
+	msgParts = append(msgParts, strconv.FormatBool(m.Slewing))
+	msgParts = append(msgParts, strconv.FormatFloat(m.SlewProgress, 'f', 1, 64))
+	msgParts = append(msgParts, string(m.TrackingRate))
+	msgParts = append(msgParts, string(m.PEC))
+	msgParts = append(msgParts, strconv.FormatBool(m.Parked))
+	msgParts = append(msgParts, m.DriverStatus)
+	msgParts = append(msgParts, strconv.FormatFloat(m.Temperature, 'f', 1, 64))
+	msgParts = append(msgParts, strconv.FormatBool(m.EncoderHealthy))
+	msgParts = append(msgParts, m.EncoderStats)
+
+	return msgParts
+}
+
+func makeRADriver(msgParts []string) RADriverMsg {
+
+	var m RADriverMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Tracking = driver.RaValue(msgParts[1])
+	}
+
+	if len(msgParts) > 2 {
+		m.Direction = driver.RaValue(msgParts[2])
+	}
+
+	if len(msgParts) > 3 {
+		m.Position, _ = strconv.ParseInt(msgParts[3], 10, 64)
+	}
+
+	if len(msgParts) > 4 {
+		m.Slewing, _ = strconv.ParseBool(msgParts[4])
+	}
+
+	if len(msgParts) > 5 {
+		m.SlewProgress, _ = strconv.ParseFloat(msgParts[5], 64)
+	}
+
+	if len(msgParts) > 6 {
+		m.TrackingRate = driver.TrackingRate(msgParts[6])
+	}
+
+	if len(msgParts) > 7 {
+		m.PEC = driver.PecState(msgParts[7])
+	}
+
+	if len(msgParts) > 8 {
+		m.Parked, _ = strconv.ParseBool(msgParts[8])
+	}
+
+	if len(msgParts) > 9 {
+		m.DriverStatus = msgParts[9]
+	}
+
+	// NaN when it is not sent
+	m.Temperature = math.NaN()
+	if len(msgParts) > 10 {
+		if x, err := strconv.ParseFloat(msgParts[10], 64); err == nil {
+			m.Temperature = x
+		}
+	}
+
+	if len(msgParts) > 11 {
+		m.EncoderHealthy, _ = strconv.ParseBool(msgParts[11])
+	}
+
+	if len(msgParts) > 12 {
+		m.EncoderStats = msgParts[12]
+	}
+
+	return m
+}
+
+func raDriverCmdParts(m RADriverCmdMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, string(m.Cmd))
+	msgParts = append(msgParts, strings.Join(m.Args, ","))
+	if m.Seq != 0 {
+		msgParts = append(msgParts, strconv.FormatUint(uint64(m.Seq), 10))
+	}
+
+	return msgParts
+}
+
+func makeRADriverCmd(msgParts []string) RADriverCmdMsg {
+
+	var m RADriverCmdMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Cmd = RADriverCmd(msgParts[1])
+	}
+
+	if len(msgParts) > 2 {
+		m.Args = strings.Split(msgParts[2], ",")
+	}
+
+	if len(msgParts) > 3 {
+		x, _ := strconv.ParseUint(msgParts[3], 10, 16)
+		m.Seq = uint16(x)
+	}
+
+	return m
+}
+
+func deDriverParts(m DEDriverMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, string(m.Motor))
+	msgParts = append(msgParts, string(m.Direction))
+	msgParts = append(msgParts, strconv.FormatInt(m.Position, 10))
+	msgParts = append(msgParts, strconv.FormatBool(m.Slewing))
+	msgParts = append(msgParts, strconv.FormatFloat(m.SlewProgress, 'f', 1, 64))
+	msgParts = append(msgParts, strconv.FormatBool(m.Parked))
+	msgParts = append(msgParts, m.DriverStatus)
+	msgParts = append(msgParts, strconv.FormatBool(m.EncoderHealthy))
+	msgParts = append(msgParts, m.EncoderStats)
+
+	return msgParts
+}
+
+func makeDEDriver(msgParts []string) DEDriverMsg {
+
+	var m DEDriverMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Motor = driver.DeValue(msgParts[1])
+	}
+
+	if len(msgParts) > 2 {
+		m.Direction = driver.DeValue(msgParts[2])
+	}
+
+	if len(msgParts) > 3 {
+		m.Position, _ = strconv.ParseInt(msgParts[3], 10, 64)
+	}
+
+	if len(msgParts) > 4 {
+		m.Slewing, _ = strconv.ParseBool(msgParts[4])
+	}
+
+	if len(msgParts) > 5 {
+		m.SlewProgress, _ = strconv.ParseFloat(msgParts[5], 64)
+	}
+
+	if len(msgParts) > 6 {
+		m.Parked, _ = strconv.ParseBool(msgParts[6])
+	}
+
+	if len(msgParts) > 7 {
+		m.DriverStatus = msgParts[7]
+	}
+
+	if len(msgParts) > 8 {
+		m.EncoderHealthy, _ = strconv.ParseBool(msgParts[8])
+	}
+
+	if len(msgParts) > 9 {
+		m.EncoderStats = msgParts[9]
+	}
+
+	return m
+}
+
+func deDriverCmdParts(m DEDriverCmdMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, string(m.Cmd))
+	msgParts = append(msgParts, strings.Join(m.Args, ","))
+	if m.Seq != 0 {
+		msgParts = append(msgParts, strconv.FormatUint(uint64(m.Seq), 10))
+	}
+
+	return msgParts
+}
+
+func makeDEDriverCmd(msgParts []string) DEDriverCmdMsg {
+
+	var m DEDriverCmdMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Cmd = DEDriverCmd(msgParts[1])
+	}
+
+	if len(msgParts) > 2 {
+		m.Args = strings.Split(msgParts[2], ",")
+	}
+
+	if len(msgParts) > 3 {
+		x, _ := strconv.ParseUint(msgParts[3], 10, 16)
+		m.Seq = uint16(x)
+	}
+
+	return m
+}
+
+func alarmParts(m AlarmMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, m.Source)
+	msgParts = append(msgParts, string(m.Alarm))
+	msgParts = append(msgParts, strconv.FormatInt(m.Position, 10))
+
+	return msgParts
+}
+
+func makeAlarm(msgParts []string) AlarmMsg {
+
+	var m AlarmMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Source = msgParts[1]
+	}
+
+	if len(msgParts) > 2 {
+		m.Alarm = driver.Alarm(msgParts[2])
+	}
+
+	if len(msgParts) > 3 {
+		m.Position, _ = strconv.ParseInt(msgParts[3], 10, 64)
+	}
+
+	return m
+}
+
+func raDriverFaultParts(m RADriverFaultMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, string(m.Fault))
+	msgParts = append(msgParts, strconv.FormatFloat(m.Expected, 'f', 0, 64))
+	msgParts = append(msgParts, strconv.FormatFloat(m.Measured, 'f', 0, 64))
+	msgParts = append(msgParts, strconv.FormatInt(m.Position, 10))
+
+	return msgParts
+}
+
+func makeRADriverFault(msgParts []string) RADriverFaultMsg {
+
+	var m RADriverFaultMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Fault = driver.Fault(msgParts[1])
+	}
+
+	if len(msgParts) > 2 {
+		m.Expected, _ = strconv.ParseFloat(msgParts[2], 64)
+	}
+
+	if len(msgParts) > 3 {
+		m.Measured, _ = strconv.ParseFloat(msgParts[3], 64)
+	}
+
+	if len(msgParts) > 4 {
+		m.Position, _ = strconv.ParseInt(msgParts[4], 10, 64)
+	}
+
+	return m
+}
+
+func ackParts(m AckMsg) []string {
+
+	msgParts := []string{string(m.Kind)}
+	msgParts = append(msgParts, string(m.Cmd))
+	msgParts = append(msgParts, strconv.FormatUint(uint64(m.Seq), 10))
+	msgParts = append(msgParts, strconv.FormatUint(uint64(m.Code), 10))
+	msgParts = append(msgParts, m.Detail)
+
+	return msgParts
+}
+
+func makeAck(msgParts []string) AckMsg {
+
+	var m AckMsg
+
+	if len(msgParts) > 0 {
+		m.Kind = MsgType(msgParts[0])
+	}
+
+	if len(msgParts) > 1 {
+		m.Cmd = MsgType(msgParts[1])
+	}
+
+	if len(msgParts) > 2 {
+		x, _ := strconv.ParseUint(msgParts[2], 10, 16)
+		m.Seq = uint16(x)
+	}
+
+	if len(msgParts) > 3 {
+		x, _ := strconv.ParseUint(msgParts[3], 10, 8)
+		m.Code = AckCode(x)
+	}
+
+	if len(msgParts) > 4 {
+		m.Detail = msgParts[4]
+	}
+
+	return m
+}
@@ -0,0 +1,223 @@
+// Code generated by msggen from the message structs. DO NOT EDIT.
+
+package msg
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestFooRoundTrip(t *testing.T) {
+
+	want := FooMsg{
+		Kind: MsgType("Foo"),
+		Name: "v1",
+	}
+
+	got := makeFoo(fooParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeFoo([]string{"Foo"})
+	if short.Kind != MsgType("Foo") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestHandsetRoundTrip(t *testing.T) {
+
+	want := HandsetMsg{
+		Kind: MsgType("Handset"),
+		Keys: []string{"a", "b"},
+	}
+
+	got := makeHandset(handsetParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeHandset([]string{"Handset"})
+	if short.Kind != MsgType("Handset") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestRADriverRoundTrip(t *testing.T) {
+
+	want := RADriverMsg{
+		Kind:           MsgType("RADriver"),
+		Tracking:       "v1",
+		Direction:      "v2",
+		Position:       -300,
+		Slewing:        true,
+		SlewProgress:   12.5,
+		TrackingRate:   "v6",
+		PEC:            "v7",
+		Parked:         true,
+		DriverStatus:   "v9",
+		Temperature:    12.5,
+		EncoderHealthy: true,
+		EncoderStats:   "v12",
+	}
+
+	got := makeRADriver(raDriverParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeRADriver([]string{"RADriver"})
+	if short.Kind != MsgType("RADriver") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+	if !math.IsNaN(float64(short.Temperature)) {
+		t.Errorf("short Temperature = %v, want NaN", short.Temperature)
+	}
+
+}
+
+func TestRADriverCmdRoundTrip(t *testing.T) {
+
+	want := RADriverCmdMsg{
+		Kind: MsgType("RADriverCmd"),
+		Cmd:  "v1",
+		Args: []string{"a", "b"},
+		Seq:  3,
+	}
+
+	got := makeRADriverCmd(raDriverCmdParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeRADriverCmd([]string{"RADriverCmd"})
+	if short.Kind != MsgType("RADriverCmd") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestDEDriverRoundTrip(t *testing.T) {
+
+	want := DEDriverMsg{
+		Kind:           MsgType("DEDriver"),
+		Motor:          "v1",
+		Direction:      "v2",
+		Position:       -300,
+		Slewing:        true,
+		SlewProgress:   12.5,
+		Parked:         true,
+		DriverStatus:   "v7",
+		EncoderHealthy: true,
+		EncoderStats:   "v9",
+	}
+
+	got := makeDEDriver(deDriverParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeDEDriver([]string{"DEDriver"})
+	if short.Kind != MsgType("DEDriver") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestDEDriverCmdRoundTrip(t *testing.T) {
+
+	want := DEDriverCmdMsg{
+		Kind: MsgType("DEDriverCmd"),
+		Cmd:  "v1",
+		Args: []string{"a", "b"},
+		Seq:  3,
+	}
+
+	got := makeDEDriverCmd(deDriverCmdParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeDEDriverCmd([]string{"DEDriverCmd"})
+	if short.Kind != MsgType("DEDriverCmd") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestAlarmRoundTrip(t *testing.T) {
+
+	want := AlarmMsg{
+		Kind:     MsgType("Alarm"),
+		Source:   "v1",
+		Alarm:    "v2",
+		Position: -300,
+	}
+
+	got := makeAlarm(alarmParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeAlarm([]string{"Alarm"})
+	if short.Kind != MsgType("Alarm") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestRADriverFaultRoundTrip(t *testing.T) {
+
+	want := RADriverFaultMsg{
+		Kind:     MsgType("RADriverFault"),
+		Fault:    "v1",
+		Expected: 12,
+		Measured: 12,
+		Position: -400,
+	}
+
+	got := makeRADriverFault(raDriverFaultParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeRADriverFault([]string{"RADriverFault"})
+	if short.Kind != MsgType("RADriverFault") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
+
+func TestAckRoundTrip(t *testing.T) {
+
+	want := AckMsg{
+		Kind:   MsgType("Ack"),
+		Cmd:    "v1",
+		Seq:    2,
+		Code:   3,
+		Detail: "v4",
+	}
+
+	got := makeAck(ackParts(want))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+
+	// A message cut short is read as far as it goes
+	short := makeAck([]string{"Ack"})
+	if short.Kind != MsgType("Ack") {
+		t.Errorf("short Kind = %v", short.Kind)
+	}
+
+}
@@ -0,0 +1,173 @@
+package msg
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/tonygilkerson/astroeq/pkg/msg/wire"
+)
+
+// The messages are read by nodes on older firmware, the parts must not change with the codecs
+func TestParts(t *testing.T) {
+
+	ra := RADriverMsg{
+		Kind:           MSG_RADRIVER,
+		Tracking:       "On",
+		Direction:      "North",
+		Position:       12345,
+		Slewing:        true,
+		SlewProgress:   42.5,
+		TrackingRate:   "Lunar",
+		PEC:            "Playback",
+		DriverStatus:   "OK",
+		Temperature:    38.5,
+		EncoderHealthy: false,
+		EncoderStats:   "980,31,0,31,7,7",
+	}
+	noSensor := ra
+	noSensor.Temperature = math.NaN()
+
+	tests := []struct {
+		name  string
+		parts []string
+		want  []string
+	}{
+		{"RADriver", raDriverParts(ra), []string{"RADriver", "On", "North", "12345", "true", "42.5", "Lunar", "Playback", "false", "OK", "38.5", "false", "980,31,0,31,7,7"}},
+		{"RADriver no sensor", raDriverParts(noSensor)[10:11], []string{"NaN"}},
+		{"RADriverCmd", raDriverCmdParts(RADriverCmdMsg{Kind: MSG_RADRIVER_CMD, Cmd: RA_CMD_ABORT}), []string{"RADriverCmd", "Abort", ""}},
+		{"RADriverCmd seq", raDriverCmdParts(RADriverCmdMsg{Kind: MSG_RADRIVER_CMD, Cmd: RA_CMD_SET_LIMITS, Args: []string{"1000", "7000000"}, Seq: 17, From: ADDR_HANDSET}), []string{"RADriverCmd", "SetLimits", "1000,7000000", "17"}},
+		{"RADriverFault", raDriverFaultParts(RADriverFaultMsg{Kind: MSG_RADRIVER_FAULT, Fault: "Stall", Expected: 64.4, Measured: 2, Position: 123456}), []string{"RADriverFault", "Stall", "64", "2", "123456"}},
+		{"Handset", handsetParts(HandsetMsg{Kind: MSG_HANDSET, Keys: []string{"Up", "Enter"}}), []string{"Handset", "Up", "Enter"}},
+		{"Ack", ackParts(AckMsg{Kind: MSG_NACK, Cmd: MSG_RADRIVER_CMD, Seq: 18, Code: NACK_BAD_ARGS, Detail: "bad slew target: [abc]"}), []string{"Nack", "RADriverCmd", "18", "2", "bad slew target: [abc]"}},
+	}
+
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.parts, test.want) {
+			t.Errorf("%v: parts = %q, want %q", test.name, test.parts, test.want)
+		}
+	}
+
+}
+
+func TestMakeLegacy(t *testing.T) {
+
+	// A driver on older firmware sends no temperature, encoder or sequence number
+	ra := makeRADriver([]string{"RADriver", "On", "North", "12345", "false", "0.0", "Sidereal", "Off", "false", ""})
+	if ra.Position != 12345 || ra.TrackingRate != "Sidereal" || !math.IsNaN(ra.Temperature) || ra.EncoderHealthy {
+		t.Errorf("makeRADriver = %+v", ra)
+	}
+
+	cmd := makeRADriverCmd([]string{"RADriverCmd", "SetTracking", "On"})
+	if cmd.Cmd != RA_CMD_SET_TRACKING || !reflect.DeepEqual(cmd.Args, []string{"On"}) || cmd.Seq != 0 {
+		t.Errorf("makeRADriverCmd = %+v", cmd)
+	}
+
+}
+
+// A UART that reads back what it is given and keeps what is written
+type testUART struct {
+	rx []byte
+	tx []byte
+}
+
+func (u *testUART) Configure(config UARTConfig) error {
+	return nil
+}
+
+func (u *testUART) Buffered() int {
+	return len(u.rx)
+}
+
+func (u *testUART) ReadByte() (byte, error) {
+	b := u.rx[0]
+	u.rx = u.rx[1:]
+	return b, nil
+}
+
+func (u *testUART) Write(data []byte) (n int, err error) {
+	u.tx = append(u.tx, data...)
+	return len(data), nil
+}
+
+// Returns the messages in what was written, and the decoder counts
+func decodeAll(data []byte) ([]wire.Message, wire.DecoderStats) {
+
+	decoder := wire.NewDecoder()
+	var messages []wire.Message
+	for _, b := range data {
+		if m, ok := decoder.Feed(b); ok {
+			messages = append(messages, m)
+		}
+	}
+	return messages, decoder.GetStats()
+}
+
+func TestPublishFrames(t *testing.T) {
+
+	up := &testUART{}
+	mb, _ := NewBroker(up, 0, 0, nil, 0, 0)
+
+	// Nothing is written between the frames, a reader skips no bytes
+	mb.PublishFoo(FooMsg{Kind: MSG_FOO, Name: "foo"})
+	mb.PublishFoo(FooMsg{Kind: MSG_FOO, Name: "bar"})
+	messages, stats := decodeAll(up.tx)
+	if len(messages) != 2 || stats.SkippedBytes != 0 {
+		t.Errorf("%v messages, %v bytes skipped, want 2 messages and none skipped", len(messages), stats.SkippedBytes)
+	}
+
+}
+
+func TestForwardLegacy(t *testing.T) {
+
+	frame, _ := wire.EncodeLegacy(fooParts(FooMsg{Kind: MSG_FOO, Name: "foo"}))
+
+	// Handset on the old firmware, then the RA and DEC drivers, the DEC driver is two hops away
+	raUp := &testUART{rx: frame}
+	raDn := &testUART{}
+	ra, _ := NewBroker(raUp, 0, 0, raDn, 0, 0)
+	ra.SetAddress(ADDR_RA_DRIVER)
+	ra.uartReader(raUp, raDn, ra.upDecoder)
+
+	deUp := &testUART{rx: raDn.tx}
+	deDn := &testUART{}
+	de, _ := NewBroker(deUp, 0, 0, deDn, 0, 0)
+	de.SetAddress(ADDR_DE_DRIVER)
+	ch, _ := Subscribe[FooMsg](&de, MSG_FOO, 1)
+	de.uartReader(deUp, deDn, de.upDecoder)
+
+	if len(ch) != 1 {
+		t.Error("the legacy message did not reach the DEC driver")
+	}
+	messages, _ := decodeAll(deDn.tx)
+	if len(messages) != 1 || messages[0].Version != wire.VERSION_LEGACY {
+		t.Errorf("forwarded %+v, want one legacy message", messages)
+	}
+
+	// A copy that came round a ring is not passed on again
+	raUp.rx = frame
+	raDn.tx = nil
+	ra.uartReader(raUp, raDn, ra.upDecoder)
+	if len(raDn.tx) != 0 {
+		t.Errorf("the copy was forwarded: %q", raDn.tx)
+	}
+
+}
+
+func TestForwardWireVersion(t *testing.T) {
+
+	frame, _ := wire.Encode(wire.Header{Src: ADDR_HANDSET, Dst: wire.ADDR_BROADCAST, TTL: wire.DEFAULT_TTL, ID: 1}, fooParts(FooMsg{Kind: MSG_FOO, Name: "foo"}))
+	up := &testUART{rx: frame}
+	dn := &testUART{}
+	mb, _ := NewBroker(up, 0, 0, dn, 0, 0)
+	mb.SetAddress(ADDR_RA_DRIVER)
+
+	// With nodes on the old firmware next to it, the node passes messages on in the legacy framing
+	mb.SetWireVersion(wire.VERSION_LEGACY)
+	mb.uartReader(up, dn, mb.upDecoder)
+	messages, _ := decodeAll(dn.tx)
+	if len(messages) != 1 || messages[0].Version != wire.VERSION_LEGACY {
+		t.Errorf("forwarded %+v, want one legacy message", messages)
+	}
+
+}
@@ -0,0 +1,238 @@
+package msg
+
+import (
+	"fmt"
+
+	"github.com/tonygilkerson/astroeq/pkg/msg/wire"
+)
+
+// Message registry
+//
+// Each message kind registers a Codec, how its message is turned into parts and back. Any
+// number of consumers Subscribe to a kind, each with its own buffered channel. A message is
+// never waited on, when a subscriber's channel is full the message is dropped for that
+// subscriber and counted, so a slow consumer can not hold up the UART reader.
+//
+// A new message kind needs its struct in MsgInterface, its MSG_ constant and a Register call in
+// init below, go generate writes its Codec functions.
+
+// A good buffer for most subscribers, a status message comes every few seconds
+const SUBSCRIBE_BUFFER = 4
+
+// How a message kind is sent and read, the parts are the kind first then its fields
+type Codec[T any] struct {
+	Encode func(m T) []string
+	Decode func(msgParts []string) T
+}
+
+// A registered Codec with the message type hidden
+type registration struct {
+	encode func(m any) ([]string, bool)
+	decode func(msgParts []string) any
+	typeOf func(m any) bool
+}
+
+// The message kinds, registered in init
+var codecs = map[MsgType]registration{}
+
+// Implemented by messages that carry the node they came from, which is not in the parts
+type addressed interface {
+	withFrom(from wire.Address) any
+}
+
+func (m RADriverCmdMsg) withFrom(from wire.Address) any {
+	m.From = from
+	return m
+}
+
+func (m DEDriverCmdMsg) withFrom(from wire.Address) any {
+	m.From = from
+	return m
+}
+
+type subscriber struct {
+	kind      MsgType
+	ch        any
+	send      func(m any) bool
+	delivered uint32
+	dropped   uint32
+}
+
+// The counts for one subscriber
+type SubscriptionStats struct {
+	Kind      MsgType
+	Delivered uint32
+	Dropped   uint32
+}
+
+func init() {
+
+	Register(MSG_FOO, Codec[FooMsg]{Encode: fooParts, Decode: makeFoo})
+	Register(MSG_HANDSET, Codec[HandsetMsg]{Encode: handsetParts, Decode: makeHandset})
+	Register(MSG_RADRIVER, Codec[RADriverMsg]{Encode: raDriverParts, Decode: makeRADriver})
+	Register(MSG_RADRIVER_CMD, Codec[RADriverCmdMsg]{Encode: raDriverCmdParts, Decode: makeRADriverCmd})
+	Register(MSG_DEDRIVER, Codec[DEDriverMsg]{Encode: deDriverParts, Decode: makeDEDriver})
+	Register(MSG_DEDRIVER_CMD, Codec[DEDriverCmdMsg]{Encode: deDriverCmdParts, Decode: makeDEDriverCmd})
+	Register(MSG_ALARM, Codec[AlarmMsg]{Encode: alarmParts, Decode: makeAlarm})
+	Register(MSG_RADRIVER_FAULT, Codec[RADriverFaultMsg]{Encode: raDriverFaultParts, Decode: makeRADriverFault})
+	Register(MSG_ACK, Codec[AckMsg]{Encode: ackParts, Decode: makeAck})
+	Register(MSG_NACK, Codec[AckMsg]{Encode: ackParts, Decode: makeAck})
+
+}
+
+// Register the codec for a message kind, a kind is registered once
+func Register[T any](kind MsgType, codec Codec[T]) error {
+
+	if _, ok := codecs[kind]; ok {
+		return fmt.Errorf("message kind already registered: %v", kind)
+	}
+	if codec.Encode == nil || codec.Decode == nil {
+		return fmt.Errorf("message kind %v needs an Encode and Decode", kind)
+	}
+
+	codecs[kind] = registration{
+		encode: func(m any) ([]string, bool) {
+			t, ok := m.(T)
+			if !ok {
+				return nil, false
+			}
+			return codec.Encode(t), true
+		},
+		decode: func(msgParts []string) any {
+			return codec.Decode(msgParts)
+		},
+		typeOf: func(m any) bool {
+			_, ok := m.(T)
+			return ok
+		},
+	}
+
+	return nil
+}
+
+// Returns a channel the kind's messages are sent to, buffered for size messages
+//
+// T must be the message type the kind is registered with, for example
+//
+//	raDriverCh, err := msg.Subscribe[msg.RADriverMsg](&mb, msg.MSG_RADRIVER, msg.SUBSCRIBE_BUFFER)
+func Subscribe[T any](mb *MsgBroker, kind MsgType, size int) (chan T, error) {
+
+	reg, ok := codecs[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown message kind: %v", kind)
+	}
+
+	var zero T
+	if !reg.typeOf(zero) {
+		return nil, fmt.Errorf("%v messages are not %T", kind, zero)
+	}
+
+	ch := make(chan T, size)
+	sub := &subscriber{
+		kind: kind,
+		ch:   ch,
+		send: func(m any) bool {
+			select {
+			case ch <- m.(T):
+				return true
+			default:
+				return false
+			}
+		},
+	}
+
+	mb.subMu.Lock()
+	mb.subscribers = append(mb.subscribers, sub)
+	mb.subMu.Unlock()
+
+	return ch, nil
+}
+
+// Stop sending to a channel from Subscribe and close it
+func Unsubscribe[T any](mb *MsgBroker, ch chan T) {
+
+	mb.subMu.Lock()
+	defer mb.subMu.Unlock()
+
+	for i, sub := range mb.subscribers {
+		if sub.ch == any(ch) {
+			mb.subscribers = append(mb.subscribers[:i], mb.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+
+}
+
+// Publish a message of a registered kind to every node
+func Publish[T any](mb *MsgBroker, kind MsgType, m T) error {
+
+	reg, ok := codecs[kind]
+	if !ok {
+		return fmt.Errorf("unknown message kind: %v", kind)
+	}
+
+	msgParts, ok := reg.encode(m)
+	if !ok {
+		return fmt.Errorf("%v messages are not %T", kind, m)
+	}
+
+	mb.PublishMsg(msgParts)
+	return nil
+}
+
+// Returns the counts for each subscriber in the order they subscribed
+func (mb *MsgBroker) GetSubscriptionStats() []SubscriptionStats {
+
+	mb.subMu.Lock()
+	defer mb.subMu.Unlock()
+
+	stats := make([]SubscriptionStats, 0, len(mb.subscribers))
+	for _, sub := range mb.subscribers {
+		stats = append(stats, SubscriptionStats{Kind: sub.kind, Delivered: sub.delivered, Dropped: sub.dropped})
+	}
+	return stats
+}
+
+// Send the message to each subscriber of its kind, from is the node it came from
+func (mb *MsgBroker) DispatchMsgToChannel(from wire.Address, msgParts []string) {
+
+	if len(msgParts) == 0 {
+		fmt.Println("[DispatchMsgToChannel] - empty message")
+		return
+	}
+
+	kind := MsgType(msgParts[0])
+	reg, ok := codecs[kind]
+	if !ok {
+		fmt.Printf("[DispatchMsgToChannel] - no match found for [%v]\n", kind)
+		return
+	}
+	fmt.Printf("[DispatchMsgToChannel] - %v\n", kind)
+
+	message := reg.decode(msgParts)
+	if a, ok := message.(addressed); ok {
+		message = a.withFrom(from)
+	}
+
+	// A reply also goes to the request waiting for it
+	if ack, ok := message.(AckMsg); ok {
+		mb.deliverAck(ack)
+	}
+
+	mb.subMu.Lock()
+	defer mb.subMu.Unlock()
+
+	for _, sub := range mb.subscribers {
+		if sub.kind != kind {
+			continue
+		}
+		if sub.send(message) {
+			sub.delivered++
+		} else {
+			sub.dropped++
+			fmt.Printf("[DispatchMsgToChannel] - %v subscriber is full, message dropped\n", kind)
+		}
+	}
+
+}
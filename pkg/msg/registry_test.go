@@ -0,0 +1,142 @@
+package msg
+
+import (
+	"sync"
+	"testing"
+)
+
+// A message kind only the tests know
+const MSG_TEST MsgType = "Test"
+
+type testMsg struct {
+	Kind MsgType
+	Name string
+}
+
+// Register MSG_TEST, it is taken out again when the test ends
+func registerTestKind(t *testing.T) {
+
+	codec := Codec[testMsg]{
+		Encode: func(m testMsg) []string { return []string{string(m.Kind), m.Name} },
+		Decode: func(msgParts []string) testMsg { return testMsg{Kind: MsgType(msgParts[0]), Name: msgParts[1]} },
+	}
+	if err := Register(MSG_TEST, codec); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	t.Cleanup(func() { delete(codecs, MSG_TEST) })
+
+	if err := Register(MSG_TEST, codec); err == nil {
+		t.Error("a kind registered twice should fail")
+	}
+
+}
+
+func TestRegister(t *testing.T) {
+
+	if err := Register(MSG_TEST, Codec[testMsg]{}); err == nil {
+		t.Error("Register with no Encode or Decode should fail")
+	}
+
+	registerTestKind(t)
+
+	mb := newTestBroker(t)
+	ch, err := Subscribe[testMsg](mb, MSG_TEST, 1)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	mb.DispatchMsgToChannel(ADDR_HANDSET, []string{"Test", "foo"})
+	if m := <-ch; m.Name != "foo" {
+		t.Errorf("got %+v, want foo", m)
+	}
+
+	// A channel of the wrong type is refused
+	if _, err := Subscribe[FooMsg](mb, MSG_TEST, 1); err == nil {
+		t.Error("Subscribe with the wrong message type should fail")
+	}
+
+	// After Unsubscribe the channel is closed and no longer sent to
+	Unsubscribe(mb, ch)
+	if _, ok := <-ch; ok {
+		t.Error("the channel is still open after Unsubscribe")
+	}
+	mb.DispatchMsgToChannel(ADDR_HANDSET, []string{"Test", "bar"})
+	if stats := mb.GetSubscriptionStats(); len(stats) != 0 {
+		t.Errorf("stats = %+v after Unsubscribe, want none", stats)
+	}
+
+}
+
+func TestUnregisteredKind(t *testing.T) {
+
+	mb := newTestBroker(t)
+
+	if _, err := Subscribe[testMsg](mb, "NotAKind", 1); err == nil {
+		t.Error("Subscribe to an unregistered kind should fail")
+	}
+	if err := Publish(mb, "NotAKind", testMsg{}); err == nil {
+		t.Error("Publish of an unregistered kind should fail")
+	}
+
+	// Read off the bus it is dropped
+	mb.DispatchMsgToChannel(ADDR_HANDSET, []string{"NotAKind", "foo"})
+
+}
+
+func TestFullSubscriber(t *testing.T) {
+
+	registerTestKind(t)
+	mb := newTestBroker(t)
+
+	slow, _ := Subscribe[testMsg](mb, MSG_TEST, 1)
+	fast, _ := Subscribe[testMsg](mb, MSG_TEST, 4)
+
+	// The slow subscriber is full after the first, the other still gets all three
+	for _, name := range []string{"a", "b", "c"} {
+		mb.DispatchMsgToChannel(ADDR_HANDSET, []string{"Test", name})
+	}
+
+	if len(slow) != 1 || len(fast) != 3 {
+		t.Errorf("slow has %v messages, fast %v, want 1 and 3", len(slow), len(fast))
+	}
+	if m := <-slow; m.Name != "a" {
+		t.Errorf("slow got %v first, want a", m.Name)
+	}
+
+	stats := mb.GetSubscriptionStats()
+	want := []SubscriptionStats{
+		{Kind: MSG_TEST, Delivered: 1, Dropped: 2},
+		{Kind: MSG_TEST, Delivered: 3, Dropped: 0},
+	}
+	if len(stats) != 2 || stats[0] != want[0] || stats[1] != want[1] {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+}
+
+func TestUnsubscribeDuringDelivery(t *testing.T) {
+
+	registerTestKind(t)
+	mb := newTestBroker(t)
+
+	// A channel closed by Unsubscribe is never sent to, the race detector checks the rest
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		ch, _ := Subscribe[testMsg](mb, MSG_TEST, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Unsubscribe(mb, ch)
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		mb.DispatchMsgToChannel(ADDR_HANDSET, []string{"Test", "foo"})
+	}
+	wg.Wait()
+
+	if stats := mb.GetSubscriptionStats(); len(stats) != 0 {
+		t.Errorf("%v subscribers left, want none", len(stats))
+	}
+
+}
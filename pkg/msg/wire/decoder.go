@@ -0,0 +1,232 @@
+package wire
+
+import (
+	"strings"
+)
+
+type decoderState int
+
+const (
+	STATE_IDLE decoderState = iota
+	STATE_LEGACY
+	STATE_HEADER
+	STATE_PAYLOAD
+	STATE_CRC
+)
+
+// Counts kept by a Decoder
+type DecoderStats struct {
+	Messages     uint32 // Version 2 messages decoded
+	Legacy       uint32 // Legacy messages decoded
+	CRCErrors    uint32 // Version 2 frames with a bad CRC
+	BadFrames    uint32 // Frames dropped for a bad version, length or payload, or cut short by a new frame
+	SkippedBytes uint32 // Bytes outside a frame
+}
+
+// An incremental decoder for both framings, bytes are fed in as they arrive
+//
+// Bytes outside a frame are skipped. A FRAME_START or ^ inside a frame starts a new frame,
+// so after line noise the decoder picks up again at the next frame.
+type Decoder struct {
+	state   decoderState
+	escaped bool
+
+	// The version 2 frame so far, the version, routing header and length, the payload and the CRC
+	header  []byte
+	payload []byte
+	crc     []byte
+	length  int
+
+	// The legacy message so far
+	legacy []byte
+
+	stats DecoderStats
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Returns the decoder counts
+func (d *Decoder) GetStats() DecoderStats {
+	return d.stats
+}
+
+// Drop any frame in progress
+func (d *Decoder) Reset() {
+	d.state = STATE_IDLE
+	d.escaped = false
+}
+
+// Feed one byte, returns the message and true when the byte completes one
+func (d *Decoder) Feed(b byte) (Message, bool) {
+
+	//
+	// A start byte always starts a new frame, a frame in progress is dropped
+	//
+	if b == FRAME_START || (b == LEGACY_START && d.state != STATE_IDLE && d.state != STATE_LEGACY) {
+		d.dropFrame()
+	}
+
+	switch d.state {
+
+	case STATE_IDLE:
+		switch b {
+		case FRAME_START:
+			d.startFrame()
+		case LEGACY_START:
+			d.state = STATE_LEGACY
+			d.legacy = d.legacy[:0]
+		default:
+			d.stats.SkippedBytes++
+		}
+
+	case STATE_LEGACY:
+		return d.feedLegacy(b)
+
+	default:
+		return d.feedFrame(b)
+	}
+
+	return Message{}, false
+}
+
+// Feed a byte of a legacy ^...~ message
+func (d *Decoder) feedLegacy(b byte) (Message, bool) {
+
+	switch {
+	case b == LEGACY_END:
+		d.state = STATE_IDLE
+		d.stats.Legacy++
+		header := Header{Src: ADDR_NONE, Dst: ADDR_BROADCAST}
+		return Message{Version: VERSION_LEGACY, Header: header, Parts: strings.Split(string(d.legacy), string(LEGACY_SEP))}, true
+
+	case b == LEGACY_START:
+		// A new message, the one so far was cut short
+		d.stats.BadFrames++
+		d.legacy = d.legacy[:0]
+
+	case len(d.legacy) >= MAX_LEGACY_SIZE:
+		d.stats.BadFrames++
+		d.state = STATE_IDLE
+
+	default:
+		d.legacy = append(d.legacy, b)
+	}
+
+	return Message{}, false
+}
+
+// Feed a byte of a version 2 frame
+func (d *Decoder) feedFrame(b byte) (Message, bool) {
+
+	// Unescape
+	if d.escaped {
+		d.escaped = false
+		b ^= FRAME_XOR
+	} else if b == FRAME_ESCAPE {
+		d.escaped = true
+		return Message{}, false
+	} else if b == LEGACY_START || b == LEGACY_END {
+		// These are always escaped inside a frame
+		d.dropFrame()
+		return Message{}, false
+	}
+
+	switch d.state {
+
+	case STATE_HEADER:
+		d.header = append(d.header, b)
+		if d.header[0] != VERSION_2 {
+			d.dropFrame()
+			return Message{}, false
+		}
+		if len(d.header) < HEADER_SIZE {
+			return Message{}, false
+		}
+		d.length = int(d.header[6])<<8 | int(d.header[7])
+		if d.length > MAX_PAYLOAD_SIZE {
+			d.dropFrame()
+			return Message{}, false
+		}
+		d.state = STATE_PAYLOAD
+		if d.length == 0 {
+			d.state = STATE_CRC
+		}
+
+	case STATE_PAYLOAD:
+		d.payload = append(d.payload, b)
+		if len(d.payload) == d.length {
+			d.state = STATE_CRC
+		}
+
+	case STATE_CRC:
+		d.crc = append(d.crc, b)
+		if len(d.crc) < 2 {
+			return Message{}, false
+		}
+		d.state = STATE_IDLE
+
+		crc := CRC16(append(d.header, d.payload...))
+		if uint16(d.crc[0])<<8|uint16(d.crc[1]) != crc {
+			d.stats.CRCErrors++
+			return Message{}, false
+		}
+
+		parts, ok := splitPayload(d.payload)
+		if !ok {
+			d.stats.BadFrames++
+			return Message{}, false
+		}
+
+		header := Header{
+			Src: Address(d.header[1]),
+			Dst: Address(d.header[2]),
+			TTL: d.header[3],
+			ID:  uint16(d.header[4])<<8 | uint16(d.header[5]),
+		}
+
+		d.stats.Messages++
+		return Message{Version: VERSION_2, Header: header, Parts: parts}, true
+	}
+
+	return Message{}, false
+}
+
+func (d *Decoder) startFrame() {
+
+	d.state = STATE_HEADER
+	d.escaped = false
+	d.header = d.header[:0]
+	d.payload = d.payload[:0]
+	d.crc = d.crc[:0]
+
+}
+
+// Drop the frame in progress, if any
+func (d *Decoder) dropFrame() {
+
+	if d.state != STATE_IDLE {
+		d.stats.BadFrames++
+	}
+	d.state = STATE_IDLE
+	d.escaped = false
+
+}
+
+// Returns the parts of a payload, false if the part lengths do not add up
+func splitPayload(payload []byte) ([]string, bool) {
+
+	parts := make([]string, 0, 8)
+	for i := 0; i < len(payload); {
+		n := int(payload[i])
+		i++
+		if i+n > len(payload) {
+			return nil, false
+		}
+		parts = append(parts, string(payload[i:i+n]))
+		i += n
+	}
+
+	return parts, true
+}
@@ -0,0 +1,175 @@
+package wire
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// A Router remembers the last DEDUPE_SIZE messages for DEDUPE_WINDOW to drop a second copy
+//
+// A copy going round the bus is back in well under the window, a node that restarts counts
+// its ids from the start again so they are forgotten before it is back on the bus
+const (
+	DEDUPE_SIZE   = 32
+	DEDUPE_WINDOW = time.Second * 2
+)
+
+// How long a legacy message is remembered by its content, long enough for a copy to come round
+// a ring of a few nodes and short enough that a key pressed again is not taken for a copy
+const LEGACY_DEDUPE_WINDOW = time.Second
+
+// Counts kept by a Router
+type RouterStats struct {
+	Delivered  uint32 // Messages for this node
+	Forwarded  uint32 // Messages passed on to the next node
+	Duplicates uint32 // Second copies dropped
+	Looped     uint32 // Messages from this node that came back
+	Expired    uint32 // Messages not passed on because they ran out of hops
+}
+
+type seenMessage struct {
+	src  Address
+	id   uint16
+	time time.Time
+}
+
+// Decides what a node does with each message it reads off the bus
+//
+// The nodes are in a line, each passes a message on to the next one out the other UART, so
+// every node sees a broadcast. A message for one node is not passed on by it. A node never
+// reads its own message back, reads a message twice or passes one on once its hops run out,
+// so a message can not go round the bus for ever when the line is wired in a ring.
+//
+// A legacy message has no header, it is read and passed on in the legacy framing as before. With
+// no source or id it is known by its content, a copy that comes back round a ring inside
+// LEGACY_DEDUPE_WINDOW is dropped, so is the same message sent twice that quickly.
+type Router struct {
+	addr   Address
+	nextID uint16
+	clock  hal.Clock
+
+	seen     [DEDUPE_SIZE]seenMessage
+	seenNext int
+	seenLen  int
+
+	stats RouterStats
+}
+
+// Returns a router for the node at addr, ADDR_NONE for a node with no address
+func NewRouter(addr Address) (*Router, error) {
+
+	if addr == ADDR_BROADCAST {
+		return nil, errors.New("a node can not have the broadcast address")
+	}
+
+	return &Router{addr: addr, clock: hal.SystemClock{}}, nil
+}
+
+// Use a fake clock in tests
+func (r *Router) SetClock(clock hal.Clock) {
+	r.clock = clock
+}
+
+func (r *Router) GetAddress() Address {
+	return r.addr
+}
+
+// Returns the router counts
+func (r *Router) GetStats() RouterStats {
+	return r.stats
+}
+
+// Returns the header for a new message from this node to dst
+func (r *Router) NewHeader(dst Address) Header {
+
+	r.nextID++
+	return Header{Src: r.addr, Dst: dst, TTL: DEFAULT_TTL, ID: r.nextID}
+}
+
+// Returns if the message is for this node and if it is passed on, with the header to pass it on with
+func (r *Router) Route(m Message) (deliver bool, forward bool, next Header) {
+
+	if m.Version == VERSION_LEGACY {
+		h := Header{Src: ADDR_NONE, Dst: ADDR_BROADCAST, ID: legacyID(m.Parts)}
+		if r.isSeenWithin(h, LEGACY_DEDUPE_WINDOW) {
+			r.stats.Duplicates++
+			return false, false, h
+		}
+		r.remember(h)
+
+		r.stats.Delivered++
+		r.stats.Forwarded++
+		return true, true, h
+	}
+
+	h := m.Header
+
+	if r.addr != ADDR_NONE && h.Src == r.addr {
+		r.stats.Looped++
+		return false, false, h
+	}
+
+	// Ids are counted per node, a node with no address can not be told apart from another
+	if h.Src != ADDR_NONE {
+		if r.isSeen(h) {
+			r.stats.Duplicates++
+			return false, false, h
+		}
+		r.remember(h)
+	}
+
+	deliver = h.Dst == ADDR_BROADCAST || (h.Dst == r.addr && r.addr != ADDR_NONE)
+	if deliver {
+		r.stats.Delivered++
+	}
+
+	// A message for this node stops here
+	if h.Dst == r.addr && r.addr != ADDR_NONE {
+		return deliver, false, h
+	}
+
+	if h.TTL <= 1 {
+		r.stats.Expired++
+		return deliver, false, h
+	}
+
+	next = h
+	next.TTL--
+	r.stats.Forwarded++
+	return deliver, true, next
+}
+
+func (r *Router) isSeen(h Header) bool {
+	return r.isSeenWithin(h, DEDUPE_WINDOW)
+}
+
+func (r *Router) isSeenWithin(h Header, window time.Duration) bool {
+
+	now := r.clock.Now()
+	for i := 0; i < r.seenLen; i++ {
+		if r.seen[i].src == h.Src && r.seen[i].id == h.ID && now.Sub(r.seen[i].time) < window {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the id a legacy message is remembered by, ADDR_NONE is never remembered for a version 2
+// message so the ids can not be mixed up
+func legacyID(parts []string) uint16 {
+	return CRC16([]byte(strings.Join(parts, string(LEGACY_SEP))))
+}
+
+// Remember the message, the oldest is forgotten when full
+func (r *Router) remember(h Header) {
+
+	r.seen[r.seenNext] = seenMessage{src: h.Src, id: h.ID, time: r.clock.Now()}
+	r.seenNext = (r.seenNext + 1) % DEDUPE_SIZE
+	if r.seenLen < DEDUPE_SIZE {
+		r.seenLen++
+	}
+
+}
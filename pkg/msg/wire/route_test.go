@@ -0,0 +1,90 @@
+package wire
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+func TestRoute(t *testing.T) {
+
+	const (
+		handset  Address = 1
+		raDriver Address = 3
+		deDriver Address = 4
+	)
+
+	r, err := NewRouter(raDriver)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	clock := hal.NewFakeClock(time.Now())
+	r.SetClock(clock)
+
+	message := func(src Address, dst Address, ttl byte, id uint16) Message {
+		return Message{Version: VERSION_2, Header: Header{Src: src, Dst: dst, TTL: ttl, ID: id}}
+	}
+
+	tests := []struct {
+		name    string
+		message Message
+		deliver bool
+		forward bool
+	}{
+		{"broadcast", message(handset, ADDR_BROADCAST, DEFAULT_TTL, 1), true, true},
+		{"a second copy", message(handset, ADDR_BROADCAST, DEFAULT_TTL, 1), false, false},
+		{"for this node", message(handset, raDriver, DEFAULT_TTL, 2), true, false},
+		{"for another node", message(handset, deDriver, DEFAULT_TTL, 3), false, true},
+		{"out of hops", message(handset, ADDR_BROADCAST, 1, 4), true, false},
+		{"from this node", message(raDriver, ADDR_BROADCAST, DEFAULT_TTL, 1), false, false},
+		{"legacy", Message{Version: VERSION_LEGACY, Header: Header{Dst: ADDR_BROADCAST}}, true, true},
+	}
+
+	for _, tt := range tests {
+		deliver, forward, next := r.Route(tt.message)
+		if deliver != tt.deliver || forward != tt.forward {
+			t.Errorf("%v: deliver %v forward %v, want %v %v", tt.name, deliver, forward, tt.deliver, tt.forward)
+		}
+		if forward && tt.message.Version == VERSION_2 && next.TTL != tt.message.Header.TTL-1 {
+			t.Errorf("%v: forwarded with TTL %v, want %v", tt.name, next.TTL, tt.message.Header.TTL-1)
+		}
+	}
+
+	stats := r.GetStats()
+	if stats.Duplicates != 1 || stats.Looped != 1 || stats.Expired != 1 || stats.Forwarded != 3 || stats.Delivered != 4 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// A copy of a legacy message that comes back round a ring is known by its content
+	legacy := Message{Version: VERSION_LEGACY, Header: Header{Dst: ADDR_BROADCAST}}
+	if deliver, forward, _ := r.Route(legacy); deliver || forward {
+		t.Errorf("legacy copy: deliver %v forward %v, want false false", deliver, forward)
+	}
+	clock.Advance(LEGACY_DEDUPE_WINDOW)
+	if deliver, forward, _ := r.Route(legacy); !deliver || !forward {
+		t.Errorf("legacy after the window: deliver %v forward %v, want true true", deliver, forward)
+	}
+
+	// After a restart the handset counts from 1 again, once the window is past that is not a copy
+	clock.Advance(DEDUPE_WINDOW)
+	if deliver, _, _ := r.Route(message(handset, ADDR_BROADCAST, DEFAULT_TTL, 1)); !deliver {
+		t.Error("an id seen before the window should be delivered")
+	}
+
+}
+
+func TestNewHeader(t *testing.T) {
+
+	if _, err := NewRouter(ADDR_BROADCAST); err == nil {
+		t.Error("NewRouter(ADDR_BROADCAST) should fail")
+	}
+
+	r, _ := NewRouter(2)
+	first := r.NewHeader(ADDR_BROADCAST)
+	second := r.NewHeader(5)
+	if first.Src != 2 || first.TTL != DEFAULT_TTL || second.Dst != 5 || second.ID == first.ID {
+		t.Errorf("headers %+v %+v", first, second)
+	}
+
+}
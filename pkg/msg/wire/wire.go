@@ -0,0 +1,161 @@
+// This package is the framing used on the UART message bus
+//
+// A message is a list of parts, the kind first then its fields, for example
+// ["RADriverCmd", "SetTracking", "On"]. Two framings are understood:
+//
+// The legacy framing, version 1, is the parts joined with | between ^ and ~
+//
+//	^RADriverCmd|SetTracking|On~
+//
+// It has no checksum and a part can not hold |, ^ or ~.
+//
+// The version 2 framing starts with FRAME_START and carries a version byte, the routing
+// header, a length, the parts each with their own length and a CRC-16, escaped so
+// FRAME_START, FRAME_ESCAPE, ^ and ~ never appear inside a frame
+//
+//	FRAME_START  version  src  dst  ttl  id (2 bytes)  length (2 bytes)  payload  CRC-16 (2 bytes)
+//	             |<-------------------------------- escaped --------------------------------->|
+//
+// The routing header is the source and destination node addresses, the hops left and an id
+// the source counts up, see Router. The payload is each part as a one byte length then its
+// bytes. The CRC-16 is CRC-16/CCITT-FALSE over everything from the version to the end of the
+// payload. Numbers are big endian.
+//
+// A node on the old firmware skips a version 2 frame as line noise since it never holds a ^.
+package wire
+
+import (
+	"errors"
+)
+
+// Framing bytes
+const (
+	FRAME_START  byte = 0x01 // SOH
+	FRAME_ESCAPE byte = 0x10 // DLE, the next byte is XOR FRAME_XOR
+	FRAME_XOR    byte = 0x40 // Not 0x20, that would swap ^ and ~
+
+	LEGACY_START byte = '^'
+	LEGACY_END   byte = '~'
+	LEGACY_SEP   byte = '|'
+)
+
+// Versions
+const (
+	VERSION_LEGACY byte = 1
+	VERSION_2      byte = 2
+)
+
+// Node addresses, each node on the bus has its own
+type Address byte
+
+const (
+	ADDR_NONE      Address = 0x00 // A node with no address, and the source of a legacy message
+	ADDR_BROADCAST Address = 0xFF // Every node
+)
+
+// The hops a message is sent with, more than the nodes on the bus
+const DEFAULT_TTL byte = 8
+
+// Limits, a part length is one byte
+const (
+	MAX_PART_SIZE    = 255
+	MAX_PAYLOAD_SIZE = 1024
+	MAX_LEGACY_SIZE  = 255
+
+	// The version, routing header and length
+	HEADER_SIZE = 8
+)
+
+// Where a message is from and to, a legacy message has no header and is read as a
+// broadcast from ADDR_NONE
+type Header struct {
+	Src Address
+	Dst Address
+	TTL byte
+	ID  uint16
+}
+
+// A message read off the bus and the framing it came in
+type Message struct {
+	Version byte
+	Header  Header
+	Parts   []string
+}
+
+// Returns the parts framed as version 2, an error if a part or the payload is too long
+func Encode(header Header, parts []string) ([]byte, error) {
+
+	payload := make([]byte, 0, 64)
+	for _, part := range parts {
+		if len(part) > MAX_PART_SIZE {
+			return nil, errors.New("part longer than 255 bytes")
+		}
+		payload = append(payload, byte(len(part)))
+		payload = append(payload, part...)
+	}
+
+	if len(payload) > MAX_PAYLOAD_SIZE {
+		return nil, errors.New("payload too long")
+	}
+
+	body := make([]byte, 0, len(payload)+HEADER_SIZE+2)
+	body = append(body, VERSION_2, byte(header.Src), byte(header.Dst), header.TTL, byte(header.ID>>8), byte(header.ID))
+	body = append(body, byte(len(payload)>>8), byte(len(payload)))
+	body = append(body, payload...)
+	crc := CRC16(body)
+	body = append(body, byte(crc>>8), byte(crc))
+
+	frame := make([]byte, 0, len(body)+8)
+	frame = append(frame, FRAME_START)
+	for _, b := range body {
+		if needsEscape(b) {
+			frame = append(frame, FRAME_ESCAPE, b^FRAME_XOR)
+		} else {
+			frame = append(frame, b)
+		}
+	}
+
+	return frame, nil
+}
+
+// Returns the parts framed as the legacy ^...~, an error if a part holds a framing byte
+func EncodeLegacy(parts []string) ([]byte, error) {
+
+	frame := []byte{LEGACY_START}
+	for i, part := range parts {
+		for j := 0; j < len(part); j++ {
+			if part[j] == LEGACY_START || part[j] == LEGACY_END || part[j] == LEGACY_SEP {
+				return nil, errors.New("part holds ^, ~ or |, it needs the version 2 framing")
+			}
+		}
+		if i > 0 {
+			frame = append(frame, LEGACY_SEP)
+		}
+		frame = append(frame, part...)
+	}
+	frame = append(frame, LEGACY_END)
+
+	return frame, nil
+}
+
+// Bytes that are escaped inside a version 2 frame
+func needsEscape(b byte) bool {
+	return b == FRAME_START || b == FRAME_ESCAPE || b == LEGACY_START || b == LEGACY_END
+}
+
+// CRC-16/CCITT-FALSE, polynomial 0x1021 starting from 0xFFFF
+func CRC16(data []byte) uint16 {
+
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,127 @@
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Feed all the bytes and return the messages decoded
+func feed(d *Decoder, data []byte) []Message {
+
+	var messages []Message
+	for _, b := range data {
+		if msg, ok := d.Feed(b); ok {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func TestCRC16(t *testing.T) {
+
+	// The CRC-16/CCITT-FALSE check value
+	if crc := CRC16([]byte("123456789")); crc != 0x29B1 {
+		t.Errorf("CRC16 = %#04x, want 0x29b1", crc)
+	}
+
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	tests := [][]string{
+		{"RADriverCmd", "SetTracking", "On"},
+		{"Foo", "a ~ and a | and a ^ in a name"},
+		{"Foo", string([]byte{FRAME_START, FRAME_ESCAPE, 0x00, 0xFF})},
+		{"Foo", ""},
+	}
+
+	header := Header{Src: 3, Dst: ADDR_BROADCAST, TTL: DEFAULT_TTL, ID: 0x5E01}
+
+	for _, parts := range tests {
+		frame, err := Encode(header, parts)
+		if err != nil {
+			t.Fatalf("Encode(%q): %v", parts, err)
+		}
+		if bytes.IndexByte(frame[1:], FRAME_START) >= 0 || bytes.ContainsAny(frame, "^~") {
+			t.Errorf("Encode(%q) = % x, framing bytes are not escaped", parts, frame)
+		}
+
+		messages := feed(NewDecoder(), frame)
+		if len(messages) != 1 || messages[0].Version != VERSION_2 || messages[0].Header != header || !reflect.DeepEqual(messages[0].Parts, parts) {
+			t.Errorf("decoded %+v, want %q", messages, parts)
+		}
+	}
+
+}
+
+func TestLegacy(t *testing.T) {
+
+	frame, err := EncodeLegacy([]string{"RADriverCmd", "SetTracking", "On"})
+	if err != nil || string(frame) != "^RADriverCmd|SetTracking|On~" {
+		t.Fatalf("EncodeLegacy = %q, %v", frame, err)
+	}
+
+	if _, err := EncodeLegacy([]string{"Foo", "a|b"}); err == nil {
+		t.Error("EncodeLegacy should refuse a part holding |")
+	}
+
+	messages := feed(NewDecoder(), append(frame, '\n'))
+	if len(messages) != 1 || messages[0].Version != VERSION_LEGACY || messages[0].Header.Dst != ADDR_BROADCAST || len(messages[0].Parts) != 3 {
+		t.Errorf("decoded %q", messages)
+	}
+
+}
+
+func TestResync(t *testing.T) {
+
+	header := Header{Src: 1, Dst: ADDR_BROADCAST, TTL: DEFAULT_TTL, ID: 7}
+	good, _ := Encode(header, []string{"Foo", "good"})
+	bad, _ := Encode(header, []string{"Foo", "bad"})
+
+	// A flipped bit fails the CRC
+	corrupt := append([]byte{}, bad...)
+	corrupt[len(corrupt)-3] ^= 0x04
+
+	var data []byte
+	data = append(data, "noise\x10\x02"...)
+	data = append(data, bad[:12]...) // cut short by the next frame
+	data = append(data, good...)
+	data = append(data, corrupt...)
+	data = append(data, "^Foo|cut"...) // cut short by the next frame
+	data = append(data, good...)
+	data = append(data, "^Foo|legacy~"...)
+
+	d := NewDecoder()
+	messages := feed(d, data)
+
+	want := []Message{
+		{VERSION_2, header, []string{"Foo", "good"}},
+		{VERSION_2, header, []string{"Foo", "good"}},
+		{VERSION_LEGACY, Header{Dst: ADDR_BROADCAST}, []string{"Foo", "legacy"}},
+	}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("decoded %q, want %q", messages, want)
+	}
+
+	stats := d.GetStats()
+	if stats.CRCErrors != 1 || stats.BadFrames != 2 || stats.Messages != 2 || stats.Legacy != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+}
+
+func TestLimits(t *testing.T) {
+
+	if _, err := Encode(Header{}, []string{string(make([]byte, MAX_PART_SIZE+1))}); err == nil {
+		t.Error("Encode should refuse a part longer than MAX_PART_SIZE")
+	}
+
+	// A header claiming a payload over the limit is dropped
+	d := NewDecoder()
+	feed(d, []byte{FRAME_START, VERSION_2, 5, 6, 3, 0, 7, 0x7F, 0xFF, 0x00})
+	if stats := d.GetStats(); stats.BadFrames != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+}
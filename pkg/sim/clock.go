@@ -0,0 +1,178 @@
+//go:build !tinygo
+
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+// A clock that runs Scale times faster than the wall clock
+//
+// Sleep sleeps for 1/Scale of the time asked for, so a driver sleeping for a second between
+// reads sees a second pass on Now while only 1/Scale of a second goes by
+type ScaledClock struct {
+	mu    sync.Mutex
+	scale float64
+
+	// The wall time and simulated time the clock started at
+	wallStart time.Time
+	simStart  time.Time
+}
+
+// Returns a clock starting at start and running scale times faster than the wall clock
+func NewScaledClock(start time.Time, scale float64) *ScaledClock {
+
+	if scale <= 0 {
+		scale = 1
+	}
+
+	return &ScaledClock{
+		scale:     scale,
+		wallStart: time.Now(),
+		simStart:  start,
+	}
+}
+
+func (c *ScaledClock) Now() time.Time {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elapsed := time.Since(c.wallStart)
+	return c.simStart.Add(time.Duration(float64(elapsed) * c.scale))
+}
+
+func (c *ScaledClock) Sleep(d time.Duration) {
+	time.Sleep(time.Duration(float64(d) / c.GetScale()))
+}
+
+func (c *ScaledClock) GetScale() float64 {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.scale
+}
+
+// Change the speed, the simulated time carries on from where it is
+func (c *ScaledClock) SetScale(scale float64) {
+
+	if scale <= 0 {
+		return
+	}
+
+	now := c.Now()
+
+	c.mu.Lock()
+	c.wallStart = time.Now()
+	c.simStart = now
+	c.scale = scale
+	c.mu.Unlock()
+
+}
+
+// How long Advance waits for a woken routine to sleep again, a routine that ends never does
+const STEP_CLOCK_SETTLE = time.Millisecond * 200
+
+// A clock that only moves when the test calls Advance, for tests that must not depend on how fast the host is
+//
+// Sleep blocks until the clock has been advanced past the wake time. Advance wakes the sleepers one at
+// a time in wake time order, and waits for each to sleep again before moving on, so every routine sees
+// the same times and the same order of events on every run.
+type StepClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []stepWaiter
+
+	// Signalled each time a routine goes to sleep
+	slept chan struct{}
+}
+
+type stepWaiter struct {
+	wake time.Time
+	ch   chan struct{}
+}
+
+// Returns a clock stopped at start
+func NewStepClock(start time.Time) *StepClock {
+	return &StepClock{
+		now:   start,
+		slept: make(chan struct{}, 1),
+	}
+}
+
+func (c *StepClock) Now() time.Time {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *StepClock) Sleep(d time.Duration) {
+
+	if d <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	waiter := stepWaiter{wake: c.now.Add(d), ch: make(chan struct{})}
+
+	// Keep the waiters in wake time order, sleepers with the same wake time in the order they slept
+	i := len(c.waiters)
+	for i > 0 && c.waiters[i-1].wake.After(waiter.wake) {
+		i--
+	}
+	c.waiters = append(c.waiters, stepWaiter{})
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = waiter
+	c.mu.Unlock()
+
+	select {
+	case c.slept <- struct{}{}:
+	default:
+	}
+
+	<-waiter.ch
+}
+
+// Move the clock on by d, waking the sleepers on the way
+func (c *StepClock) Advance(d time.Duration) {
+
+	c.mu.Lock()
+	target := c.now.Add(d)
+
+	for len(c.waiters) > 0 && !c.waiters[0].wake.After(target) {
+		waiter := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		c.now = waiter.wake
+		c.mu.Unlock()
+
+		// Forget earlier sleeps, then wait for the woken routine to sleep again
+		select {
+		case <-c.slept:
+		default:
+		}
+		close(waiter.ch)
+		select {
+		case <-c.slept:
+		case <-time.After(STEP_CLOCK_SETTLE):
+		}
+
+		c.mu.Lock()
+	}
+
+	c.now = target
+	c.mu.Unlock()
+
+}
+
+// Returns the number of routines sleeping on the clock
+func (c *StepClock) GetSleepers() int {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
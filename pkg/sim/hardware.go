@@ -0,0 +1,165 @@
+//go:build !tinygo
+
+package sim
+
+import (
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// The simulated pins, PWM and SPI bus wired to the Mount
+//
+// Every change brings the motor up to date first so the time before the change is
+// stepped at the old rate, direction and microstep
+
+// A pin on the mount
+type Pin struct {
+	mount *Mount
+	mode  hal.PinMode
+	value bool
+
+	// Called with the new level, with the mount locked
+	onSet func(value bool)
+}
+
+func (p *Pin) Configure(config hal.PinConfig) {
+
+	p.mount.mu.Lock()
+	defer p.mount.mu.Unlock()
+
+	p.mode = config.Mode
+	if config.Mode == hal.PinInputPullup {
+		p.value = true
+	}
+
+}
+
+func (p *Pin) High() {
+	p.Set(true)
+}
+
+func (p *Pin) Low() {
+	p.Set(false)
+}
+
+func (p *Pin) Set(value bool) {
+
+	p.mount.mu.Lock()
+	defer p.mount.mu.Unlock()
+
+	p.mount.advance()
+	p.value = value
+	if p.onSet != nil {
+		p.onSet(value)
+	}
+
+}
+
+func (p *Pin) Get() bool {
+
+	p.mount.mu.Lock()
+	defer p.mount.mu.Unlock()
+
+	return p.value
+}
+
+// The PWM slice driving the step pin, every pulse is one microstep
+type PWM struct {
+	mount  *Mount
+	period uint64
+	level  uint32
+}
+
+func (p *PWM) Configure(config hal.PWMConfig) error {
+	return p.SetPeriod(config.Period)
+}
+
+// There is only the step pin
+func (p *PWM) Channel(pin hal.Pin) (channel uint8, err error) {
+	return 0, nil
+}
+
+// A fixed top, only on or off matters to the model
+func (p *PWM) Top() uint32 {
+	return 0xFFFF
+}
+
+func (p *PWM) Set(channel uint8, value uint32) {
+
+	p.mount.mu.Lock()
+	defer p.mount.mu.Unlock()
+
+	p.mount.advance()
+	p.level = value
+
+}
+
+func (p *PWM) SetPeriod(period uint64) error {
+
+	p.mount.mu.Lock()
+	defer p.mount.mu.Unlock()
+
+	p.mount.advance()
+	p.period = period
+
+	return nil
+}
+
+// Returns the pulse rate, 0 if the PWM is off
+func (p *PWM) hz() float64 {
+
+	if p.period == 0 || p.level == 0 {
+		return 0
+	}
+	return 1e9 / float64(p.period)
+}
+
+// The SPI bus to the AMT22
+//
+// Pulling CS low latches the reading, the first byte out is the high byte with the check bits
+// and the second byte is the low byte. A second command byte of AMT22_ZERO zeroes the encoder,
+// AMT22_READ_TURNS sends the turn count in the next two bytes.
+type SPI struct {
+	mount *Mount
+
+	// The reading and turns latched when CS went low and the bytes sent so far
+	response uint16
+	turns    uint16
+	sent     int
+}
+
+func (s *SPI) Transfer(w byte) (byte, error) {
+
+	s.mount.mu.Lock()
+	defer s.mount.mu.Unlock()
+
+	var r byte
+	switch s.sent {
+	case 0:
+		r = byte(s.response >> 8)
+	case 1:
+		r = byte(s.response)
+		if w == encoder.AMT22_ZERO {
+			s.mount.zeroEncoder()
+		}
+	case 2:
+		r = byte(s.turns >> 8)
+	case 3:
+		r = byte(s.turns)
+	}
+	s.sent++
+
+	return r, nil
+}
+
+// Called with the mount locked when CS changes, CS is active low
+func (s *SPI) chipSelect(level bool) {
+
+	if level {
+		return
+	}
+
+	s.sent = 0
+	s.response, s.turns = s.mount.encoderResponse()
+
+}
@@ -0,0 +1,384 @@
+//go:build !tinygo
+
+// This package simulates the RA axis so the driver, encoder and tracking loop can run on the host
+//
+// The model follows the real mount, the PWM steps the motor, the motor turns the 48:16 belt and
+// the belt turns the 144:1 worm. The AMT22 is on the motor shaft and reads 14 bits that wrap once
+// per motor turn, with the two check bits. Time runs on a ScaledClock so a night of tracking can
+// run in minutes, tests run it on a StepClock so they do not depend on how fast the host is.
+//
+// Faults can be added, periodic error in the worm, backlash in the gears, a stalled motor and
+// corrupt SPI replies.
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/driver"
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+const ARCSEC_PER_REVOLUTION = 1_296_000
+
+type Config struct {
+	// The motor and gear train, the same values given to the driver
+	StepsPerRevolution int32
+	MaxHz              int32
+	MaxMicroStep       driver.MicroStep
+	WormRatio          int32
+	GearRatio          int32
+
+	// The AMT22, encoder.RES12 or encoder.RES14, and whether it is the multi-turn part
+	Resolution int8
+	MultiTurn  bool
+
+	// How much faster than the wall clock the simulation runs
+	Scale float64
+
+	// Periodic error at the axis, peak in arc seconds, with one period per worm turn
+	//
+	// The error is added to the motor angle the encoder reads as well as to the axis, as if the
+	// worm load pulled the motor off its step, so the tracking loop and PEC can see it
+	PeriodicErrorArcsec float64
+
+	// Play in the gear train in arc seconds at the axis, the motor turns through it on a reversal
+	// before the axis moves, the encoder on the motor shaft does not see it
+	BacklashArcsec float64
+
+	// Full steps the rotor trails the step it was given while it drives the gears, none inside the play
+	//
+	// This is the only sign of the play the encoder on the motor shaft gets, the backlash calibration
+	// looks for it
+	LoadLagSteps float64
+
+	// The fraction of encoder reads with one bit flipped, the check bits catch these
+	SPIErrorRate float64
+
+	// Random encoder noise in counts, the reading is off by up to this many counts either way
+	EncoderNoiseCounts int
+
+	// Seed for the SPI errors and encoder noise
+	Seed int64
+}
+
+// Returns the cmd/ra-driver mount, 400 steps at 1/16, 48:16 belt and a 144:1 worm, at 60x
+func DefaultConfig() Config {
+	return Config{
+		StepsPerRevolution: 400,
+		MaxHz:              1000,
+		MaxMicroStep:       driver.MS_SIXTEENTH,
+		WormRatio:          144,
+		GearRatio:          3,
+		Resolution:         encoder.RES14,
+		Scale:              60,
+		Seed:               1,
+	}
+}
+
+// A simulated RA axis
+type Mount struct {
+	mu     sync.Mutex
+	config Config
+	clock  hal.Clock
+	rand   *rand.Rand
+
+	// The hardware the driver is given
+	step       *Pin
+	direction  *Pin
+	microStep1 *Pin
+	microStep2 *Pin
+	enable     *Pin
+	cs         *Pin
+	pwm        *PWM
+	spi        *SPI
+
+	// The motor angle in turns, forward is positive
+	motorTurns float64
+
+	// The axis angle in motor turns, it lags the motor by up to half the backlash
+	axisTurns float64
+
+	// 1 while the motor drives the gears forward, -1 in reverse and 0 inside the play
+	engaged float64
+
+	// The motor angle the encoder was zeroed at
+	zeroTurns float64
+
+	// The time the motor was last brought up to date
+	lastUpdate time.Time
+
+	// Fault injection
+	stalled bool
+
+	// Encoder reads and the reads that were corrupted
+	reads    int
+	badReads int
+}
+
+// Returns a new Mount on a ScaledClock, the simulated time starts at start
+func NewMount(config Config, start time.Time) *Mount {
+	return NewMountOnClock(config, NewScaledClock(start, config.Scale))
+}
+
+// Returns a new Mount on the clock, for example a StepClock, config.Scale is not used
+func NewMountOnClock(config Config, clock hal.Clock) *Mount {
+
+	m := &Mount{
+		config:     config,
+		clock:      clock,
+		rand:       rand.New(rand.NewSource(config.Seed)),
+		lastUpdate: clock.Now(),
+	}
+
+	m.step = &Pin{mount: m}
+	m.direction = &Pin{mount: m}
+	m.microStep1 = &Pin{mount: m}
+	m.microStep2 = &Pin{mount: m}
+	m.enable = &Pin{mount: m, value: true} // Disabled, the enable pin is active low
+	m.pwm = &PWM{mount: m}
+	m.spi = &SPI{mount: m}
+	m.cs = &Pin{mount: m, value: true, onSet: m.spi.chipSelect}
+
+	return m
+}
+
+// Returns an RADriver wired to the mount and running on its clock, call Configure next
+func (m *Mount) NewRADriver() (driver.RADriver, error) {
+
+	c := m.config
+	enc, err := encoder.NewAMT22(m.spi, m.cs, c.Resolution)
+	if err != nil {
+		return driver.RADriver{}, err
+	}
+	enc.SetMultiTurn(c.MultiTurn)
+
+	ra, err := driver.NewRADriver(
+		m.step,
+		m.pwm,
+		m.direction,
+		c.StepsPerRevolution,
+		c.MaxHz,
+		m.microStep1,
+		m.microStep2,
+		c.MaxMicroStep,
+		m.enable,
+		c.WormRatio,
+		c.GearRatio,
+		enc,
+	)
+	if err != nil {
+		return driver.RADriver{}, err
+	}
+	ra.SetClock(m.clock)
+
+	return ra, nil
+}
+
+func (m *Mount) GetClock() hal.Clock {
+	return m.clock
+}
+
+// Stop the motor turning while it is still stepped, as if it had stalled
+func (m *Mount) SetStalled(stalled bool) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance()
+	m.stalled = stalled
+
+}
+
+// Returns the motor angle in turns
+func (m *Mount) GetMotorTurns() float64 {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance()
+	return m.motorTurns
+}
+
+// Returns the axis angle in arc seconds with the periodic error and backlash, this is where the
+// telescope is pointing
+func (m *Mount) GetAxisArcsec() float64 {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance()
+	return m.axisTurns/m.reduction()*ARCSEC_PER_REVOLUTION + m.periodicErrorArcsec()
+}
+
+// Returns the pulse rate the motor is being stepped at, 0 if it is disabled
+func (m *Mount) GetStepHz() float64 {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.enable.value {
+		return 0
+	}
+	return m.pwm.hz()
+}
+
+// Returns the number of encoder reads and the number that were corrupted
+func (m *Mount) GetReads() (reads int, badReads int) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.reads, m.badReads
+}
+
+// Motor turns for one turn of the axis
+func (m *Mount) reduction() float64 {
+	return float64(m.config.WormRatio) * float64(m.config.GearRatio)
+}
+
+// Returns the microstep set on the MS pins
+//
+//	ms1  ms2  Steps
+//	---  ---  -----
+//	 H    L   1/2
+//	 L    H   1/4
+//	 L    L   1/8
+//	 H    H   1/16
+func (m *Mount) microStep() float64 {
+
+	switch {
+	case m.microStep1.value && !m.microStep2.value:
+		return 2
+	case !m.microStep1.value && m.microStep2.value:
+		return 4
+	case !m.microStep1.value && !m.microStep2.value:
+		return 8
+	default:
+		return 16
+	}
+
+}
+
+// Step the motor from the last update to now, called with the mount locked
+func (m *Mount) advance() {
+
+	now := m.clock.Now()
+	elapsed := now.Sub(m.lastUpdate).Seconds()
+	m.lastUpdate = now
+
+	// The enable pin is active low
+	if elapsed <= 0 || m.enable.value || m.stalled {
+		return
+	}
+
+	turns := m.pwm.hz() * elapsed / (float64(m.config.StepsPerRevolution) * m.microStep())
+	if !m.direction.value {
+		turns = -turns
+	}
+	m.motorTurns += turns
+
+	// The axis only moves once the motor has taken up the play
+	play := m.config.BacklashArcsec / ARCSEC_PER_REVOLUTION * m.reduction()
+	if m.motorTurns-m.axisTurns > play/2 {
+		m.axisTurns = m.motorTurns - play/2
+		m.engaged = 1
+	} else if m.axisTurns-m.motorTurns > play/2 {
+		m.axisTurns = m.motorTurns + play/2
+		m.engaged = -1
+	} else if turns != 0 {
+		m.engaged = 0
+	}
+
+}
+
+// Returns the periodic error at the axis in arc seconds, called with the mount locked
+func (m *Mount) periodicErrorArcsec() float64 {
+
+	if m.config.PeriodicErrorArcsec == 0 {
+		return 0
+	}
+
+	// The worm turns once for every GearRatio motor turns
+	wormTurns := m.axisTurns / float64(m.config.GearRatio)
+	return m.config.PeriodicErrorArcsec * math.Sin(2*math.Pi*wormTurns)
+}
+
+// Returns the encoder counts in one motor turn
+func (m *Mount) countsPerRevolution() int64 {
+
+	if m.config.Resolution == encoder.RES12 {
+		return int64(encoder.COUNTS_12)
+	}
+	return int64(encoder.COUNTS_14)
+}
+
+// Returns the 16 bit AMT22 position and turns replies for the motor angle now, called with the mount locked
+func (m *Mount) encoderResponse() (response uint16, turnsResponse uint16) {
+
+	m.advance()
+	m.reads++
+
+	turns := m.motorTurns - m.zeroTurns
+	turns += m.periodicErrorArcsec() / ARCSEC_PER_REVOLUTION * m.reduction()
+	turns -= m.engaged * m.config.LoadLagSteps / float64(m.config.StepsPerRevolution)
+
+	countsPerRevolution := m.countsPerRevolution()
+	counts := int64(math.Floor(turns * float64(countsPerRevolution)))
+	if n := m.config.EncoderNoiseCounts; n > 0 {
+		counts += int64(m.rand.Intn(2*n+1) - n)
+	}
+
+	// Wraps once per motor turn, a 12 bit part leaves the two lowest of the 14 bits at zero
+	wholeTurns := counts / countsPerRevolution
+	reading := counts % countsPerRevolution
+	if reading < 0 {
+		reading += countsPerRevolution
+		wholeTurns--
+	}
+	if m.config.Resolution == encoder.RES12 {
+		reading <<= 2
+	}
+	response = uint16(reading) | checkBits(uint16(reading))
+
+	// The turns are 14 bit two's complement
+	turnsBits := uint16(wholeTurns) & 0x3FFF
+	turnsResponse = turnsBits | checkBits(turnsBits)
+
+	if m.config.SPIErrorRate > 0 && m.rand.Float64() < m.config.SPIErrorRate {
+		response ^= 1 << m.rand.Intn(16)
+		m.badReads++
+	}
+
+	return response, turnsResponse
+}
+
+// Zero the encoder at the motor angle now, called with the mount locked
+func (m *Mount) zeroEncoder() {
+
+	m.advance()
+	m.zeroTurns = m.motorTurns
+
+}
+
+// Returns the AMT22 check bits for a 14 bit reading
+//
+//	K1 = !(H5^H3^H1^L7^L5^L3^L1)  the odd bits, bit 15
+//	K0 = !(H4^H2^H0^L6^L4^L2^L0)  the even bits, bit 14
+func checkBits(reading uint16) uint16 {
+
+	var odd, even uint16
+	for i := 0; i < 14; i++ {
+		bit := (reading >> i) & 1
+		if i%2 == 0 {
+			even ^= bit
+		} else {
+			odd ^= bit
+		}
+	}
+
+	return (odd^1)<<15 | (even^1)<<14
+}
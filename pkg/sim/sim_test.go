@@ -0,0 +1,377 @@
+//go:build !tinygo
+
+package sim
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/astroeq/pkg/driver"
+	"github.com/tonygilkerson/astroeq/pkg/encoder"
+	"github.com/tonygilkerson/astroeq/pkg/hal"
+)
+
+// Returns an AMT22 on the simulated SPI bus
+func newTestAMT22(t *testing.T, m *Mount, resolution int8) *encoder.AMT22 {
+
+	enc, err := encoder.NewAMT22(m.spi, m.cs, resolution)
+	if err != nil {
+		t.Fatalf("NewAMT22: %v", err)
+	}
+	return enc
+}
+
+func TestCheckBits(t *testing.T) {
+
+	// The datasheet example, 0x61AB is a good reply for 0x21AB
+	if bits := checkBits(0x21AB); bits != 0x4000 {
+		t.Errorf("checkBits(0x21AB) = %#04x, want 0x4000", bits)
+	}
+
+}
+
+func TestEncoderReadsMotor(t *testing.T) {
+
+	// Forward, and back past home, a read a second
+	for _, sequence := range [][]float64{
+		{0.25, 0.5, 0.75, 1, 1.25},
+		{0, -0.25, -0.5, -0.75, -1.25},
+	} {
+		m := NewMount(DefaultConfig(), time.Now())
+		clock := hal.NewFakeClock(time.Now())
+
+		enc := newTestAMT22(t, m, encoder.RES14)
+		enc.SetClock(clock)
+
+		for _, turns := range sequence {
+			m.mu.Lock()
+			m.motorTurns = turns
+			m.mu.Unlock()
+
+			position, err := enc.GetPosition()
+			if err != nil {
+				t.Fatalf("GetPosition: %v", err)
+			}
+			if want := int64(turns * float64(encoder.COUNTS_14)); position != want {
+				t.Errorf("%v turns: position %v, want %v", turns, position, want)
+			}
+
+			clock.Advance(time.Second)
+		}
+	}
+
+}
+
+func TestEncoderResolutionAndTurns(t *testing.T) {
+
+	config := DefaultConfig()
+	config.Resolution = encoder.RES12
+	m := NewMount(config, time.Now())
+
+	enc := newTestAMT22(t, m, encoder.RES12)
+	enc.SetMultiTurn(true)
+
+	// The multi-turn part knows the turns however far apart the reads are
+	m.mu.Lock()
+	m.motorTurns = 3.5
+	m.mu.Unlock()
+
+	position, err := enc.GetPosition()
+	if err != nil {
+		t.Fatalf("GetPosition: %v", err)
+	}
+	if want := int64(3.5 * float64(encoder.COUNTS_12)); position != want {
+		t.Errorf("position %v, want %v", position, want)
+	}
+
+}
+
+func TestSPIErrors(t *testing.T) {
+
+	config := DefaultConfig()
+	config.SPIErrorRate = 1
+	m := NewMount(config, time.Now())
+
+	enc := newTestAMT22(t, m, encoder.RES14)
+
+	if _, err := enc.GetPosition(); err == nil {
+		t.Error("a corrupt reply should fail the parity check")
+	}
+
+	// The read is tried again before it fails
+	tries := 1 + encoder.ENCODER_READ_RETRIES
+	if reads, badReads := m.GetReads(); reads != tries || badReads != tries {
+		t.Errorf("GetReads = %v, %v, want %v, %v", reads, badReads, tries, tries)
+	}
+	if stats := enc.GetStats(); stats.FailedReads != 1 || stats.ParityFailures != uint32(tries) {
+		t.Errorf("stats = %+v", stats)
+	}
+
+}
+
+func TestBacklash(t *testing.T) {
+
+	config := DefaultConfig()
+	config.BacklashArcsec = 60
+	m := NewMount(config, time.Now())
+
+	play := 60.0 / ARCSEC_PER_REVOLUTION * m.reduction()
+
+	m.mu.Lock()
+	m.enable.value = false
+	m.direction.value = true
+	m.pwm.period = 1e6 // 1000 Hz
+	m.pwm.level = 1
+	m.lastUpdate = m.clock.Now().Add(-time.Second)
+	m.advance()
+	forward := m.axisTurns
+
+	// Back by less than the play, the axis does not move
+	m.direction.value = false
+	m.motorTurns -= play / 2
+	m.enable.value = true
+	m.advance()
+	back := m.axisTurns
+	m.mu.Unlock()
+
+	if forward != back {
+		t.Errorf("the axis moved from %v to %v inside the play", forward, back)
+	}
+
+}
+
+// Returns a configured RA driver on a mount that runs on a StepClock, once its routines are asleep
+func newTestRADriver(t *testing.T, config Config) (*Mount, *StepClock, *driver.RADriver) {
+
+	clock := NewStepClock(time.Now())
+	m := NewMountOnClock(config, clock)
+	ra, err := m.NewRADriver()
+	if err != nil {
+		t.Fatalf("NewRADriver: %v", err)
+	}
+
+	// Zeroing the encoder sleeps on the clock, step it until Configure returns
+	done := make(chan struct{})
+	go func() {
+		ra.Configure()
+		close(done)
+	}()
+	for configured := false; !configured; {
+		select {
+		case <-done:
+			configured = true
+		default:
+			if clock.GetSleepers() > 0 {
+				clock.Advance(encoder.AMT22_STARTUP)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	// The monitor and tracking routines
+	deadline := time.Now().Add(time.Second)
+	for clock.GetSleepers() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v routines asleep, want 2", clock.GetSleepers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return m, clock, &ra
+}
+
+func TestTracking(t *testing.T) {
+
+	m, clock, ra := newTestRADriver(t, DefaultConfig())
+
+	start := m.GetAxisArcsec()
+
+	ra.RunAtSiderealRate()
+	ra.SetTracking(driver.RA_TRACKING_ON)
+
+	clock.Advance(time.Minute)
+
+	moved := m.GetAxisArcsec() - start
+	want := driver.SIDEREAL_RATE_ARCSEC * time.Minute.Seconds()
+
+	// Within a second of sidereal time
+	if math.Abs(moved-want) > driver.SIDEREAL_RATE_ARCSEC {
+		t.Errorf("moved %.1f arcsec in a minute, want %.1f arcsec", moved, want)
+	}
+	if fault := ra.GetFault(); fault != driver.FAULT_NONE {
+		t.Errorf("GetFault = %q, want none", fault)
+	}
+
+}
+
+func TestStallFault(t *testing.T) {
+
+	m, clock, ra := newTestRADriver(t, DefaultConfig())
+
+	ra.RunAtSiderealRate()
+	ra.SetTracking(driver.RA_TRACKING_ON)
+	m.SetStalled(true)
+
+	// Two windows to be sure one is full
+	clock.Advance(3 * driver.WATCHDOG_WINDOW)
+
+	if fault := ra.GetFault(); fault != driver.FAULT_STALL {
+		t.Errorf("GetFault = %q, want %q", fault, driver.FAULT_STALL)
+	}
+	if ra.IsEnabled() {
+		t.Error("the motor is still enabled after a stall")
+	}
+
+}
+
+func TestEncoderFault(t *testing.T) {
+
+	config := DefaultConfig()
+	config.SPIErrorRate = 1
+	_, clock, ra := newTestRADriver(t, config)
+
+	ra.RunAtSiderealRate()
+	ra.SetTracking(driver.RA_TRACKING_ON)
+
+	// The position is read every POSITION_INTERVAL, leave time for plenty of failed reads
+	clock.Advance(4 * encoder.ENCODER_UNHEALTHY_FAILURES * driver.POSITION_INTERVAL)
+
+	if ra.IsEncoderHealthy() {
+		t.Errorf("encoder healthy, stats %+v", ra.GetEncoderStats())
+	}
+	if fault := ra.GetFault(); fault != driver.FAULT_ENCODER {
+		t.Errorf("GetFault = %q, want %q", fault, driver.FAULT_ENCODER)
+	}
+	if ra.IsEnabled() {
+		t.Error("the motor is still enabled with an unhealthy encoder")
+	}
+
+}
+
+// Calibrate the backlash and wait for it to end
+func calibrateBacklash(t *testing.T, clock *StepClock, ra *driver.RADriver) {
+
+	ra.RunAtSiderealRate()
+	ra.SetTracking(driver.RA_TRACKING_ON)
+
+	if err := ra.CalibrateBacklash(); err != nil {
+		t.Fatalf("CalibrateBacklash: %v", err)
+	}
+
+	// The calibration routine joins the monitor and tracking routines
+	deadline := time.Now().Add(time.Second)
+	for clock.GetSleepers() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v routines asleep, want 3", clock.GetSleepers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Minute)
+	if ra.IsCalibratingBacklash() {
+		t.Fatal("still calibrating after a minute")
+	}
+
+}
+
+func TestCalibrateBacklash(t *testing.T) {
+
+	config := DefaultConfig()
+	config.BacklashArcsec = 60
+	config.LoadLagSteps = 0.5
+	m, clock, ra := newTestRADriver(t, config)
+
+	calibrateBacklash(t, clock, ra)
+
+	if err := ra.GetBacklashCalibrationError(); err != nil {
+		t.Fatalf("calibration failed: %v", err)
+	}
+
+	// Within two encoder readings at the sidereal rate
+	want := config.BacklashArcsec / ARCSEC_PER_REVOLUTION * m.reduction() * float64(m.countsPerRevolution())
+	counts, _ := ra.GetBacklash()
+	if math.Abs(float64(counts)-want) > 8 {
+		t.Errorf("backlash = %v counts, want %.0f", counts, want)
+	}
+
+	// Tracking resumes
+	if !ra.IsEnabled() || ra.GetAxisDirection() != driver.AXIS_FORWARD || ra.GetRunningHz() == 0 {
+		t.Errorf("enabled %v, direction %v at %v Hz after the calibration, want tracking forward", ra.IsEnabled(), ra.GetAxisDirection(), ra.GetRunningHz())
+	}
+
+}
+
+func TestCalibrateBacklashNoLoad(t *testing.T) {
+
+	// With no load lag the encoder can not tell the slack from the gears engaged
+	config := DefaultConfig()
+	config.BacklashArcsec = 60
+	_, clock, ra := newTestRADriver(t, config)
+
+	calibrateBacklash(t, clock, ra)
+
+	if err := ra.GetBacklashCalibrationError(); err == nil {
+		t.Error("calibration with no load seen should fail")
+	}
+	if counts, _ := ra.GetBacklash(); counts != 0 {
+		t.Errorf("backlash = %v counts after a failed calibration, want 0", counts)
+	}
+
+}
+
+// Returns the largest tracking error seen over d, read once a second
+func maxTrackingError(clock *StepClock, ra *driver.RADriver, d time.Duration) float64 {
+
+	var worst float64
+	for t := time.Duration(0); t < d; t += time.Second {
+		clock.Advance(time.Second)
+		worst = math.Max(worst, math.Abs(ra.GetTrackingError()))
+	}
+	return worst
+}
+
+func TestPEC(t *testing.T) {
+
+	config := DefaultConfig()
+	config.PeriodicErrorArcsec = 10
+	_, clock, ra := newTestRADriver(t, config)
+
+	ra.RunAtSiderealRate()
+	ra.SetTracking(driver.RA_TRACKING_ON)
+
+	// Let the loop settle, then record for a worm turn and a little
+	wormTurn := time.Duration(driver.SIDEREAL_DAY_IN_SECONDS / float64(config.WormRatio) * float64(time.Second))
+	clock.Advance(time.Minute)
+	if err := ra.StartPECRecording(); err != nil {
+		t.Fatalf("StartPECRecording: %v", err)
+	}
+	without := maxTrackingError(clock, ra, wormTurn+time.Minute)
+	if state := ra.GetPECState(); state != driver.PEC_OFF {
+		t.Fatalf("PEC %v after a worm turn, want %v", state, driver.PEC_OFF)
+	}
+
+	// The encoder runs fast while the error grows, the loop slows the motor, so the table follows
+	// the opposite of the rate of change of the error
+	var dot, norm float64
+	for bin, correction := range ra.GetPECTable() {
+		want := -math.Cos(2 * math.Pi * float64(bin) / driver.PEC_BINS)
+		dot += correction * want
+		norm += correction * correction
+	}
+	if fit := dot / math.Sqrt(norm*driver.PEC_BINS/2); fit < 0.9 {
+		t.Errorf("the PEC table fits the worm error by %.2f, want at least 0.9", fit)
+	}
+
+	// Played back the loop is left with less to do, once it has let go of the correction it was making
+	if err := ra.SetPECPlayback(true); err != nil {
+		t.Fatalf("SetPECPlayback: %v", err)
+	}
+	clock.Advance(time.Minute)
+	with := maxTrackingError(clock, ra, wormTurn)
+	if with > without/2 {
+		t.Errorf("largest tracking error %.1f counts with PEC, %.1f without, want less than half", with, without)
+	}
+
+}